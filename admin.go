@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// checkAdminToken reports whether the request carries the configured admin
+// token as a bearer token. Admin endpoints are disabled when no token is set.
+func checkAdminToken(r *http.Request) bool {
+	if appConfig.AdminToken == "" {
+		return false
+	}
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(token), []byte(appConfig.AdminToken)) == 1
+}
+
+// withAdminAuth wraps a management handler, such as /upload-status,
+// /upload-cancel and /submissions, so it only runs for requests carrying the
+// admin token. The upload routes the form calls must stay public.
+func withAdminAuth(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !checkAdminToken(r) {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="admin"`)
+			jsonError(w, "Missing or invalid admin token.", http.StatusUnauthorized)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// handleSubmissions lists the Nextcloud folders created for an email address,
+// so support staff can see what someone uploaded before. With
+// HASH_FOLDER_IDENTIFIERS the folders are matched on the hashed address.
+func handleSubmissions(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	email := strings.TrimSpace(r.URL.Query().Get("email"))
+	if email == "" {
+		jsonError(w, "Missing email parameter.", http.StatusBadRequest)
+		return
+	}
+	fragment := sanitizeFolderName(folderIdentifier(sanitizeEmailForFolder(email)))
+
+	if s3Backend != nil {
+		jsonError(w, "Listing submissions requires the Nextcloud backend.", http.StatusNotImplemented)
+		return
+	}
+	folders, err := submissionFolders(r.Context())
+	if err != nil {
+		loggerFrom(r.Context()).Error("Could not list Nextcloud folders", "error", err)
+		jsonError(w, "Could not list submissions.", http.StatusBadGateway)
+		return
+	}
+
+	submissions := []FolderInfo{}
+	for _, folder := range folders {
+		if strings.Contains(folder.Name, fragment) {
+			submissions = append(submissions, folder)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"email":       email,
+		"submissions": submissions,
+	})
+}
+
+// submissionFolders lists the upload folders, including those filed below the
+// category folders of DATA_ORIGIN_CATEGORIES, which are named category/folder
+func submissionFolders(ctx context.Context) ([]FolderInfo, error) {
+	folders, err := nextcloud.ListFolders(ctx, "")
+	if err != nil {
+		return nil, err
+	}
+	categories := make(map[string]bool)
+	for _, category := range appConfig.DataOriginCategories {
+		categories[sanitizeFolderName(category)] = true
+	}
+	for _, category := range slices.Sorted(maps.Keys(categories)) {
+		inCategory, err := nextcloud.ListFolders(ctx, category)
+		if err != nil {
+			return nil, fmt.Errorf("category %s: %w", category, err)
+		}
+		for _, folder := range inCategory {
+			folder.Name = category + "/" + folder.Name
+			folders = append(folders, folder)
+		}
+	}
+	return folders, nil
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// AuditEntry records one /upload-complete attempt for compliance purposes.
+// Unlike the operational logs it is written for rejected requests too.
+type AuditEntry struct {
+	Time       time.Time `json:"time"`
+	RequestID  string    `json:"requestId,omitempty"`
+	ClientIP   string    `json:"clientIp"` // Salted hash with HASH_CLIENT_IP
+	UserAgent  string    `json:"userAgent,omitempty"`
+	UploadID   string    `json:"uploadId,omitempty"`
+	SessionID  string    `json:"sessionId,omitempty"`
+	Email      string    `json:"email,omitempty"`
+	Phone      string    `json:"phone,omitempty"`
+	FileName   string    `json:"fileName,omitempty"`
+	FolderName string    `json:"folderName,omitempty"`
+	Size       int64     `json:"size"`
+	Outcome    string    `json:"outcome"` // success, rejected, failed or aborted
+	Status     int       `json:"status"`
+	Code       string    `json:"code,omitempty"`
+	Error      string    `json:"error,omitempty"`
+}
+
+// auditLog is the audit log used by the HTTP handlers, nil when AUDIT_LOG_FILE is unset
+var auditLog *auditLogger
+
+// auditLogger appends entries as JSON lines to a file
+type auditLogger struct {
+	mu   sync.Mutex
+	file *os.File
+}
+
+// openAuditLog opens path for appending, creating it if needed
+func openAuditLog(path string) (*auditLogger, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("could not open audit log %s: %w", path, err)
+	}
+	return &auditLogger{file: file}, nil
+}
+
+// write appends entry as a single line, so concurrent entries never interleave
+func (a *auditLogger) write(entry *AuditEntry) error {
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	_, err = a.file.Write(append(line, '\n'))
+	return err
+}
+
+// record completes entry from the response captured by recorder and writes it
+func (a *auditLogger) record(r *http.Request, entry *AuditEntry, recorder *auditRecorder) {
+	entry.Time = time.Now().UTC()
+	entry.RequestID = recorder.Header().Get(requestIDHeader)
+	entry.Status = recorder.status
+
+	// The last JSON object written is the error response or the final progress event
+	var last struct {
+		Code  string `json:"code"`
+		Error string `json:"error"`
+	}
+	json.Unmarshal(bytes.TrimSpace(recorder.last), &last)
+	entry.Code, entry.Error = last.Code, last.Error
+
+	switch {
+	case recorder.status == 0:
+		entry.Outcome = "aborted"
+	case recorder.status >= 500 || (recorder.status < 400 && entry.Error != ""):
+		entry.Outcome = "failed"
+	case recorder.status >= 400:
+		entry.Outcome = "rejected"
+	default:
+		entry.Outcome = "success"
+	}
+
+	if err := a.write(entry); err != nil {
+		loggerFrom(r.Context()).Error("Could not write audit log entry", "error", err)
+	}
+}
+
+// auditRecorder passes a response through while keeping its status and the
+// last write, which holds the JSON outcome of the request
+type auditRecorder struct {
+	http.ResponseWriter
+	status int
+	last   []byte
+}
+
+func (a *auditRecorder) WriteHeader(status int) {
+	if a.status == 0 {
+		a.status = status
+	}
+	a.ResponseWriter.WriteHeader(status)
+}
+
+func (a *auditRecorder) Write(p []byte) (int, error) {
+	if a.status == 0 {
+		a.status = http.StatusOK
+	}
+	if len(p) <= 4<<10 {
+		a.last = append(a.last[:0], p...)
+	}
+	return a.ResponseWriter.Write(p)
+}
+
+// Flush keeps progress streams working through the recorder
+func (a *auditRecorder) Flush() {
+	if flusher, ok := a.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (a *auditRecorder) Unwrap() http.ResponseWriter {
+	return a.ResponseWriter
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"path"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awsconfig "github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/smithy-go"
+)
+
+// UploadBackend stores assembled uploads. The upload handlers only rely on
+// these operations, so the chunk and session handling works the same for
+// every backend. Nextcloud-only features (shares, WebDAV properties,
+// submission listing) are used when the backend is a *NextcloudClient.
+type UploadBackend interface {
+	// CreateFolder creates a folder; creating an existing folder is not an error.
+	CreateFolder(ctx context.Context, folderName string) error
+	// PutFile stores data as filename inside folderName, replacing any existing file.
+	PutFile(ctx context.Context, folderName, filename string, data io.Reader) error
+	// CreateFile stores data as filename inside folderName unless that file
+	// already exists, in which case it returns errFileExists. The check and the
+	// write are one atomic operation on the storage side.
+	CreateFile(ctx context.Context, folderName, filename string, data io.Reader) error
+	// FileExists reports whether filename exists inside folderName.
+	FileExists(ctx context.Context, folderName, filename string) bool
+	// DeleteFile removes a file; deleting a missing file is not an error.
+	DeleteFile(ctx context.Context, folderName, filename string) error
+	// CheckConnectivity checks that the storage is reachable with the configured credentials.
+	CheckConnectivity(ctx context.Context) error
+}
+
+// errFileExists is returned by CreateFile when the file is already there
+var errFileExists = errors.New("file already exists")
+
+// s3Backend is set when BACKEND=s3 and then receives all uploads
+var s3Backend *S3Backend
+
+// backendForSession returns the backend uploads of the session are stored in
+func backendForSession(ctx context.Context, sessionID string) (UploadBackend, error) {
+	if s3Backend != nil {
+		return s3Backend, nil
+	}
+	nc, err := nextcloudForSession(ctx, sessionID)
+	if err != nil {
+		return nil, err
+	}
+	// Sessions that picked a target upload to that target alone
+	if nc == nextcloud && replicaSet != nil {
+		return replicaSet, nil
+	}
+	return nc, nil
+}
+
+// defaultBackend returns the backend used outside of sessions, e.g. by health checks
+func defaultBackend() UploadBackend {
+	if s3Backend != nil {
+		return s3Backend
+	}
+	if replicaSet != nil {
+		return replicaSet
+	}
+	return nextcloud
+}
+
+// S3Backend stores uploads as objects in an S3-compatible bucket. Folders are
+// key prefixes below Prefix, so they need not be created.
+type S3Backend struct {
+	Client *s3.Client
+	Bucket string
+	Prefix string // Key prefix playing the role of NC_FOLDER
+	DryRun bool   // Log requests instead of sending them
+
+	UploadTimeout time.Duration
+	HeadTimeout   time.Duration
+
+	uploader *manager.Uploader
+}
+
+// newS3Backend creates a backend for the bucket in cfg. Credentials not set in
+// cfg come from the usual AWS sources (environment, shared config, instance role).
+func newS3Backend(cfg Config) (*S3Backend, error) {
+	var options []func(*awsconfig.LoadOptions) error
+	if cfg.S3Region != "" {
+		options = append(options, awsconfig.WithRegion(cfg.S3Region))
+	}
+	if cfg.S3AccessKeyID != "" {
+		options = append(options, awsconfig.WithCredentialsProvider(
+			credentials.NewStaticCredentialsProvider(cfg.S3AccessKeyID, cfg.S3SecretAccessKey, ""),
+		))
+	}
+	awsCfg, err := awsconfig.LoadDefaultConfig(context.Background(), options...)
+	if err != nil {
+		return nil, fmt.Errorf("could not load S3 configuration: %w", err)
+	}
+
+	client := s3.NewFromConfig(awsCfg, func(o *s3.Options) {
+		if cfg.S3Endpoint != "" {
+			o.BaseEndpoint = aws.String(cfg.S3Endpoint)
+		}
+		// MinIO and most other self-hosted servers do not support virtual-hosted buckets
+		o.UsePathStyle = cfg.S3ForcePathStyle
+	})
+	return &S3Backend{
+		Client:        client,
+		Bucket:        cfg.S3Bucket,
+		Prefix:        cfg.S3Prefix,
+		DryRun:        cfg.DryRun,
+		UploadTimeout: cfg.UploadTimeout,
+		HeadTimeout:   cfg.HeadTimeout,
+		uploader:      manager.NewUploader(client),
+	}, nil
+}
+
+// key returns the object key of a file inside a folder
+func (b *S3Backend) key(folderName, filename string) string {
+	return path.Join(b.Prefix, folderName, filename)
+}
+
+// CreateFolder does nothing, as objects can be stored below any prefix
+func (b *S3Backend) CreateFolder(ctx context.Context, folderName string) error {
+	return nil
+}
+
+// PutFile streams data into an object, switching to a multipart upload for
+// large files so the size need not be known in advance
+func (b *S3Backend) PutFile(ctx context.Context, folderName, filename string, data io.Reader) error {
+	if b.DryRun {
+		return dryRunUpload(folderName, filename, data)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, b.UploadTimeout)
+	defer cancel()
+	_, err := b.uploader.Upload(ctx, &s3.PutObjectInput{
+		Bucket: aws.String(b.Bucket),
+		Key:    aws.String(b.key(folderName, filename)),
+		Body:   data,
+	})
+	if err != nil {
+		return fmt.Errorf("could not upload object: %w", err)
+	}
+	return nil
+}
+
+// CreateFile stores an object with a conditional write, which S3 rejects
+// with 412 Precondition Failed if the key already exists
+func (b *S3Backend) CreateFile(ctx context.Context, folderName, filename string, data io.Reader) error {
+	if b.DryRun {
+		return dryRunUpload(folderName, filename, data)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, b.UploadTimeout)
+	defer cancel()
+	_, err := b.Client.PutObject(ctx, &s3.PutObjectInput{
+		Bucket:      aws.String(b.Bucket),
+		Key:         aws.String(b.key(folderName, filename)),
+		Body:        data,
+		IfNoneMatch: aws.String("*"),
+	})
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) && apiErr.ErrorCode() == "PreconditionFailed" {
+		return errFileExists
+	}
+	if err != nil {
+		return fmt.Errorf("could not upload object: %w", err)
+	}
+	return nil
+}
+
+// FileExists checks for the object with a HEAD request
+func (b *S3Backend) FileExists(ctx context.Context, folderName, filename string) bool {
+	if b.DryRun {
+		slog.Info("DRY RUN: would check for existing S3 object", "folderName", folderName, "fileName", filename)
+		return false
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, b.HeadTimeout)
+	defer cancel()
+	_, err := b.Client.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(b.Bucket),
+		Key:    aws.String(b.key(folderName, filename)),
+	})
+	return err == nil
+}
+
+// DeleteFile deletes the object. S3 reports success for missing objects too.
+func (b *S3Backend) DeleteFile(ctx context.Context, folderName, filename string) error {
+	if b.DryRun {
+		slog.Info("DRY RUN: would delete S3 object", "folderName", folderName, "fileName", filename)
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, b.HeadTimeout)
+	defer cancel()
+	_, err := b.Client.DeleteObject(ctx, &s3.DeleteObjectInput{
+		Bucket: aws.String(b.Bucket),
+		Key:    aws.String(b.key(folderName, filename)),
+	})
+	var noSuchKey *types.NoSuchKey
+	if err != nil && !errors.As(err, &noSuchKey) {
+		return fmt.Errorf("could not delete object: %w", err)
+	}
+	return nil
+}
+
+// CheckConnectivity checks that the bucket exists and is accessible
+func (b *S3Backend) CheckConnectivity(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	if _, err := b.Client.HeadBucket(ctx, &s3.HeadBucketInput{Bucket: aws.String(b.Bucket)}); err != nil {
+		return fmt.Errorf("could not access bucket %s: %w", b.Bucket, err)
+	}
+	return nil
+}
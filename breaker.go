@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// errCircuitOpen is returned instead of sending a request while the circuit breaker is open
+var errCircuitOpen = errors.New("nextcloud circuit breaker open")
+
+// Circuit breaker states
+const (
+	breakerClosed   = iota // Requests flow normally
+	breakerOpen            // Requests fail immediately until the cooldown has passed
+	breakerHalfOpen        // One trial request is in flight to test recovery
+)
+
+// circuitBreaker stops requests to a server after threshold consecutive
+// failures, so that uploads fail fast instead of each waiting for its own
+// timeout while the server is down. After cooldown a single trial request is
+// let through; its outcome closes the breaker again or restarts the cooldown.
+// A nil breaker lets every request through.
+type circuitBreaker struct {
+	threshold int
+	cooldown  time.Duration
+
+	mu       sync.Mutex
+	state    int
+	failures int
+	openedAt time.Time
+}
+
+// newCircuitBreaker returns a breaker, or nil when threshold is 0 to disable it
+func newCircuitBreaker(threshold int, cooldown time.Duration) *circuitBreaker {
+	if threshold <= 0 {
+		return nil
+	}
+	return &circuitBreaker{threshold: threshold, cooldown: cooldown}
+}
+
+// allow reports whether a request may be sent. Every allowed request must be
+// followed by a call to record.
+func (b *circuitBreaker) allow() bool {
+	if b == nil {
+		return true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case breakerOpen:
+		if time.Since(b.openedAt) < b.cooldown {
+			return false
+		}
+		b.state = breakerHalfOpen
+		return true
+	case breakerHalfOpen:
+		return false
+	default:
+		return true
+	}
+}
+
+// record updates the breaker with the outcome of an allowed request
+func (b *circuitBreaker) record(success bool) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if success {
+		if b.state != breakerClosed {
+			slog.Info("Nextcloud circuit breaker closed")
+		}
+		b.state, b.failures = breakerClosed, 0
+		return
+	}
+	b.failures++
+	if b.state == breakerHalfOpen || b.failures >= b.threshold {
+		if b.state != breakerOpen {
+			slog.Warn("Nextcloud circuit breaker opened", "failures", b.failures, "cooldown", b.cooldown)
+		}
+		b.state, b.openedAt = breakerOpen, time.Now()
+	}
+}
+
+// abandon ends an allowed request without recording an outcome, so that a
+// trial request canceled by its client does not leave the breaker half open
+func (b *circuitBreaker) abandon() {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state == breakerHalfOpen {
+		// openedAt is past the cooldown, so the next request is the new trial
+		b.state = breakerOpen
+	}
+}
+
+// retryAfter returns how long requests will still be refused, or 0 if they are let through
+func (b *circuitBreaker) retryAfter() time.Duration {
+	if b == nil {
+		return 0
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case breakerOpen:
+		return max(0, b.cooldown-time.Since(b.openedAt))
+	case breakerHalfOpen:
+		// The trial request decides soon; ask clients to come back after a short pause
+		return time.Second
+	default:
+		return 0
+	}
+}
+
+// do sends req through the client's circuit breaker. Transport errors and 5xx
+// responses other than 507 Insufficient Storage count as failures; everything
+// else shows the server is up. Requests canceled by the client that sent the
+// upload say nothing about the server and are not counted.
+func (c *NextcloudClient) do(req *http.Request) (*http.Response, error) {
+	if !c.Breaker.allow() {
+		return nil, errCircuitOpen
+	}
+	resp, err := c.HTTPClient.Do(req)
+	if errors.Is(err, context.Canceled) {
+		c.Breaker.abandon()
+		return resp, err
+	}
+	c.Breaker.record(err == nil && (resp.StatusCode < 500 || resp.StatusCode == http.StatusInsufficientStorage))
+	return resp, err
+}
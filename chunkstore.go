@@ -0,0 +1,232 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// ChunkStore persists uploaded chunks until the upload is completed.
+// Upload IDs and chunk indices must already be sanitized by the caller.
+type ChunkStore interface {
+	// WriteChunk stores the chunk read from r, replacing any previous chunk with the same index.
+	WriteChunk(uploadID, index string, r io.Reader) error
+	// DeleteChunk removes a single chunk, e.g. after failed verification.
+	DeleteChunk(uploadID, index string) error
+	// ListChunks returns the indices stored for an upload in no particular order.
+	// It returns an error wrapping fs.ErrNotExist if the upload is unknown.
+	ListChunks(uploadID string) ([]string, error)
+	// ChunkSize returns the size in bytes of a stored chunk.
+	ChunkSize(uploadID, index string) (int64, error)
+	// OpenChunk opens a stored chunk for reading.
+	OpenChunk(uploadID, index string) (io.ReadCloser, error)
+	// Remove deletes all chunks of an upload. Removing an unknown upload is not an error.
+	Remove(uploadID string) error
+	// SetFileName stores the original file name of an upload next to its chunks.
+	SetFileName(uploadID, name string) error
+	// FileName returns the name stored with SetFileName, or "" if there is none.
+	FileName(uploadID string) (string, error)
+}
+
+// chunkStore is the store used by the HTTP handlers
+var chunkStore ChunkStore
+
+// tempChunkPrefix marks chunk files that are still being written
+const tempChunkPrefix = ".tmp-"
+
+// fileNameFile holds the original file name inside an upload's chunk directory
+const fileNameFile = ".filename"
+
+// fsChunkStore stores each upload as a directory with one file per chunk
+type fsChunkStore struct {
+	baseDir string
+}
+
+// newFSChunkStore creates a filesystem chunk store rooted at baseDir
+func newFSChunkStore(baseDir string) *fsChunkStore {
+	return &fsChunkStore{baseDir: baseDir}
+}
+
+func (s *fsChunkStore) WriteChunk(uploadID, index string, r io.Reader) error {
+	chunkDir := filepath.Join(s.baseDir, uploadID)
+	if err := os.MkdirAll(chunkDir, os.ModePerm); err != nil {
+		return fmt.Errorf("could not create chunk directory %s: %w", chunkDir, err)
+	}
+
+	// Write to a temporary file and rename it into place, so concurrent writes of
+	// the same index never leave a torn chunk and readers only see complete files.
+	chunkPath := filepath.Join(chunkDir, index)
+	dst, err := os.CreateTemp(chunkDir, tempChunkPrefix+"*")
+	if err != nil {
+		return fmt.Errorf("could not create chunk file %s: %w", chunkPath, err)
+	}
+	defer os.Remove(dst.Name())
+
+	if _, err := io.Copy(dst, r); err != nil {
+		dst.Close()
+		return fmt.Errorf("could not save chunk file %s: %w", chunkPath, err)
+	}
+	if err := dst.Close(); err != nil {
+		return fmt.Errorf("could not save chunk file %s: %w", chunkPath, err)
+	}
+	if err := os.Rename(dst.Name(), chunkPath); err != nil {
+		return fmt.Errorf("could not save chunk file %s: %w", chunkPath, err)
+	}
+	return nil
+}
+
+func (s *fsChunkStore) DeleteChunk(uploadID, index string) error {
+	return os.Remove(filepath.Join(s.baseDir, uploadID, index))
+}
+
+func (s *fsChunkStore) ListChunks(uploadID string) ([]string, error) {
+	entries, err := os.ReadDir(filepath.Join(s.baseDir, uploadID))
+	if err != nil {
+		return nil, err
+	}
+	indices := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		// Skip temporary chunks and metadata files
+		if strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+		indices = append(indices, entry.Name())
+	}
+	return indices, nil
+}
+
+func (s *fsChunkStore) ChunkSize(uploadID, index string) (int64, error) {
+	info, err := os.Stat(filepath.Join(s.baseDir, uploadID, index))
+	if err != nil {
+		return 0, err
+	}
+	return info.Size(), nil
+}
+
+func (s *fsChunkStore) OpenChunk(uploadID, index string) (io.ReadCloser, error) {
+	return os.Open(filepath.Join(s.baseDir, uploadID, index))
+}
+
+func (s *fsChunkStore) Remove(uploadID string) error {
+	return os.RemoveAll(filepath.Join(s.baseDir, uploadID))
+}
+
+func (s *fsChunkStore) SetFileName(uploadID, name string) error {
+	chunkDir := filepath.Join(s.baseDir, uploadID)
+	if err := os.MkdirAll(chunkDir, os.ModePerm); err != nil {
+		return fmt.Errorf("could not create chunk directory %s: %w", chunkDir, err)
+	}
+	return os.WriteFile(filepath.Join(chunkDir, fileNameFile), []byte(name), 0o644)
+}
+
+func (s *fsChunkStore) FileName(uploadID string) (string, error) {
+	data, err := os.ReadFile(filepath.Join(s.baseDir, uploadID, fileNameFile))
+	if errors.Is(err, fs.ErrNotExist) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+// memoryChunkStore keeps chunks in memory. It is meant for tests and local development.
+type memoryChunkStore struct {
+	mu        sync.RWMutex
+	uploads   map[string]map[string][]byte
+	fileNames map[string]string
+}
+
+// newMemoryChunkStore creates an empty in-memory chunk store
+func newMemoryChunkStore() *memoryChunkStore {
+	return &memoryChunkStore{
+		uploads:   make(map[string]map[string][]byte),
+		fileNames: make(map[string]string),
+	}
+}
+
+func (s *memoryChunkStore) WriteChunk(uploadID, index string, r io.Reader) error {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return fmt.Errorf("could not read chunk data: %w", err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.uploads[uploadID] == nil {
+		s.uploads[uploadID] = make(map[string][]byte)
+	}
+	s.uploads[uploadID][index] = data
+	return nil
+}
+
+func (s *memoryChunkStore) DeleteChunk(uploadID, index string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.uploads[uploadID][index]; !ok {
+		return fmt.Errorf("chunk %s of upload %s: %w", index, uploadID, fs.ErrNotExist)
+	}
+	delete(s.uploads[uploadID], index)
+	return nil
+}
+
+func (s *memoryChunkStore) ListChunks(uploadID string) ([]string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	chunks, ok := s.uploads[uploadID]
+	if !ok {
+		return nil, fmt.Errorf("upload %s: %w", uploadID, fs.ErrNotExist)
+	}
+	indices := make([]string, 0, len(chunks))
+	for index := range chunks {
+		indices = append(indices, index)
+	}
+	return indices, nil
+}
+
+func (s *memoryChunkStore) ChunkSize(uploadID, index string) (int64, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	data, ok := s.uploads[uploadID][index]
+	if !ok {
+		return 0, fmt.Errorf("chunk %s of upload %s: %w", index, uploadID, fs.ErrNotExist)
+	}
+	return int64(len(data)), nil
+}
+
+func (s *memoryChunkStore) OpenChunk(uploadID, index string) (io.ReadCloser, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	data, ok := s.uploads[uploadID][index]
+	if !ok {
+		return nil, fmt.Errorf("chunk %s of upload %s: %w", index, uploadID, fs.ErrNotExist)
+	}
+	return io.NopCloser(bytes.NewReader(data)), nil
+}
+
+func (s *memoryChunkStore) Remove(uploadID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.uploads, uploadID)
+	delete(s.fileNames, uploadID)
+	return nil
+}
+
+func (s *memoryChunkStore) SetFileName(uploadID, name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.fileNames[uploadID] = name
+	return nil
+}
+
+func (s *memoryChunkStore) FileName(uploadID string) (string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.fileNames[uploadID], nil
+}
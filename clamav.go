@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+)
+
+const (
+	// clamavChunkSize is the size of each INSTREAM chunk sent to clamd
+	clamavChunkSize = 64 << 10
+	// clamavIOTimeout bounds every individual read or write on the clamd connection
+	clamavIOTimeout = 30 * time.Second
+)
+
+// scanWithClamAV streams data to a ClamAV daemon using the INSTREAM command.
+// addr is either host:port or a unix socket path prefixed with "unix:".
+// It returns the signature name when the stream is infected, or an empty string when clean.
+func scanWithClamAV(addr string, data io.Reader) (string, error) {
+	network := "tcp"
+	if strings.HasPrefix(addr, "unix:") {
+		network, addr = "unix", strings.TrimPrefix(addr, "unix:")
+	}
+	conn, err := net.DialTimeout(network, addr, clamavIOTimeout)
+	if err != nil {
+		return "", fmt.Errorf("could not connect to clamd: %w", err)
+	}
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(clamavIOTimeout))
+	if _, err := conn.Write([]byte("zINSTREAM\x00")); err != nil {
+		return "", fmt.Errorf("could not send INSTREAM command: %w", err)
+	}
+
+	// Each chunk is prefixed with its length as a 4 byte big-endian integer
+	buffer := make([]byte, 4+clamavChunkSize)
+	for {
+		n, readErr := io.ReadFull(data, buffer[4:])
+		if n > 0 {
+			binary.BigEndian.PutUint32(buffer[:4], uint32(n))
+			conn.SetDeadline(time.Now().Add(clamavIOTimeout))
+			if _, err := conn.Write(buffer[:4+n]); err != nil {
+				return "", fmt.Errorf("could not stream data to clamd: %w", err)
+			}
+		}
+		if readErr == io.EOF || readErr == io.ErrUnexpectedEOF {
+			break
+		}
+		if readErr != nil {
+			return "", fmt.Errorf("could not read file data: %w", readErr)
+		}
+	}
+
+	// A zero length chunk terminates the stream
+	conn.SetDeadline(time.Now().Add(clamavIOTimeout))
+	if _, err := conn.Write([]byte{0, 0, 0, 0}); err != nil {
+		return "", fmt.Errorf("could not terminate stream: %w", err)
+	}
+
+	reply, err := bufio.NewReader(conn).ReadString(0)
+	if err != nil && err != io.EOF {
+		return "", fmt.Errorf("could not read clamd reply: %w", err)
+	}
+	reply = strings.TrimSpace(strings.TrimRight(reply, "\x00"))
+
+	// Replies look like "stream: OK", "stream: <signature> FOUND" or "<message> ERROR"
+	switch {
+	case strings.HasSuffix(reply, "OK"):
+		return "", nil
+	case strings.HasSuffix(reply, "FOUND"):
+		signature := strings.TrimSuffix(strings.TrimPrefix(reply, "stream:"), "FOUND")
+		return strings.TrimSpace(signature), nil
+	default:
+		return "", fmt.Errorf("unexpected clamd reply: %q", reply)
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"compress/gzip"
+	"net/http"
+	"strings"
+)
+
+// withGzip compresses responses of at least COMPRESS_MIN_BYTES for clients
+// sending Accept-Encoding: gzip. It is meant for the status and listing
+// endpoints; upload responses are small and the progress stream must not be
+// held back by a compressor's buffer. With COMPRESS_MIN_BYTES=0 the handler
+// is returned unchanged.
+func withGzip(next http.HandlerFunc) http.HandlerFunc {
+	if appConfig.CompressMinBytes <= 0 {
+		return next
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Accept-Encoding")
+		if r.Method == http.MethodHead || !acceptsGzip(r) {
+			next(w, r)
+			return
+		}
+		gw := &gzipResponseWriter{ResponseWriter: w, minBytes: appConfig.CompressMinBytes}
+		defer gw.finish()
+		next(gw, r)
+	}
+}
+
+// acceptsGzip reports whether Accept-Encoding lists gzip without refusing it with q=0
+func acceptsGzip(r *http.Request) bool {
+	for _, accepted := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		coding, params, _ := strings.Cut(strings.TrimSpace(accepted), ";")
+		if strings.EqualFold(strings.TrimSpace(coding), "gzip") {
+			return strings.ReplaceAll(params, " ", "") != "q=0"
+		}
+	}
+	return false
+}
+
+// gzipResponseWriter holds back the response until minBytes have been
+// written, then sends it compressed. Shorter responses go out unchanged when
+// the handler returns, as compressing them would save next to nothing.
+type gzipResponseWriter struct {
+	http.ResponseWriter
+	minBytes  int
+	status    int
+	buffer    []byte
+	gzip      *gzip.Writer
+	committed bool // The header has been sent
+}
+
+func (g *gzipResponseWriter) WriteHeader(status int) {
+	if g.status == 0 {
+		g.status = status
+	}
+}
+
+func (g *gzipResponseWriter) Write(p []byte) (int, error) {
+	if g.status == 0 {
+		g.status = http.StatusOK
+	}
+	if g.gzip != nil {
+		return g.gzip.Write(p)
+	}
+	if g.committed {
+		return g.ResponseWriter.Write(p)
+	}
+	g.buffer = append(g.buffer, p...)
+	if len(g.buffer) < g.minBytes {
+		return len(p), nil
+	}
+
+	// Leave responses alone that the handler already encoded itself
+	if g.Header().Get("Content-Encoding") != "" {
+		if err := g.flushBuffer(); err != nil {
+			return 0, err
+		}
+		return len(p), nil
+	}
+	g.Header().Set("Content-Encoding", "gzip")
+	g.Header().Del("Content-Length")
+	g.ResponseWriter.WriteHeader(g.status)
+	g.committed = true
+	g.gzip = gzip.NewWriter(g.ResponseWriter)
+	if _, err := g.gzip.Write(g.buffer); err != nil {
+		return 0, err
+	}
+	g.buffer = nil
+	return len(p), nil
+}
+
+// flushBuffer sends the header and the held back bytes uncompressed
+func (g *gzipResponseWriter) flushBuffer() error {
+	if g.status == 0 {
+		g.status = http.StatusOK
+	}
+	g.ResponseWriter.WriteHeader(g.status)
+	g.committed = true
+	_, err := g.ResponseWriter.Write(g.buffer)
+	g.buffer = nil
+	return err
+}
+
+// finish completes the response once the handler has returned
+func (g *gzipResponseWriter) finish() error {
+	if g.gzip != nil {
+		return g.gzip.Close()
+	}
+	if !g.committed {
+		return g.flushBuffer()
+	}
+	return nil
+}
+
+func (g *gzipResponseWriter) Unwrap() http.ResponseWriter {
+	return g.ResponseWriter
+}
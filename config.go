@@ -0,0 +1,312 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// defaultConfig returns the configuration used when neither a config file nor
+// environment variables provide a value.
+func defaultConfig() Config {
+	return Config{
+		UploadTempDir:       "/tmp/nextcloud-public-uploader/",
+		SessionTTL:          24 * time.Hour,
+		RateLimitBurst:      20,
+		SMTPPort:            587,
+		UploadQueueTimeout:  30 * time.Second,
+		ListenAddr:          ":8080",
+		DescriptionFilename: "descripcion.txt",
+		ChunkSize:           10 << 20,
+		MaxJSONBodyBytes:    64 << 10,
+		MultipartMemory:     1 << 20,
+		CleanupOnStart:      true,
+		OrphanCleanupAge:    time.Hour,
+		MkcolTimeout:        30 * time.Second,
+		UploadTimeout:       60 * time.Minute,
+		HeadTimeout:         10 * time.Second,
+		ThumbnailMaxPixels:  50_000_000,
+		ChunkWaitInterval:   500 * time.Millisecond,
+		FilenameUnsafeChars: `\:*?"<>|`,
+		FilenameReplacement: "_",
+		MaxFilenameLength:   200,
+		BreakerThreshold:    5,
+		BreakerCooldown:     30 * time.Second,
+		AccessLog:           true,
+		PendingFolderPrefix: "pending_",
+		WriteDescription:    true,
+		CompressMinBytes:    1 << 10,
+		ReplicationQuorum:   quorumAll,
+	}
+}
+
+// loadConfig builds the configuration from the YAML (or JSON) file referenced by
+// CONFIG_FILE, if any, and then applies environment variables on top, so that
+// environment variables always win over file values.
+func loadConfig() (Config, error) {
+	cfg, err := readConfigFile()
+	if err != nil {
+		return cfg, err
+	}
+
+	cfg = Config{
+		NextcloudURL:            getEnv("NC_URL", cfg.NextcloudURL),
+		NextcloudUser:           getEnv("NC_USER", cfg.NextcloudUser),
+		NextcloudAppPass:        getEnv("NC_APP_PASSWORD", cfg.NextcloudAppPass),
+		NextcloudAuthMode:       getEnv("NC_AUTH_MODE", cfg.NextcloudAuthMode),
+		NextcloudBearerToken:    getEnv("NC_BEARER_TOKEN", cfg.NextcloudBearerToken),
+		NextcloudTokenURL:       getEnv("NC_TOKEN_URL", cfg.NextcloudTokenURL),
+		NextcloudClientID:       getEnv("NC_CLIENT_ID", cfg.NextcloudClientID),
+		NextcloudClientSecret:   getEnv("NC_CLIENT_SECRET", cfg.NextcloudClientSecret),
+		NextcloudUploadDir:      getEnv("NC_FOLDER", cfg.NextcloudUploadDir),
+		UploadTempDir:           getEnv("UPLOAD_TEMP_DIR", cfg.UploadTempDir),
+		MaxUploadBytes:          getEnvInt64("MAX_UPLOAD_BYTES", cfg.MaxUploadBytes),
+		SessionTTL:              getEnvDuration("SESSION_TTL", cfg.SessionTTL),
+		ChunkedUpload:           getEnvBool("NC_CHUNKED_UPLOAD", cfg.ChunkedUpload),
+		ClamAVAddr:              getEnv("CLAMAV_ADDR", cfg.ClamAVAddr),
+		AllowedExtensions:       getEnvList("ALLOWED_EXTENSIONS", cfg.AllowedExtensions),
+		AllowedMIMETypes:        getEnvList("ALLOWED_CONTENT_TYPES", cfg.AllowedMIMETypes),
+		RateLimitRPS:            getEnvFloat("RATE_LIMIT_RPS", cfg.RateLimitRPS),
+		RateLimitBurst:          int(getEnvInt64("RATE_LIMIT_BURST", int64(cfg.RateLimitBurst))),
+		TrustProxy:              getEnvBool("TRUST_PROXY", cfg.TrustProxy),
+		CreateShare:             getEnvBool("NC_CREATE_SHARE", cfg.CreateShare),
+		SMTPHost:                getEnv("SMTP_HOST", cfg.SMTPHost),
+		SMTPPort:                int(getEnvInt64("SMTP_PORT", int64(cfg.SMTPPort))),
+		SMTPUser:                getEnv("SMTP_USER", cfg.SMTPUser),
+		SMTPPass:                getEnv("SMTP_PASS", cfg.SMTPPass),
+		SMTPFrom:                getEnv("SMTP_FROM", cfg.SMTPFrom),
+		NotifyTo:                getEnvList("NOTIFY_TO", cfg.NotifyTo),
+		WebhookURL:              getEnv("WEBHOOK_URL", cfg.WebhookURL),
+		WebhookSecret:           getEnv("WEBHOOK_SECRET", cfg.WebhookSecret),
+		SessionStore:            getEnv("SESSION_STORE", cfg.SessionStore),
+		RedisAddr:               getEnv("REDIS_ADDR", cfg.RedisAddr),
+		MaxConcurrentUploads:    int(getEnvInt64("MAX_CONCURRENT_UPLOADS", int64(cfg.MaxConcurrentUploads))),
+		UploadQueueTimeout:      getEnvDuration("UPLOAD_QUEUE_TIMEOUT", cfg.UploadQueueTimeout),
+		AllowedOrigins:          getEnvList("ALLOWED_ORIGINS", cfg.AllowedOrigins),
+		ListenAddr:              getEnv("LISTEN_ADDR", cfg.ListenAddr),
+		TLSCertFile:             getEnv("TLS_CERT_FILE", cfg.TLSCertFile),
+		TLSKeyFile:              getEnv("TLS_KEY_FILE", cfg.TLSKeyFile),
+		HTTPSRedirectPort:       getEnv("HTTPS_REDIRECT_PORT", cfg.HTTPSRedirectPort),
+		FolderNameTemplate:      getEnv("FOLDER_NAME_TEMPLATE", cfg.FolderNameTemplate),
+		DescriptionFilename:     getEnv("DESCRIPTION_FILENAME", cfg.DescriptionFilename),
+		DescriptionTemplateFile: getEnv("DESCRIPTION_TEMPLATE_FILE", cfg.DescriptionTemplateFile),
+		DedupFilenames:          getEnvBool("DEDUP_FILENAMES", cfg.DedupFilenames),
+		RequireEmail:            getEnvBool("REQUIRE_EMAIL", cfg.RequireEmail),
+		RequirePhone:            getEnvBool("REQUIRE_PHONE", cfg.RequirePhone),
+		DryRun:                  getEnvBool("DRY_RUN", cfg.DryRun),
+		ChunkSize:               getEnvInt64("CHUNK_SIZE", cfg.ChunkSize),
+		MaxChunksPerUpload:      int(getEnvInt64("MAX_CHUNKS_PER_UPLOAD", int64(cfg.MaxChunksPerUpload))),
+		MinFreeDiskBytes:        getEnvInt64("MIN_FREE_DISK_BYTES", cfg.MinFreeDiskBytes),
+		MaxJSONBodyBytes:        getEnvInt64("MAX_JSON_BODY_BYTES", cfg.MaxJSONBodyBytes),
+		MultipartMemory:         getEnvInt64("MULTIPART_MEMORY", cfg.MultipartMemory),
+		AdminToken:              getEnv("ADMIN_TOKEN", cfg.AdminToken),
+		CleanupOnStart:          getEnvBool("CLEANUP_ON_START", cfg.CleanupOnStart),
+		OrphanCleanupAge:        getEnvDuration("ORPHAN_CLEANUP_AGE", cfg.OrphanCleanupAge),
+		DataOriginCategories:    getEnvMap("DATA_ORIGIN_CATEGORIES", cfg.DataOriginCategories),
+		MkcolTimeout:            getEnvDuration("NC_MKCOL_TIMEOUT", cfg.MkcolTimeout),
+		UploadTimeout:           getEnvDuration("NC_UPLOAD_TIMEOUT", cfg.UploadTimeout),
+		HeadTimeout:             getEnvDuration("NC_HEAD_TIMEOUT", cfg.HeadTimeout),
+		UploadToken:             getEnv("UPLOAD_TOKEN", cfg.UploadToken),
+		Targets:                 cfg.Targets,
+		MaxFilesPerSession:      int(getEnvInt64("MAX_FILES_PER_SESSION", int64(cfg.MaxFilesPerSession))),
+		SetProperties:           getEnvBool("NC_SET_PROPERTIES", cfg.SetProperties),
+		ResumeAttempts:          int(getEnvInt64("NC_RESUME_ATTEMPTS", int64(cfg.ResumeAttempts))),
+		MaxActiveSessions:       int(getEnvInt64("MAX_ACTIVE_SESSIONS", int64(cfg.MaxActiveSessions))),
+		GenerateThumbnails:      getEnvBool("GENERATE_THUMBNAILS", cfg.GenerateThumbnails),
+		ThumbnailMaxPixels:      getEnvInt64("THUMBNAIL_MAX_PIXELS", cfg.ThumbnailMaxPixels),
+		ChunkWaitAttempts:       int(getEnvInt64("CHUNK_WAIT_ATTEMPTS", int64(cfg.ChunkWaitAttempts))),
+		ChunkWaitInterval:       getEnvDuration("CHUNK_WAIT_INTERVAL", cfg.ChunkWaitInterval),
+		Backend:                 getEnv("BACKEND", cfg.Backend),
+		S3Bucket:                getEnv("S3_BUCKET", cfg.S3Bucket),
+		S3Endpoint:              getEnv("S3_ENDPOINT", cfg.S3Endpoint),
+		S3Region:                getEnv("S3_REGION", cfg.S3Region),
+		S3AccessKeyID:           getEnv("S3_ACCESS_KEY_ID", cfg.S3AccessKeyID),
+		S3SecretAccessKey:       getEnv("S3_SECRET_ACCESS_KEY", cfg.S3SecretAccessKey),
+		S3Prefix:                getEnv("S3_PREFIX", cfg.S3Prefix),
+		S3ForcePathStyle:        getEnvBool("S3_FORCE_PATH_STYLE", cfg.S3ForcePathStyle),
+		AuditLogFile:            getEnv("AUDIT_LOG_FILE", cfg.AuditLogFile),
+		FilenameUnsafeChars:     getEnv("FILENAME_UNSAFE_CHARS", cfg.FilenameUnsafeChars),
+		FilenameReplacement:     getEnv("FILENAME_REPLACEMENT", cfg.FilenameReplacement),
+		MaxFilenameLength:       int(getEnvInt64("MAX_FILENAME_LENGTH", int64(cfg.MaxFilenameLength))),
+		OnConflict:              getEnv("ON_CONFLICT", cfg.OnConflict),
+		BreakerThreshold:        int(getEnvInt64("NC_BREAKER_THRESHOLD", int64(cfg.BreakerThreshold))),
+		BreakerCooldown:         getEnvDuration("NC_BREAKER_COOLDOWN", cfg.BreakerCooldown),
+		HashClientIP:            getEnvBool("HASH_CLIENT_IP", cfg.HashClientIP),
+		ClientIPSalt:            getEnv("CLIENT_IP_SALT", cfg.ClientIPSalt),
+		SessionMaxDuration:      getEnvDuration("SESSION_MAX_DURATION", cfg.SessionMaxDuration),
+		MetadataFormat:          getEnv("METADATA_FORMAT", cfg.MetadataFormat),
+		AllowEmptyFiles:         getEnvBool("ALLOW_EMPTY_FILES", cfg.AllowEmptyFiles),
+		FolderPerSession:        getEnvBool("FOLDER_PER_SESSION", cfg.FolderPerSession),
+		AccessLog:               getEnvBool("ACCESS_LOG", cfg.AccessLog),
+		StaticDir:               getEnv("STATIC_DIR", cfg.StaticDir),
+		NextcloudHeaders:        getEnvHeaders("NC_HEADERS", cfg.NextcloudHeaders),
+		RequestTimeout:          getEnvDuration("REQUEST_TIMEOUT", cfg.RequestTimeout),
+		RenameOnComplete:        getEnvBool("RENAME_ON_COMPLETE", cfg.RenameOnComplete),
+		PendingFolderPrefix:     getEnv("PENDING_FOLDER_PREFIX", cfg.PendingFolderPrefix),
+		CompleteFolderPrefix:    getEnv("COMPLETE_FOLDER_PREFIX", cfg.CompleteFolderPrefix),
+		HashFolderIdentifiers:   getEnvBool("HASH_FOLDER_IDENTIFIERS", cfg.HashFolderIdentifiers),
+		FolderIdentifierSalt:    getEnv("FOLDER_IDENTIFIER_SALT", cfg.FolderIdentifierSalt),
+		MaxConcurrentChunks:     int(getEnvInt64("MAX_CONCURRENT_CHUNKS", int64(cfg.MaxConcurrentChunks))),
+		WriteManifest:           getEnvBool("WRITE_MANIFEST", cfg.WriteManifest),
+		SuccessRedirectURL:      getEnv("SUCCESS_REDIRECT_URL", cfg.SuccessRedirectURL),
+		StreamChunks:            getEnvBool("STREAM_CHUNKS", cfg.StreamChunks),
+		SizeLimits:              getEnvSizeLimits("SIZE_LIMITS", cfg.SizeLimits),
+		WriteDescription:        getEnvBool("WRITE_DESCRIPTION", cfg.WriteDescription),
+		CompressMinBytes:        int(getEnvInt64("COMPRESS_MIN_BYTES", int64(cfg.CompressMinBytes))),
+		AllowedDataOrigins:      getEnvList("ALLOWED_DATA_ORIGINS", cfg.AllowedDataOrigins),
+		ReplicateTo:             getEnvList("REPLICATE_TO", cfg.ReplicateTo),
+		ReplicationQuorum:       getEnv("REPLICATION_QUORUM", cfg.ReplicationQuorum),
+	}
+
+	if err := validateConfig(cfg); err != nil {
+		return cfg, err
+	}
+	cfg.NextcloudURL = strings.TrimSuffix(cfg.NextcloudURL, "/")
+	for name, target := range cfg.Targets {
+		target.URL = strings.TrimSuffix(target.URL, "/")
+		cfg.Targets[name] = target
+	}
+	return cfg, nil
+}
+
+// readConfigFile returns the defaults overlaid with the file referenced by
+// CONFIG_FILE, if any, before environment variables are applied
+func readConfigFile() (Config, error) {
+	cfg := defaultConfig()
+	path := getEnv("CONFIG_FILE", "")
+	if path == "" {
+		return cfg, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return cfg, fmt.Errorf("could not read config file %s: %w", path, err)
+	}
+	if err := yaml.Unmarshal(data, &cfg); err != nil {
+		return cfg, fmt.Errorf("could not parse config file %s: %w", path, err)
+	}
+	return cfg, nil
+}
+
+// validateConfig checks that all required settings are present and names the
+// missing ones by both their environment variable and config file key.
+func validateConfig(cfg Config) error {
+	var missing []string
+	switch cfg.Backend {
+	case "", "nextcloud":
+		if cfg.NextcloudURL == "" {
+			missing = append(missing, "NC_URL (url)")
+		}
+		if cfg.NextcloudUser == "" {
+			missing = append(missing, "NC_USER (user)")
+		}
+		switch cfg.NextcloudAuthMode {
+		case "", authModeBasic:
+			if cfg.NextcloudAppPass == "" {
+				missing = append(missing, "NC_APP_PASSWORD (app_password)")
+			}
+		case authModeBearer:
+			if cfg.NextcloudBearerToken == "" && cfg.NextcloudTokenURL == "" {
+				missing = append(missing, "NC_BEARER_TOKEN (bearer_token) or NC_TOKEN_URL (token_url)")
+			}
+		default:
+			return fmt.Errorf("NC_AUTH_MODE (auth_mode) must be %s or %s", authModeBasic, authModeBearer)
+		}
+	case "s3":
+		if cfg.S3Bucket == "" {
+			missing = append(missing, "S3_BUCKET (s3_bucket)")
+		}
+		if (cfg.S3AccessKeyID == "") != (cfg.S3SecretAccessKey == "") {
+			return fmt.Errorf("S3_ACCESS_KEY_ID (s3_access_key_id) and S3_SECRET_ACCESS_KEY (s3_secret_access_key) must be set together")
+		}
+	default:
+		return fmt.Errorf("unknown BACKEND (backend) %q", cfg.Backend)
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("missing required configuration: %s", strings.Join(missing, ", "))
+	}
+	for name, target := range cfg.Targets {
+		if target.URL == "" || target.User == "" || target.AppPassword == "" {
+			return fmt.Errorf("target %q needs url, user and app_password", name)
+		}
+	}
+	if (cfg.TLSCertFile == "") != (cfg.TLSKeyFile == "") {
+		return fmt.Errorf("TLS_CERT_FILE (tls_cert_file) and TLS_KEY_FILE (tls_key_file) must be set together")
+	}
+	switch cfg.MetadataFormat {
+	case "", metadataFormatText, metadataFormatJSON:
+	default:
+		return fmt.Errorf("METADATA_FORMAT (metadata_format) must be %s or %s", metadataFormatText, metadataFormatJSON)
+	}
+	switch cfg.OnConflict {
+	case "", conflictOverwrite, conflictSkip, conflictRename:
+	default:
+		return fmt.Errorf("ON_CONFLICT (on_conflict) must be %s, %s or %s", conflictOverwrite, conflictSkip, conflictRename)
+	}
+	if cfg.ChunkSize <= 0 {
+		return fmt.Errorf("CHUNK_SIZE (chunk_size) must be positive")
+	}
+	if cfg.MaxJSONBodyBytes <= 0 {
+		return fmt.Errorf("MAX_JSON_BODY_BYTES (max_json_body_bytes) must be positive")
+	}
+	if cfg.RenameOnComplete {
+		if cfg.Backend == "s3" {
+			return fmt.Errorf("RENAME_ON_COMPLETE (rename_on_complete) is not supported with the s3 backend")
+		}
+		if cfg.PendingFolderPrefix == cfg.CompleteFolderPrefix {
+			return fmt.Errorf("PENDING_FOLDER_PREFIX (pending_folder_prefix) and COMPLETE_FOLDER_PREFIX (complete_folder_prefix) must differ")
+		}
+	}
+	// Unlike the client IP salt this one cannot be random, as the folders of
+	// one person must get the same name after a restart and on every replica
+	if cfg.HashFolderIdentifiers && cfg.FolderIdentifierSalt == "" {
+		return fmt.Errorf("HASH_FOLDER_IDENTIFIERS (hash_folder_identifiers) requires FOLDER_IDENTIFIER_SALT (folder_identifier_salt)")
+	}
+	if cfg.SuccessRedirectURL != "" {
+		if _, err := url.Parse(cfg.SuccessRedirectURL); err != nil {
+			return fmt.Errorf("SUCCESS_REDIRECT_URL (success_redirect_url) is not a valid URL: %w", err)
+		}
+	}
+	// Streamed files are never on disk as a whole, so nothing can read them back
+	if cfg.StreamChunks {
+		if cfg.Backend == "s3" {
+			return fmt.Errorf("STREAM_CHUNKS (stream_chunks) is not supported with the s3 backend")
+		}
+		if cfg.ClamAVAddr != "" || cfg.GenerateThumbnails {
+			return fmt.Errorf("STREAM_CHUNKS (stream_chunks) cannot be combined with CLAMAV_ADDR (clamav_addr) or GENERATE_THUMBNAILS (generate_thumbnails)")
+		}
+	}
+	for rule, size := range cfg.SizeLimits {
+		if _, err := parseByteSize(size); err != nil {
+			return fmt.Errorf("SIZE_LIMITS (size_limits) entry %q: %w", rule, err)
+		}
+	}
+	if cfg.MaxConcurrentChunks < 0 {
+		return fmt.Errorf("MAX_CONCURRENT_CHUNKS (max_concurrent_chunks) must not be negative")
+	}
+	if len(cfg.ReplicateTo) > 0 {
+		if cfg.Backend == "s3" || cfg.StreamChunks || cfg.RenameOnComplete {
+			return fmt.Errorf("REPLICATE_TO (replicate_to) cannot be combined with the s3 backend, STREAM_CHUNKS (stream_chunks) or RENAME_ON_COMPLETE (rename_on_complete)")
+		}
+		for _, name := range cfg.ReplicateTo {
+			if _, ok := cfg.Targets[name]; !ok {
+				return fmt.Errorf("REPLICATE_TO (replicate_to) refers to unknown target %q", name)
+			}
+		}
+	}
+	switch cfg.ReplicationQuorum {
+	case "", quorumAll, quorumMajority, quorumAny:
+	default:
+		return fmt.Errorf("REPLICATION_QUORUM (replication_quorum) must be %s, %s or %s", quorumAll, quorumMajority, quorumAny)
+	}
+	if cfg.CompressMinBytes < 0 {
+		return fmt.Errorf("COMPRESS_MIN_BYTES (compress_min_bytes) must not be negative")
+	}
+	if cfg.MultipartMemory < 0 {
+		return fmt.Errorf("MULTIPART_MEMORY (multipart_memory) must not be negative")
+	}
+	return nil
+}
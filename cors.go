@@ -0,0 +1,53 @@
+package main
+
+import (
+	"net/http"
+)
+
+const (
+	corsAllowedMethods = "GET, POST, PUT, PATCH, HEAD, DELETE, OPTIONS"
+	corsAllowedHeaders = "Content-Type, Content-Range, Authorization, X-Upload-Token, Tus-Resumable, Upload-Length, Upload-Offset, Upload-Metadata"
+	corsExposedHeaders = requestIDHeader + ", Location, Tus-Resumable, Tus-Version, Tus-Extension, Tus-Max-Size, Upload-Offset, Upload-Length"
+)
+
+// isAllowedOrigin reports whether origin matches ALLOWED_ORIGINS exactly or the list contains "*"
+func isAllowedOrigin(origin string) bool {
+	for _, allowed := range appConfig.AllowedOrigins {
+		if allowed == "*" || allowed == origin {
+			return true
+		}
+	}
+	return false
+}
+
+// withCORS adds CORS headers for allowed origins and answers preflight requests.
+// Requests from other origins get no CORS headers, so browsers block them.
+// Without ALLOWED_ORIGINS the handler is returned unchanged (same-origin only).
+func withCORS(next http.HandlerFunc) http.HandlerFunc {
+	if len(appConfig.AllowedOrigins) == 0 {
+		return next
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		allowed := origin != "" && isAllowedOrigin(origin)
+		if allowed {
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+			w.Header().Add("Vary", "Origin")
+			w.Header().Set("Access-Control-Expose-Headers", corsExposedHeaders)
+		}
+
+		if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
+			if !allowed {
+				http.Error(w, "Origin not allowed", http.StatusForbidden)
+				return
+			}
+			w.Header().Set("Access-Control-Allow-Methods", corsAllowedMethods)
+			w.Header().Set("Access-Control-Allow-Headers", corsAllowedHeaders)
+			w.Header().Set("Access-Control-Max-Age", "600")
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		next(w, r)
+	}
+}
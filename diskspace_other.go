@@ -0,0 +1,11 @@
+//go:build !unix
+
+package main
+
+import "math"
+
+// freeDiskBytes is not implemented on this platform and always reports
+// unlimited space, which disables the free-space check.
+func freeDiskBytes(dir string) (uint64, error) {
+	return math.MaxUint64, nil
+}
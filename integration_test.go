@@ -0,0 +1,1650 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"image/png"
+	"io"
+	"io/fs"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// mockWebDAV is an in-memory stand-in for the Nextcloud WebDAV API. It answers
+// MKCOL, PUT, HEAD, MOVE and DELETE like Nextcloud does and keeps the uploaded files.
+// Chunked uploads are assembled when their .file is moved.
+type mockWebDAV struct {
+	mu      sync.Mutex
+	folders map[string]bool
+	files   map[string][]byte
+	failPut map[string]bool     // Paths whose PUT fails with 500
+	onPut   func(*http.Request) // Called before a PUT body is read, with the lock released
+}
+
+func (m *mockWebDAV) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	p, err := url.PathUnescape(strings.TrimPrefix(r.URL.EscapedPath(), "/remote.php/dav/files/uploader/"))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	p = strings.TrimSuffix(p, "/")
+
+	if r.Method == http.MethodPut && m.onPut != nil {
+		m.onPut(r)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	switch r.Method {
+	case "MKCOL":
+		if m.folders[p] {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		m.folders[p] = true
+		w.WriteHeader(http.StatusCreated)
+	case http.MethodPut:
+		data, err := io.ReadAll(r.Body)
+		if err != nil || m.failPut[p] {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		_, existed := m.files[p]
+		if existed && r.Header.Get("If-None-Match") == "*" {
+			w.WriteHeader(http.StatusPreconditionFailed)
+			return
+		}
+		m.files[p] = data
+		if existed {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+	case http.MethodHead:
+		if data, ok := m.files[p]; ok {
+			w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+		w.WriteHeader(http.StatusNotFound)
+	case "MOVE":
+		destination, err := url.Parse(r.Header.Get("Destination"))
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		dest := strings.TrimSuffix(strings.TrimPrefix(destination.Path, "/remote.php/dav/files/uploader/"), "/")
+		if transfer, ok := strings.CutSuffix(p, "/.file"); ok {
+			var chunks []string
+			for file := range m.files {
+				if strings.HasPrefix(file, transfer+"/") {
+					chunks = append(chunks, file)
+				}
+			}
+			sort.Strings(chunks)
+			var data []byte
+			for _, chunk := range chunks {
+				data = append(data, m.files[chunk]...)
+				delete(m.files, chunk)
+			}
+			delete(m.folders, transfer)
+			m.files[dest] = data
+			w.WriteHeader(http.StatusCreated)
+			return
+		}
+		if m.folders[dest] && r.Header.Get("Overwrite") == "F" {
+			w.WriteHeader(http.StatusPreconditionFailed)
+			return
+		}
+		for folder := range m.folders {
+			if folder == p || strings.HasPrefix(folder, p+"/") {
+				delete(m.folders, folder)
+				m.folders[dest+strings.TrimPrefix(folder, p)] = true
+			}
+		}
+		for file, data := range m.files {
+			if strings.HasPrefix(file, p+"/") {
+				delete(m.files, file)
+				m.files[dest+strings.TrimPrefix(file, p)] = data
+			}
+		}
+		w.WriteHeader(http.StatusCreated)
+	case "PROPFIND":
+		// Lists the folder and its direct subfolders, without any properties
+		var responses []string
+		for folder := range m.folders {
+			if path.Dir(folder) == p {
+				responses = append(responses, "<d:response><d:href>/remote.php/dav/files/uploader/"+(&url.URL{Path: folder}).EscapedPath()+"/</d:href><d:propstat><d:prop><d:resourcetype><d:collection/></d:resourcetype></d:prop></d:propstat></d:response>")
+			}
+		}
+		if len(responses) == 0 && !m.folders[p] {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusMultiStatus)
+		fmt.Fprintf(w, `<?xml version="1.0"?><d:multistatus xmlns:d="DAV:">%s</d:multistatus>`, strings.Join(responses, ""))
+	case http.MethodDelete:
+		if _, ok := m.files[p]; !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		delete(m.files, p)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// file returns the contents of an uploaded file by its path below the user's root
+func (m *mockWebDAV) file(p string) ([]byte, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	data, ok := m.files[p]
+	return data, ok
+}
+
+// setupIntegration points the package globals at in-memory stores and a mock
+// WebDAV server, and restores them when the test ends.
+func setupIntegration(t *testing.T) *mockWebDAV {
+	t.Helper()
+	mock := &mockWebDAV{folders: make(map[string]bool), files: make(map[string][]byte)}
+	server := httptest.NewServer(mock)
+	t.Cleanup(server.Close)
+
+	oldConfig, oldChunks, oldSessions := appConfig, chunkStore, sessionStore
+	oldNextcloud, oldTargets, oldTemplate := nextcloud, nextcloudTargets, folderNameTemplate
+	t.Cleanup(func() {
+		appConfig, chunkStore, sessionStore = oldConfig, oldChunks, oldSessions
+		nextcloud, nextcloudTargets, folderNameTemplate = oldNextcloud, oldTargets, oldTemplate
+	})
+
+	appConfig = defaultConfig()
+	appConfig.NextcloudURL = server.URL
+	appConfig.NextcloudUser = "uploader"
+	appConfig.NextcloudAppPass = "secret"
+	appConfig.NextcloudUploadDir = "Uploads"
+	appConfig.CleanupOnStart = false
+	chunkStore = newMemoryChunkStore()
+	sessionStore = newMemorySessionStore()
+	nextcloud = newNextcloudClient(appConfig)
+	nextcloud.HTTPClient = server.Client()
+	nextcloudTargets = nil
+
+	// A fixed folder name keeps all files of a session together regardless of timing
+	var err error
+	if folderNameTemplate, err = parseFolderNameTemplate("{{.Email}}"); err != nil {
+		t.Fatalf("could not parse folder name template: %v", err)
+	}
+	return mock
+}
+
+// postJSON calls handler with a JSON body and returns the recorded response
+func postJSON(t *testing.T, handler http.HandlerFunc, body any) *httptest.ResponseRecorder {
+	t.Helper()
+	data, err := json.Marshal(body)
+	if err != nil {
+		t.Fatalf("could not encode request: %v", err)
+	}
+	req := httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(data))
+	req.Header.Set("Content-Type", "application/json")
+	rec := httptest.NewRecorder()
+	handler(rec, req)
+	return rec
+}
+
+// postChunk uploads one chunk through handleUploadChunk and returns the recorded response
+func postChunk(t *testing.T, uploadID, chunkIndex string, data []byte) *httptest.ResponseRecorder {
+	t.Helper()
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	form.WriteField("uploadId", uploadID)
+	form.WriteField("chunkIndex", chunkIndex)
+	part, err := form.CreateFormFile("dataFile", "blob")
+	if err != nil {
+		t.Fatalf("could not create form file: %v", err)
+	}
+	part.Write(data)
+	form.Close()
+
+	req := httptest.NewRequest(http.MethodPost, "/upload-chunk", &body)
+	req.Header.Set("Content-Type", form.FormDataContentType())
+	rec := httptest.NewRecorder()
+	handleUploadChunk(rec, req)
+	return rec
+}
+
+func TestUploadSessionEndToEnd(t *testing.T) {
+	mock := setupIntegration(t)
+
+	rec := postJSON(t, handleUploadSession, map[string]any{
+		"sessionId":  "session-1",
+		"email":      "jane@example.com",
+		"dataOrigin": "Test data",
+		"totalFiles": 2,
+	})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("session: status %d: %s", rec.Code, rec.Body)
+	}
+
+	files := map[string][][]byte{
+		"report.txt": {[]byte("first chunk|"), []byte("second chunk|"), []byte("third chunk")},
+		"notes.txt":  {[]byte("only chunk")},
+	}
+	for _, name := range []string{"report.txt", "notes.txt"} {
+		chunks := files[name]
+		uploadID := name + "-upload"
+		// Send the chunks in reverse to check that assembly follows the index, not arrival order
+		for i := len(chunks) - 1; i >= 0; i-- {
+			if rec := postChunk(t, uploadID, fmt.Sprint(i), chunks[i]); rec.Code != http.StatusOK {
+				t.Fatalf("%s chunk %d: status %d: %s", name, i, rec.Code, rec.Body)
+			}
+		}
+
+		rec := postJSON(t, handleUploadComplete, map[string]any{
+			"uploadId":   uploadID,
+			"fileName":   name,
+			"totalSize":  len(bytes.Join(chunks, nil)),
+			"email":      "jane@example.com",
+			"dataOrigin": "Test data",
+			"sessionId":  "session-1",
+		})
+		if rec.Code != http.StatusOK {
+			t.Fatalf("%s complete: status %d: %s", name, rec.Code, rec.Body)
+		}
+	}
+
+	for name, chunks := range files {
+		got, ok := mock.file("Uploads/jane_en_example_com/" + name)
+		if !ok {
+			t.Fatalf("%s was not uploaded", name)
+		}
+		if want := bytes.Join(chunks, nil); !bytes.Equal(got, want) {
+			t.Errorf("%s = %q, want %q", name, got, want)
+		}
+	}
+
+	description, ok := mock.file("Uploads/jane_en_example_com/" + appConfig.DescriptionFilename)
+	if !ok {
+		t.Fatal("description file was not uploaded")
+	}
+	if !strings.Contains(string(description), "jane@example.com") || !strings.Contains(string(description), "Test data") {
+		t.Errorf("description does not contain the contact details:\n%s", description)
+	}
+}
+
+func TestUploadCompleteRejectsIncompleteUpload(t *testing.T) {
+	mock := setupIntegration(t)
+
+	if rec := postChunk(t, "partial", "0", []byte("some data")); rec.Code != http.StatusOK {
+		t.Fatalf("chunk: status %d: %s", rec.Code, rec.Body)
+	}
+	rec := postJSON(t, handleUploadComplete, map[string]any{
+		"uploadId":  "partial",
+		"fileName":  "file.txt",
+		"totalSize": 1000,
+		"email":     "jane@example.com",
+	})
+	if rec.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("status %d, want 422: %s", rec.Code, rec.Body)
+	}
+	if _, ok := mock.file("Uploads/jane_en_example_com/file.txt"); ok {
+		t.Error("incomplete file was uploaded")
+	}
+}
+
+func TestUploadCompleteVerifiesFileHash(t *testing.T) {
+	mock := setupIntegration(t)
+	data := []byte("file contents")
+	goodHash := fmt.Sprintf("%x", sha256.Sum256(data))
+	badHash := fmt.Sprintf("%x", sha256.Sum256([]byte("other contents")))
+
+	for _, tc := range []struct {
+		hash     string
+		status   int
+		uploaded bool
+	}{
+		{badHash, http.StatusUnprocessableEntity, false},
+		{goodHash, http.StatusOK, true},
+	} {
+		if rec := postChunk(t, "hashed", "0", data); rec.Code != http.StatusOK {
+			t.Fatalf("chunk: status %d: %s", rec.Code, rec.Body)
+		}
+		rec := postJSON(t, handleUploadComplete, map[string]any{
+			"uploadId": "hashed",
+			"fileName": "file.txt",
+			"fileHash": tc.hash,
+			"email":    "jane@example.com",
+		})
+		if rec.Code != tc.status {
+			t.Fatalf("hash %s: status %d, want %d: %s", tc.hash, rec.Code, tc.status, rec.Body)
+		}
+		if _, ok := mock.file("Uploads/jane_en_example_com/file.txt"); ok != tc.uploaded {
+			t.Errorf("hash %s: file present = %v, want %v", tc.hash, ok, tc.uploaded)
+		}
+	}
+}
+
+func TestUploadCompleteRollsBackOnDescriptionFailure(t *testing.T) {
+	mock := setupIntegration(t)
+	mock.failPut = map[string]bool{"Uploads/jane_en_example_com/" + appConfig.DescriptionFilename: true}
+
+	if rec := postChunk(t, "upload", "0", []byte("data")); rec.Code != http.StatusOK {
+		t.Fatalf("chunk: status %d: %s", rec.Code, rec.Body)
+	}
+	rec := postJSON(t, handleUploadComplete, map[string]any{
+		"uploadId": "upload",
+		"fileName": "file.txt",
+		"email":    "jane@example.com",
+	})
+	if rec.Code != http.StatusInternalServerError {
+		t.Fatalf("status %d, want 500: %s", rec.Code, rec.Body)
+	}
+	if _, ok := mock.file("Uploads/jane_en_example_com/file.txt"); ok {
+		t.Error("uploaded file was not rolled back")
+	}
+}
+
+func TestUploadChunkRejectsInvalidIndex(t *testing.T) {
+	setupIntegration(t)
+
+	for _, index := range []string{"", "abc", "-1", "../0"} {
+		if rec := postChunk(t, "upload", index, []byte("data")); rec.Code != http.StatusBadRequest {
+			t.Errorf("index %q: status %d, want 400", index, rec.Code)
+		}
+	}
+
+	rec := postChunk(t, "", "0", []byte("data"))
+	if rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), "uploadId") {
+		t.Errorf("missing uploadId: status %d, want 400 naming the field: %s", rec.Code, rec.Body)
+	}
+}
+
+func TestUploadChunkRemovesMultipartTempFiles(t *testing.T) {
+	setupIntegration(t)
+	tempDir := t.TempDir()
+	t.Setenv("TMPDIR", tempDir)
+	appConfig.MultipartMemory = 1 // Spill every file part to disk
+
+	// Rejected requests parse the form too, so they must clean up as well
+	for _, index := range []string{"0", "-1"} {
+		postChunk(t, "spilled", index, bytes.Repeat([]byte("x"), 4096))
+		if entries, _ := os.ReadDir(tempDir); len(entries) != 0 {
+			t.Errorf("chunk %s left %d multipart temp files behind", index, len(entries))
+		}
+	}
+}
+
+func TestUploadSessionRejectsUnknownTarget(t *testing.T) {
+	setupIntegration(t)
+
+	rec := postJSON(t, handleUploadSession, map[string]any{
+		"sessionId":  "session-1",
+		"email":      "jane@example.com",
+		"totalFiles": 1,
+		"target":     "missing",
+	})
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("status %d, want 400: %s", rec.Code, rec.Body)
+	}
+}
+
+func TestUploadCompleteUploadsToSessionTarget(t *testing.T) {
+	setupIntegration(t)
+	legal := &mockWebDAV{folders: make(map[string]bool), files: make(map[string][]byte)}
+	server := httptest.NewServer(legal)
+	defer server.Close()
+	nextcloudTargets = map[string]*NextcloudClient{
+		"legal": {
+			BaseURL:       server.URL,
+			User:          "uploader",
+			AppPass:       "secret",
+			UploadDir:     "Legal",
+			HTTPClient:    server.Client(),
+			MkcolTimeout:  5 * time.Second,
+			UploadTimeout: 5 * time.Second,
+			HeadTimeout:   5 * time.Second,
+		},
+	}
+
+	rec := postJSON(t, handleUploadSession, map[string]any{
+		"sessionId":  "session-1",
+		"email":      "jane@example.com",
+		"totalFiles": 1,
+		"target":     "legal",
+	})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("session: status %d: %s", rec.Code, rec.Body)
+	}
+	if rec := postChunk(t, "contract", "0", []byte("contract")); rec.Code != http.StatusOK {
+		t.Fatalf("chunk: status %d: %s", rec.Code, rec.Body)
+	}
+	rec = postJSON(t, handleUploadComplete, map[string]any{
+		"uploadId":  "contract",
+		"fileName":  "contract.txt",
+		"email":     "jane@example.com",
+		"sessionId": "session-1",
+	})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("complete: status %d: %s", rec.Code, rec.Body)
+	}
+	if got, ok := legal.file("Legal/jane_en_example_com/contract.txt"); !ok || string(got) != "contract" {
+		t.Errorf("contract.txt on legal target = %q (found %v), want %q", got, ok, "contract")
+	}
+}
+
+func TestUploadSessionRejectsWhenAtCapacity(t *testing.T) {
+	setupIntegration(t)
+	appConfig.MaxActiveSessions = 1
+
+	for i, want := range []int{http.StatusOK, http.StatusServiceUnavailable} {
+		rec := postJSON(t, handleUploadSession, map[string]any{
+			"sessionId":  fmt.Sprintf("session-%d", i),
+			"email":      "jane@example.com",
+			"totalFiles": 1,
+		})
+		if rec.Code != want {
+			t.Fatalf("session %d: status %d, want %d: %s", i, rec.Code, want, rec.Body)
+		}
+		if want == http.StatusServiceUnavailable && rec.Header().Get("Retry-After") == "" {
+			t.Error("missing Retry-After header")
+		}
+	}
+}
+
+func TestUploadCompleteGeneratesThumbnail(t *testing.T) {
+	mock := setupIntegration(t)
+	appConfig.GenerateThumbnails = true
+
+	var img bytes.Buffer
+	if err := png.Encode(&img, image.NewRGBA(image.Rect(0, 0, 1024, 512))); err != nil {
+		t.Fatalf("could not encode test image: %v", err)
+	}
+	for uploadID, data := range map[string][]byte{"photo.png": img.Bytes(), "notes.txt": []byte("not an image")} {
+		if rec := postChunk(t, uploadID, "0", data); rec.Code != http.StatusOK {
+			t.Fatalf("%s chunk: status %d: %s", uploadID, rec.Code, rec.Body)
+		}
+		rec := postJSON(t, handleUploadComplete, map[string]any{
+			"uploadId": uploadID,
+			"fileName": uploadID,
+			"email":    "jane@example.com",
+		})
+		if rec.Code != http.StatusOK {
+			t.Fatalf("%s complete: status %d: %s", uploadID, rec.Code, rec.Body)
+		}
+	}
+
+	thumb, ok := mock.file("Uploads/jane_en_example_com/thumb_photo.png")
+	if !ok {
+		t.Fatal("thumbnail was not uploaded")
+	}
+	config, err := png.DecodeConfig(bytes.NewReader(thumb))
+	if err != nil {
+		t.Fatalf("thumbnail is not a PNG: %v", err)
+	}
+	if config.Width != thumbnailSize || config.Height != thumbnailSize/2 {
+		t.Errorf("thumbnail is %dx%d, want %dx%d", config.Width, config.Height, thumbnailSize, thumbnailSize/2)
+	}
+	if _, ok := mock.file("Uploads/jane_en_example_com/thumb_notes.txt"); ok {
+		t.Error("thumbnail was uploaded for a text file")
+	}
+}
+
+func TestUploadCompleteWaitsForChunksInFlight(t *testing.T) {
+	mock := setupIntegration(t)
+	appConfig.ChunkWaitAttempts = 20
+	appConfig.ChunkWaitInterval = 10 * time.Millisecond
+
+	if rec := postChunk(t, "late", "0", []byte("first|")); rec.Code != http.StatusOK {
+		t.Fatalf("chunk 0: status %d: %s", rec.Code, rec.Body)
+	}
+	go func() {
+		time.Sleep(30 * time.Millisecond)
+		chunkStore.WriteChunk("late", "1", strings.NewReader("second"))
+	}()
+	rec := postJSON(t, handleUploadComplete, map[string]any{
+		"uploadId":    "late",
+		"fileName":    "file.txt",
+		"totalChunks": 2,
+		"email":       "jane@example.com",
+	})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", rec.Code, rec.Body)
+	}
+	if got, _ := mock.file("Uploads/jane_en_example_com/file.txt"); string(got) != "first|second" {
+		t.Errorf("file = %q, want %q", got, "first|second")
+	}
+
+	// Without the late chunk the wait runs out and the upload is incomplete
+	postChunk(t, "short", "0", []byte("only"))
+	rec = postJSON(t, handleUploadComplete, map[string]any{
+		"uploadId":    "short",
+		"fileName":    "other.txt",
+		"totalChunks": 2,
+		"email":       "jane@example.com",
+	})
+	if rec.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("status %d, want 422: %s", rec.Code, rec.Body)
+	}
+}
+
+func TestUploadCompleteWritesAuditLog(t *testing.T) {
+	setupIntegration(t)
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	var err error
+	if auditLog, err = openAuditLog(path); err != nil {
+		t.Fatalf("could not open audit log: %v", err)
+	}
+	t.Cleanup(func() { auditLog = nil })
+
+	postChunk(t, "audited", "0", []byte("data"))
+	postJSON(t, handleUploadComplete, map[string]any{"uploadId": "audited", "fileName": "file.txt", "email": "jane@example.com"})
+	postJSON(t, handleUploadComplete, map[string]any{"uploadId": "..", "fileName": "file.txt", "email": "jane@example.com"})
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("could not read audit log: %v", err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("got %d audit entries, want 2:\n%s", len(lines), data)
+	}
+	var entries [2]AuditEntry
+	for i, line := range lines {
+		if err := json.Unmarshal([]byte(line), &entries[i]); err != nil {
+			t.Fatalf("entry %d is not JSON: %v", i, err)
+		}
+	}
+	if e := entries[0]; e.Outcome != "success" || e.Email != "jane@example.com" || e.FileName != "file.txt" || e.Size != 4 {
+		t.Errorf("success entry = %+v", e)
+	}
+	if e := entries[1]; e.Outcome != "rejected" || e.Status != http.StatusBadRequest || e.Code != errCodeInvalidInput {
+		t.Errorf("rejection entry = %+v", e)
+	}
+}
+
+func TestUploadCompleteSkipsExistingFile(t *testing.T) {
+	mock := setupIntegration(t)
+	appConfig.OnConflict = conflictSkip
+	mock.files["Uploads/jane_en_example_com/file.txt"] = []byte("original")
+
+	postChunk(t, "retry", "0", []byte("replacement"))
+	rec := postJSON(t, handleUploadComplete, map[string]any{
+		"uploadId": "retry",
+		"fileName": "file.txt",
+		"email":    "jane@example.com",
+	})
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `"skipped":"true"`) {
+		t.Fatalf("status %d, want 200 reporting the skip: %s", rec.Code, rec.Body)
+	}
+	if got, _ := mock.file("Uploads/jane_en_example_com/file.txt"); string(got) != "original" {
+		t.Errorf("file = %q, want the original contents", got)
+	}
+}
+
+func TestUploadCompleteRejectsExpiredSession(t *testing.T) {
+	mock := setupIntegration(t)
+	appConfig.SessionMaxDuration = time.Millisecond
+
+	rec := postJSON(t, handleUploadSession, map[string]any{
+		"sessionId":  "session-1",
+		"email":      "jane@example.com",
+		"totalFiles": 1,
+	})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("session: status %d: %s", rec.Code, rec.Body)
+	}
+	postChunk(t, "late", "0", []byte("data"))
+	time.Sleep(5 * time.Millisecond)
+
+	rec = postJSON(t, handleUploadComplete, map[string]any{
+		"uploadId":  "late",
+		"fileName":  "file.txt",
+		"email":     "jane@example.com",
+		"sessionId": "session-1",
+	})
+	if rec.Code != http.StatusGone {
+		t.Fatalf("status %d, want 410: %s", rec.Code, rec.Body)
+	}
+	if _, ok := mock.file("Uploads/jane_en_example_com/file.txt"); ok {
+		t.Error("file of an expired session was uploaded")
+	}
+	if _, err := chunkStore.ListChunks("late"); err == nil {
+		t.Error("chunks of the expired session were kept")
+	}
+}
+
+func TestUploadSessionWritesJSONMetadata(t *testing.T) {
+	mock := setupIntegration(t)
+	appConfig.MetadataFormat = metadataFormatJSON
+
+	postJSON(t, handleUploadSession, map[string]any{
+		"sessionId":  "session-1",
+		"email":      "jane@example.com",
+		"dataOrigin": "Test data",
+		"totalFiles": 2,
+	})
+	for _, name := range []string{"a.txt", "b.txt"} {
+		postChunk(t, name, "0", []byte(name))
+		rec := postJSON(t, handleUploadComplete, map[string]any{
+			"uploadId":   name,
+			"fileName":   name,
+			"email":      "jane@example.com",
+			"dataOrigin": "Test data",
+			"sessionId":  "session-1",
+		})
+		if rec.Code != http.StatusOK {
+			t.Fatalf("%s complete: status %d: %s", name, rec.Code, rec.Body)
+		}
+	}
+
+	if _, ok := mock.file("Uploads/jane_en_example_com/" + appConfig.DescriptionFilename); ok {
+		t.Error("text description was written with METADATA_FORMAT=json")
+	}
+	data, ok := mock.file("Uploads/jane_en_example_com/metadata.json")
+	if !ok {
+		t.Fatal("metadata.json was not uploaded")
+	}
+	var metadata UploadMetadata
+	if err := json.Unmarshal(data, &metadata); err != nil {
+		t.Fatalf("metadata.json is not valid JSON: %v", err)
+	}
+	if metadata.Email != "jane@example.com" || metadata.DataOrigin != "Test data" || len(metadata.Files) != 2 {
+		t.Fatalf("metadata = %+v", metadata)
+	}
+	if file := metadata.Files[1]; file.FileName != "b.txt" || file.Size != 5 || file.SHA256 != fmt.Sprintf("%x", sha256.Sum256([]byte("b.txt"))) {
+		t.Errorf("second file = %+v", file)
+	}
+}
+
+func TestUploadCompleteRejectsEmptyUpload(t *testing.T) {
+	mock := setupIntegration(t)
+
+	rec := postJSON(t, handleUploadComplete, map[string]any{
+		"uploadId": "nothing",
+		"fileName": "empty.txt",
+		"email":    "jane@example.com",
+	})
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("status %d, want 400: %s", rec.Code, rec.Body)
+	}
+	if len(mock.folders) != 0 {
+		t.Errorf("folders created for an empty upload: %v", mock.folders)
+	}
+
+	// With ALLOW_EMPTY_FILES the same completion stores a zero-byte file
+	appConfig.AllowEmptyFiles = true
+	rec = postJSON(t, handleUploadComplete, map[string]any{
+		"uploadId": "nothing",
+		"fileName": "empty.txt",
+		"email":    "jane@example.com",
+	})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status %d, want 200: %s", rec.Code, rec.Body)
+	}
+	if data, ok := mock.file("Uploads/jane_en_example_com/empty.txt"); !ok || len(data) != 0 {
+		t.Errorf("empty.txt = %q (exists %v), want an empty file", data, ok)
+	}
+}
+
+func TestFolderPerSessionKeepsFilesTogether(t *testing.T) {
+	mock := setupIntegration(t)
+	appConfig.FolderPerSession = true
+
+	postJSON(t, handleUploadSession, map[string]any{
+		"sessionId":  "session-1",
+		"email":      "jane@example.com",
+		"totalFiles": 1,
+	})
+	// A folder name computed at completion time would now differ
+	var err error
+	if folderNameTemplate, err = parseFolderNameTemplate("later-{{.Email}}"); err != nil {
+		t.Fatalf("could not parse folder name template: %v", err)
+	}
+
+	postChunk(t, "file", "0", []byte("data"))
+	rec := postJSON(t, handleUploadComplete, map[string]any{
+		"uploadId":  "file",
+		"fileName":  "file.txt",
+		"email":     "jane@example.com",
+		"sessionId": "session-1",
+	})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", rec.Code, rec.Body)
+	}
+	if _, ok := mock.file("Uploads/jane_en_example_com/file.txt"); !ok {
+		t.Error("file did not land in the folder chosen at session registration")
+	}
+}
+
+func TestUploadSessionExists(t *testing.T) {
+	setupIntegration(t)
+	postJSON(t, handleUploadSession, map[string]any{
+		"sessionId":  "session-1",
+		"email":      "jane@example.com",
+		"totalFiles": 1,
+	})
+
+	for sessionID, want := range map[string]int{"session-1": http.StatusOK, "missing": http.StatusNotFound, "": http.StatusBadRequest} {
+		rec := httptest.NewRecorder()
+		handleUploadSession(rec, httptest.NewRequest(http.MethodGet, "/upload-session?sessionId="+sessionID, nil))
+		if rec.Code != want {
+			t.Errorf("session %q: status %d, want %d", sessionID, rec.Code, want)
+		}
+	}
+}
+
+func TestUploadSessionExistsRequiresUploadToken(t *testing.T) {
+	setupIntegration(t)
+	postJSON(t, handleUploadSession, map[string]any{
+		"sessionId":  "session-1",
+		"email":      "jane@example.com",
+		"totalFiles": 1,
+	})
+	appConfig.UploadToken = "secret"
+
+	for token, want := range map[string]int{"": http.StatusUnauthorized, "wrong": http.StatusUnauthorized, "secret": http.StatusOK} {
+		req := httptest.NewRequest(http.MethodGet, "/upload-session?sessionId=session-1", nil)
+		if token != "" {
+			req.Header.Set(uploadTokenHeader, token)
+		}
+		rec := httptest.NewRecorder()
+		handleUploadSession(rec, req)
+		if rec.Code != want {
+			t.Errorf("token %q: status %d, want %d", token, rec.Code, want)
+		}
+	}
+}
+
+func TestUploadRangeOutOfOrder(t *testing.T) {
+	mock := setupIntegration(t)
+	appConfig.UploadTempDir = t.TempDir()
+
+	putRange := func(contentRange, data string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPut, "/upload-range?uploadId=ranged", strings.NewReader(data))
+		req.Header.Set("Content-Range", contentRange)
+		rec := httptest.NewRecorder()
+		handleUploadRange(rec, req)
+		return rec
+	}
+	complete := func() *httptest.ResponseRecorder {
+		return postJSON(t, handleUploadComplete, map[string]any{
+			"uploadId": "ranged",
+			"fileName": "ranged.txt",
+			"email":    "jane@example.com",
+		})
+	}
+
+	if rec := putRange("bytes 6-10/11", "world"); rec.Code != http.StatusOK {
+		t.Fatalf("second range: status %d: %s", rec.Code, rec.Body)
+	}
+	if rec := putRange("bytes 0-4/12", "hello"); rec.Code != http.StatusBadRequest {
+		t.Errorf("range with another total: status %d, want 400", rec.Code)
+	}
+	if rec := putRange("bytes 0-4/11", "hello"); rec.Code != http.StatusOK {
+		t.Fatalf("first range: status %d: %s", rec.Code, rec.Body)
+	}
+
+	// The gap at offset 5 keeps the upload incomplete
+	if rec := complete(); rec.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("incomplete upload: status %d, want 422: %s", rec.Code, rec.Body)
+	}
+	if rec := putRange("bytes 0-4/11", "hello"); rec.Code != http.StatusOK {
+		t.Fatalf("first range: status %d: %s", rec.Code, rec.Body)
+	}
+	if rec := putRange("bytes 6-10/11", "world"); rec.Code != http.StatusOK {
+		t.Fatalf("second range: status %d: %s", rec.Code, rec.Body)
+	}
+	rec := putRange("bytes 5-5/11", " ")
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `"complete":true`) {
+		t.Fatalf("gap range: status %d: %s", rec.Code, rec.Body)
+	}
+
+	if rec := complete(); rec.Code != http.StatusOK {
+		t.Fatalf("complete: status %d: %s", rec.Code, rec.Body)
+	}
+	if data, _ := mock.file("Uploads/jane_en_example_com/ranged.txt"); string(data) != "hello world" {
+		t.Errorf("ranged.txt = %q, want %q", data, "hello world")
+	}
+	if rangeUploadExists("ranged") {
+		t.Error("range upload was not removed after completion")
+	}
+}
+
+func TestUploadIDsCannotReachRangeUploads(t *testing.T) {
+	setupIntegration(t)
+	appConfig.UploadTempDir = t.TempDir()
+
+	req := httptest.NewRequest(http.MethodPut, "/upload-range?uploadId=ranged", strings.NewReader("hello"))
+	req.Header.Set("Content-Range", "bytes 0-4/11")
+	rec := httptest.NewRecorder()
+	handleUploadRange(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("range: status %d: %s", rec.Code, rec.Body)
+	}
+
+	for _, uploadID := range []string{".ranges", ".hidden"} {
+		if rec := postJSON(t, handleUploadCancel, map[string]any{"uploadId": uploadID}); rec.Code != http.StatusBadRequest {
+			t.Errorf("cancel %q: status %d, want 400", uploadID, rec.Code)
+		}
+		rec := postJSON(t, handleUploadComplete, map[string]any{"uploadId": uploadID, "fileName": "file.txt", "email": "jane@example.com"})
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("complete %q: status %d, want 400", uploadID, rec.Code)
+		}
+	}
+	if !rangeUploadExists("ranged") {
+		t.Error("range upload was removed through another upload ID")
+	}
+}
+
+func TestTusUpload(t *testing.T) {
+	mock := setupIntegration(t)
+	appConfig.UploadTempDir = t.TempDir()
+
+	tusRequest := func(method, target string, body string, headers map[string]string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		req.Header.Set("Tus-Resumable", tusVersion)
+		for key, value := range headers {
+			req.Header.Set(key, value)
+		}
+		rec := httptest.NewRecorder()
+		handleTus(rec, req)
+		return rec
+	}
+	b64 := base64.StdEncoding.EncodeToString
+
+	rec := tusRequest(http.MethodPost, tusBasePath, "", map[string]string{
+		"Upload-Length":   "11",
+		"Upload-Metadata": "filename " + b64([]byte("tus.txt")) + ",email " + b64([]byte("jane@example.com")),
+	})
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("create: status %d: %s", rec.Code, rec.Body)
+	}
+	location := rec.Header().Get("Location")
+
+	patch := func(offset, data string) *httptest.ResponseRecorder {
+		return tusRequest(http.MethodPatch, location, data, map[string]string{
+			"Content-Type":  "application/offset+octet-stream",
+			"Upload-Offset": offset,
+		})
+	}
+	if rec := patch("0", "hello "); rec.Code != http.StatusNoContent || rec.Header().Get("Upload-Offset") != "6" {
+		t.Fatalf("first patch: status %d, offset %q: %s", rec.Code, rec.Header().Get("Upload-Offset"), rec.Body)
+	}
+	if rec := patch("0", "hello "); rec.Code != http.StatusConflict {
+		t.Errorf("patch at stale offset: status %d, want 409", rec.Code)
+	}
+	if rec := tusRequest(http.MethodHead, location, "", nil); rec.Header().Get("Upload-Offset") != "6" {
+		t.Errorf("HEAD Upload-Offset = %q, want 6", rec.Header().Get("Upload-Offset"))
+	}
+	if rec := patch("6", "world"); rec.Code != http.StatusNoContent {
+		t.Fatalf("last patch: status %d: %s", rec.Code, rec.Body)
+	}
+
+	if data, _ := mock.file("Uploads/jane_en_example_com/tus.txt"); string(data) != "hello world" {
+		t.Errorf("tus.txt = %q, want %q", data, "hello world")
+	}
+	if rec := tusRequest(http.MethodHead, location, "", nil); rec.Code != http.StatusNotFound {
+		t.Errorf("HEAD after completion: status %d, want 404", rec.Code)
+	}
+}
+
+func TestServeFormFallsBackToEmbeddedCopy(t *testing.T) {
+	setupIntegration(t)
+
+	get := func(path string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		serveForm(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		return rec
+	}
+	embedded, _ := embeddedAssets.ReadFile("index.html")
+	if rec := get("/"); rec.Code != http.StatusOK || rec.Body.String() != string(embedded) {
+		t.Errorf("embedded form: status %d, body differs from index.html", rec.Code)
+	}
+
+	// An override directory serves its own assets but never hidden files
+	appConfig.StaticDir = t.TempDir()
+	os.WriteFile(filepath.Join(appConfig.StaticDir, "index.html"), []byte("custom form"), 0o600)
+	os.WriteFile(filepath.Join(appConfig.StaticDir, "style.css"), []byte("body {}"), 0o600)
+	os.WriteFile(filepath.Join(appConfig.StaticDir, ".env"), []byte("SECRET=1"), 0o600)
+	for path, want := range map[string]string{"/": "custom form", "/style.css": "body {}", "/.env": "custom form"} {
+		if rec := get(path); rec.Body.String() != want {
+			t.Errorf("GET %s = %q, want %q", path, rec.Body, want)
+		}
+	}
+
+	os.Remove(filepath.Join(appConfig.StaticDir, "index.html"))
+	if rec := get("/"); rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("missing form: status %d, want 503", rec.Code)
+	}
+}
+
+func TestUploadCompleteAbortsWhenClientDisconnects(t *testing.T) {
+	mock := setupIntegration(t)
+
+	if rec := postChunk(t, "aborted", "0", []byte("file contents")); rec.Code != http.StatusOK {
+		t.Fatalf("chunk: status %d: %s", rec.Code, rec.Body)
+	}
+
+	// The client goes away while the file is being sent to Nextcloud
+	ctx, cancel := context.WithCancel(context.Background())
+	mock.onPut = func(r *http.Request) {
+		cancel()
+		// A complete body means the client may still be connected; the server
+		// then notices it leaving. A broken body means it is already gone.
+		if _, err := io.Copy(io.Discard, r.Body); err == nil {
+			<-r.Context().Done()
+		}
+	}
+	body, _ := json.Marshal(map[string]any{"uploadId": "aborted", "fileName": "file.txt", "email": "jane@example.com"})
+	req := httptest.NewRequest(http.MethodPost, "/upload-complete", bytes.NewReader(body)).WithContext(ctx)
+	rec := httptest.NewRecorder()
+	handleUploadComplete(rec, req)
+
+	// Nobody is left to read a response
+	if rec.Body.Len() != 0 {
+		t.Errorf("aborted upload got a response: %s", rec.Body)
+	}
+	if _, err := chunkStore.ListChunks("aborted"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("chunks of aborted upload were kept: %v", err)
+	}
+}
+
+func TestRenameOnCompleteFinalizesFolder(t *testing.T) {
+	mock := setupIntegration(t)
+	appConfig.RenameOnComplete = true
+	appConfig.CompleteFolderPrefix = "done_"
+
+	for i, want := range []string{"done_jane_en_example_com", "done_jane_en_example_com (2)"} {
+		uploadID := fmt.Sprintf("renamed-%d", i)
+		if rec := postChunk(t, uploadID, "0", []byte("file contents")); rec.Code != http.StatusOK {
+			t.Fatalf("chunk: status %d: %s", rec.Code, rec.Body)
+		}
+		rec := postJSON(t, handleUploadComplete, map[string]any{
+			"uploadId": uploadID,
+			"fileName": "file.txt",
+			"email":    "jane@example.com",
+		})
+		if rec.Code != http.StatusOK {
+			t.Fatalf("complete: status %d: %s", rec.Code, rec.Body)
+		}
+		var response map[string]string
+		json.Unmarshal(rec.Body.Bytes(), &response)
+		if response["folderName"] != want {
+			t.Errorf("folderName = %q, want %q", response["folderName"], want)
+		}
+		if _, ok := mock.file("Uploads/" + want + "/file.txt"); !ok {
+			t.Errorf("file not found in renamed folder %s", want)
+		}
+	}
+	if mock.folders["Uploads/pending_jane_en_example_com"] {
+		t.Error("pending folder still exists")
+	}
+}
+
+func TestHashFolderIdentifiersKeepsEmailOutOfFolderName(t *testing.T) {
+	mock := setupIntegration(t)
+	appConfig.HashFolderIdentifiers = true
+	appConfig.FolderIdentifierSalt = "pepper"
+
+	if rec := postChunk(t, "hashed-folder", "0", []byte("file contents")); rec.Code != http.StatusOK {
+		t.Fatalf("chunk: status %d: %s", rec.Code, rec.Body)
+	}
+	rec := postJSON(t, handleUploadComplete, map[string]any{
+		"uploadId": "hashed-folder",
+		"fileName": "file.txt",
+		"email":    "jane@example.com",
+	})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("complete: status %d: %s", rec.Code, rec.Body)
+	}
+	var response map[string]string
+	json.Unmarshal(rec.Body.Bytes(), &response)
+	folderName := response["folderName"]
+	if strings.Contains(folderName, "jane") || folderName != folderIdentifier("jane_en_example_com") {
+		t.Fatalf("folderName = %q, want the hashed email", folderName)
+	}
+	description, ok := mock.file("Uploads/" + folderName + "/" + appConfig.DescriptionFilename)
+	if !ok {
+		t.Fatal("description file was not uploaded")
+	}
+	if !strings.Contains(string(description), "jane@example.com") {
+		t.Errorf("description does not contain the email:\n%s", description)
+	}
+}
+
+func TestUploadChunkLimitsConcurrentChunksPerUpload(t *testing.T) {
+	setupIntegration(t)
+	appConfig.MaxConcurrentChunks = 1
+
+	// Hold the only slot as if another chunk of the upload were being written
+	release, ok := chunkWrites.acquire("busy", appConfig.MaxConcurrentChunks)
+	if !ok {
+		t.Fatal("could not acquire write slot")
+	}
+	if rec := postChunk(t, "busy", "1", []byte("data")); rec.Code != http.StatusTooManyRequests {
+		t.Fatalf("status %d, want 429: %s", rec.Code, rec.Body)
+	}
+	if rec := postChunk(t, "other", "0", []byte("data")); rec.Code != http.StatusOK {
+		t.Fatalf("other upload: status %d: %s", rec.Code, rec.Body)
+	}
+	release()
+	if rec := postChunk(t, "busy", "1", []byte("data")); rec.Code != http.StatusOK {
+		t.Fatalf("after release: status %d: %s", rec.Code, rec.Body)
+	}
+}
+
+func TestTusPatchAppliesUploadLimits(t *testing.T) {
+	setupIntegration(t)
+	appConfig.UploadTempDir = t.TempDir()
+	appConfig.MaxConcurrentChunks = 1
+	appConfig.SessionMaxDuration = 50 * time.Millisecond
+
+	postJSON(t, handleUploadSession, map[string]any{
+		"sessionId":  "session-1",
+		"email":      "jane@example.com",
+		"totalFiles": 1,
+	})
+	tusRequest := func(method, target string, headers map[string]string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, strings.NewReader("hello"))
+		req.Header.Set("Tus-Resumable", tusVersion)
+		for key, value := range headers {
+			req.Header.Set(key, value)
+		}
+		rec := httptest.NewRecorder()
+		handleTus(rec, req)
+		return rec
+	}
+	rec := tusRequest(http.MethodPost, tusBasePath, map[string]string{
+		"Upload-Length":   "11",
+		"Upload-Metadata": "filename " + base64.StdEncoding.EncodeToString([]byte("tus.txt")) + ",sessionId " + base64.StdEncoding.EncodeToString([]byte("session-1")),
+	})
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("create: status %d: %s", rec.Code, rec.Body)
+	}
+	location := rec.Header().Get("Location")
+	uploadID := strings.TrimPrefix(location, tusBasePath)
+	patch := func() *httptest.ResponseRecorder {
+		return tusRequest(http.MethodPatch, location, map[string]string{
+			"Content-Type":  "application/offset+octet-stream",
+			"Upload-Offset": "0",
+		})
+	}
+
+	release, ok := chunkWrites.acquire(uploadID, appConfig.MaxConcurrentChunks)
+	if !ok {
+		t.Fatal("could not acquire write slot")
+	}
+	if rec := patch(); rec.Code != http.StatusTooManyRequests {
+		t.Errorf("patch while busy: status %d, want 429: %s", rec.Code, rec.Body)
+	}
+	release()
+
+	time.Sleep(60 * time.Millisecond)
+	if rec := patch(); rec.Code != http.StatusGone {
+		t.Fatalf("patch after expiry: status %d, want 410: %s", rec.Code, rec.Body)
+	}
+	if rangeUploadExists(uploadID) {
+		t.Error("tus upload of the expired session was kept")
+	}
+}
+
+func TestUploadSessionWritesManifest(t *testing.T) {
+	mock := setupIntegration(t)
+	appConfig.WriteManifest = true
+
+	postJSON(t, handleUploadSession, map[string]any{
+		"sessionId":  "session-1",
+		"email":      "jane@example.com",
+		"totalFiles": 2,
+	})
+	for i, name := range []string{"a.txt", "b.txt"} {
+		postChunk(t, name, "0", []byte(name))
+		rec := postJSON(t, handleUploadComplete, map[string]any{
+			"uploadId":  name,
+			"fileName":  name,
+			"email":     "jane@example.com",
+			"sessionId": "session-1",
+		})
+		if rec.Code != http.StatusOK {
+			t.Fatalf("%s complete: status %d: %s", name, rec.Code, rec.Body)
+		}
+		if _, ok := mock.file("Uploads/jane_en_example_com/" + manifestFilename); ok != (i == 1) {
+			t.Fatalf("after %s: manifest present = %v", name, ok)
+		}
+	}
+
+	data, _ := mock.file("Uploads/jane_en_example_com/" + manifestFilename)
+	var manifest UploadManifest
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		t.Fatalf("manifest is not valid JSON: %v", err)
+	}
+	if len(manifest.Files) != 2 {
+		t.Fatalf("manifest lists %d files, want 2", len(manifest.Files))
+	}
+	for _, file := range manifest.Files {
+		if want := fmt.Sprintf("%x", sha256.Sum256([]byte(file.FileName))); file.SHA256 != want || file.Size != int64(len(file.FileName)) {
+			t.Errorf("manifest entry %+v, want size %d and sha256 %s", file, len(file.FileName), want)
+		}
+	}
+}
+
+func TestUploadCompleteRedirectsBrowsers(t *testing.T) {
+	setupIntegration(t)
+	appConfig.SuccessRedirectURL = "https://example.org/thanks?lang=en"
+
+	postChunk(t, "form-upload", "0", []byte("file contents"))
+	data, _ := json.Marshal(map[string]any{
+		"uploadId": "form-upload",
+		"fileName": "file.txt",
+		"email":    "jane@example.com",
+	})
+	req := httptest.NewRequest(http.MethodPost, "/upload-complete", bytes.NewReader(data))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "text/html,application/xhtml+xml;q=0.9")
+	rec := httptest.NewRecorder()
+	handleUploadComplete(rec, req)
+
+	if rec.Code != http.StatusSeeOther {
+		t.Fatalf("status %d, want 303: %s", rec.Code, rec.Body)
+	}
+	if want := "https://example.org/thanks?folderName=jane_en_example_com&lang=en"; rec.Header().Get("Location") != want {
+		t.Errorf("Location = %q, want %q", rec.Header().Get("Location"), want)
+	}
+
+	// AJAX clients keep getting JSON
+	postChunk(t, "ajax-upload", "0", []byte("file contents"))
+	rec = postJSON(t, handleUploadComplete, map[string]any{
+		"uploadId": "ajax-upload",
+		"fileName": "other.txt",
+		"email":    "jane@example.com",
+	})
+	if rec.Code != http.StatusOK || rec.Header().Get("Content-Type") != "application/json" {
+		t.Errorf("AJAX response: status %d, content type %q", rec.Code, rec.Header().Get("Content-Type"))
+	}
+}
+
+func TestStreamChunksForwardsChunksToNextcloud(t *testing.T) {
+	mock := setupIntegration(t)
+	appConfig.StreamChunks = true
+
+	chunks := [][]byte{[]byte("first chunk|"), []byte("second chunk")}
+	for i, chunk := range chunks {
+		if rec := postChunk(t, "streamed", fmt.Sprint(i), chunk); rec.Code != http.StatusOK {
+			t.Fatalf("chunk %d: status %d: %s", i, rec.Code, rec.Body)
+		}
+	}
+	if rec := postChunk(t, "streamed", "3", []byte("skipped ahead")); rec.Code != http.StatusConflict {
+		t.Fatalf("out of order chunk: status %d, want 409: %s", rec.Code, rec.Body)
+	}
+	// A retried chunk is acknowledged without being sent twice
+	if rec := postChunk(t, "streamed", "1", chunks[1]); rec.Code != http.StatusOK {
+		t.Fatalf("retried chunk: status %d: %s", rec.Code, rec.Body)
+	}
+	if _, err := chunkStore.ListChunks("streamed"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("streamed chunks were stored locally: %v", err)
+	}
+
+	want := bytes.Join(chunks, nil)
+	rec := postJSON(t, handleUploadComplete, map[string]any{
+		"uploadId":  "streamed",
+		"fileName":  "file.txt",
+		"fileHash":  fmt.Sprintf("%x", sha256.Sum256(want)),
+		"totalSize": len(want),
+		"email":     "jane@example.com",
+	})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("complete: status %d: %s", rec.Code, rec.Body)
+	}
+	if got, ok := mock.file("Uploads/jane_en_example_com/file.txt"); !ok || !bytes.Equal(got, want) {
+		t.Errorf("file.txt = %q, want %q", got, want)
+	}
+	if lookupStreamTransfer("streamed") != nil {
+		t.Error("streamed upload was not forgotten after completion")
+	}
+}
+
+func TestStreamChunksEnforcesUploadLimits(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		limit  func()
+		status int
+	}{
+		{"chunk count", func() { appConfig.MaxChunksPerUpload = 2 }, http.StatusBadRequest},
+		{"upload size", func() { appConfig.MaxUploadBytes = 20 }, http.StatusRequestEntityTooLarge},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			mock := setupIntegration(t)
+			appConfig.StreamChunks = true
+			tc.limit()
+			t.Cleanup(func() { removeStreamTransfer(context.Background(), "streamed") })
+
+			for i := range 2 {
+				if rec := postChunk(t, "streamed", fmt.Sprint(i), []byte("ten bytes|")); rec.Code != http.StatusOK {
+					t.Fatalf("chunk %d: status %d: %s", i, rec.Code, rec.Body)
+				}
+			}
+			mock.onPut = func(r *http.Request) { t.Errorf("chunk over the limit was forwarded to %s", r.URL.Path) }
+			if rec := postChunk(t, "streamed", "2", []byte("ten bytes|")); rec.Code != tc.status {
+				t.Fatalf("chunk over the limit: status %d, want %d: %s", rec.Code, tc.status, rec.Body)
+			}
+		})
+	}
+}
+
+func TestStreamChunksCompleteAfterIncompleteAttempt(t *testing.T) {
+	mock := setupIntegration(t)
+	appConfig.StreamChunks = true
+
+	chunks := [][]byte{[]byte("first chunk|"), []byte("second chunk")}
+	complete := func() *httptest.ResponseRecorder {
+		return postJSON(t, handleUploadComplete, map[string]any{
+			"uploadId":    "streamed",
+			"fileName":    "file.txt",
+			"totalChunks": len(chunks),
+			"email":       "jane@example.com",
+		})
+	}
+	postChunk(t, "streamed", "0", chunks[0])
+	if rec := complete(); rec.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("early complete: status %d, want 422: %s", rec.Code, rec.Body)
+	}
+	if rec := postChunk(t, "streamed", "1", chunks[1]); rec.Code != http.StatusOK {
+		t.Fatalf("remaining chunk: status %d: %s", rec.Code, rec.Body)
+	}
+	if rec := complete(); rec.Code != http.StatusOK {
+		t.Fatalf("complete: status %d: %s", rec.Code, rec.Body)
+	}
+	want := bytes.Join(chunks, nil)
+	if got, ok := mock.file("Uploads/jane_en_example_com/file.txt"); !ok || !bytes.Equal(got, want) {
+		t.Errorf("file.txt = %q, want %q", got, want)
+	}
+}
+
+func TestUploadCompleteEnforcesSizeLimitsByType(t *testing.T) {
+	mock := setupIntegration(t)
+	appConfig.SizeLimits = map[string]string{"txt": "10B", "image/": "1KB", "default": "1 KB"}
+	data := []byte("twenty bytes of text")
+
+	for _, tc := range []struct {
+		fileName string
+		status   int
+	}{
+		{"notes.txt", http.StatusRequestEntityTooLarge},
+		{"data.bin", http.StatusOK},
+	} {
+		postChunk(t, tc.fileName, "0", data)
+		rec := postJSON(t, handleUploadComplete, map[string]any{
+			"uploadId": tc.fileName,
+			"fileName": tc.fileName,
+			"email":    "jane@example.com",
+		})
+		if rec.Code != tc.status {
+			t.Fatalf("%s: status %d, want %d: %s", tc.fileName, rec.Code, tc.status, rec.Body)
+		}
+		if tc.status == http.StatusRequestEntityTooLarge && !strings.Contains(rec.Body.String(), "txt files is 10B") {
+			t.Errorf("%s: error does not name the limit: %s", tc.fileName, rec.Body)
+		}
+	}
+	if _, ok := mock.file("Uploads/jane_en_example_com/notes.txt"); ok {
+		t.Error("file over its type's limit was uploaded")
+	}
+}
+
+func TestUploadSessionWithoutDescription(t *testing.T) {
+	mock := setupIntegration(t)
+	appConfig.WriteDescription = false
+
+	postJSON(t, handleUploadSession, map[string]any{
+		"sessionId":  "session-1",
+		"email":      "jane@example.com",
+		"totalFiles": 2,
+	})
+	for _, name := range []string{"a.txt", "b.txt"} {
+		postChunk(t, name, "0", []byte(name))
+		rec := postJSON(t, handleUploadComplete, map[string]any{
+			"uploadId":  name,
+			"fileName":  name,
+			"email":     "jane@example.com",
+			"sessionId": "session-1",
+		})
+		if rec.Code != http.StatusOK {
+			t.Fatalf("%s complete: status %d: %s", name, rec.Code, rec.Body)
+		}
+	}
+
+	if _, ok := mock.file("Uploads/jane_en_example_com/" + appConfig.DescriptionFilename); ok {
+		t.Error("description file was written with WRITE_DESCRIPTION=false")
+	}
+	if _, err := sessionStore.Get(context.Background(), "session-1"); !errors.Is(err, errSessionNotFound) {
+		t.Errorf("completed session was not removed: %v", err)
+	}
+}
+
+func TestWithGzipCompressesLargeResponses(t *testing.T) {
+	setupIntegration(t)
+	appConfig.CompressMinBytes = 100
+	large := strings.Repeat(`{"name":"folder"},`, 50)
+	handler := withGzip(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, r.URL.Query().Get("prefix"))
+		if r.URL.Query().Has("large") {
+			fmt.Fprint(w, large)
+		}
+	})
+
+	req := httptest.NewRequest(http.MethodGet, "/submissions?large&prefix=[", nil)
+	req.Header.Set("Accept-Encoding", "gzip, deflate")
+	rec := httptest.NewRecorder()
+	handler(rec, req)
+	if rec.Header().Get("Content-Encoding") != "gzip" {
+		t.Fatalf("large response not compressed, headers %v", rec.Header())
+	}
+	reader, err := gzip.NewReader(rec.Body)
+	if err != nil {
+		t.Fatalf("invalid gzip body: %v", err)
+	}
+	body, _ := io.ReadAll(reader)
+	if string(body) != "["+large {
+		t.Errorf("decompressed body = %q", body)
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/submissions?prefix=[]", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	rec = httptest.NewRecorder()
+	handler(rec, req)
+	if rec.Header().Get("Content-Encoding") != "" || rec.Body.String() != "[]" {
+		t.Errorf("small response: encoding %q, body %q", rec.Header().Get("Content-Encoding"), rec.Body)
+	}
+}
+
+func TestSubmissionsFindsCategorizedAndHashedFolders(t *testing.T) {
+	setupIntegration(t)
+	appConfig.HashFolderIdentifiers, appConfig.FolderIdentifierSalt = true, "pepper"
+	appConfig.DataOriginCategories = map[string]string{"research": "Research"}
+
+	for _, upload := range []struct{ id, email, dataOrigin string }{
+		{"research", "jane@example.com", "Research"},
+		{"plain", "jane@example.com", ""},
+		{"other", "john@example.com", "Research"},
+	} {
+		postChunk(t, upload.id, "0", []byte("data"))
+		rec := postJSON(t, handleUploadComplete, map[string]any{
+			"uploadId":   upload.id,
+			"fileName":   "file.txt",
+			"email":      upload.email,
+			"dataOrigin": upload.dataOrigin,
+		})
+		if rec.Code != http.StatusOK {
+			t.Fatalf("complete %s: status %d: %s", upload.id, rec.Code, rec.Body)
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	handleSubmissions(rec, httptest.NewRequest(http.MethodGet, "/submissions?email=jane@example.com", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("submissions: status %d: %s", rec.Code, rec.Body)
+	}
+	var response struct {
+		Submissions []FolderInfo `json:"submissions"`
+	}
+	json.Unmarshal(rec.Body.Bytes(), &response)
+	hashed := folderIdentifier(sanitizeEmailForFolder("jane@example.com"))
+	var names []string
+	for _, submission := range response.Submissions {
+		names = append(names, submission.Name)
+	}
+	sort.Strings(names)
+	if got, want := strings.Join(names, " "), "Research/"+hashed+" "+hashed; got != want {
+		t.Errorf("submissions = %s, want %s", got, want)
+	}
+}
+
+func TestAllowedDataOrigins(t *testing.T) {
+	mock := setupIntegration(t)
+	appConfig.AllowedDataOrigins = []string{"Research", "Field work"}
+
+	rec := postJSON(t, handleUploadSession, map[string]any{
+		"sessionId":  "session-1",
+		"email":      "jane@example.com",
+		"dataOrigin": "Reserch",
+		"totalFiles": 1,
+	})
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("session with unknown dataOrigin: status %d, want 400: %s", rec.Code, rec.Body)
+	}
+
+	postChunk(t, "typo", "0", []byte("file contents"))
+	rec = postJSON(t, handleUploadComplete, map[string]any{
+		"uploadId":   "typo",
+		"fileName":   "file.txt",
+		"email":      "jane@example.com",
+		"dataOrigin": "Reserch",
+	})
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("complete with unknown dataOrigin: status %d, want 400: %s", rec.Code, rec.Body)
+	}
+	if _, ok := mock.file("Uploads/jane_en_example_com/file.txt"); ok {
+		t.Error("file with unknown dataOrigin was uploaded")
+	}
+
+	postChunk(t, "known", "0", []byte("file contents"))
+	rec = postJSON(t, handleUploadComplete, map[string]any{
+		"uploadId":   "known",
+		"fileName":   "file.txt",
+		"email":      "jane@example.com",
+		"dataOrigin": "field work",
+	})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("complete with allowed dataOrigin: status %d: %s", rec.Code, rec.Body)
+	}
+}
+
+func TestReplicateToMirrorsUploads(t *testing.T) {
+	mock := setupIntegration(t)
+	appConfig.UploadTempDir = t.TempDir()
+	backup := &mockWebDAV{folders: make(map[string]bool), files: make(map[string][]byte)}
+	server := httptest.NewServer(backup)
+	t.Cleanup(server.Close)
+	backupClient := newNextcloudClient(appConfig)
+	backupClient.BaseURL, backupClient.HTTPClient = server.URL, server.Client()
+	nextcloudTargets = map[string]*NextcloudClient{"backup": backupClient}
+	t.Cleanup(func() { replicaSet = nil })
+
+	complete := func(uploadID, fileName string) *httptest.ResponseRecorder {
+		postChunk(t, uploadID, "0", []byte("file contents"))
+		return postJSON(t, handleUploadComplete, map[string]any{
+			"uploadId": uploadID,
+			"fileName": fileName,
+			"email":    "jane@example.com",
+		})
+	}
+
+	replicaSet = newReplicatedBackend(nextcloud, []string{"backup"}, nextcloudTargets, quorumAll)
+	rec := complete("mirrored", "file.txt")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("complete: status %d: %s", rec.Code, rec.Body)
+	}
+	for name, server := range map[string]*mockWebDAV{"default": mock, "backup": backup} {
+		if got, ok := server.file("Uploads/jane_en_example_com/file.txt"); !ok || string(got) != "file contents" {
+			t.Errorf("%s replica has %q", name, got)
+		}
+	}
+
+	// A failing replica only fails the upload if the quorum needs it
+	backup.failPut = map[string]bool{"Uploads/jane_en_example_com/broken.txt": true}
+	if rec := complete("all-quorum", "broken.txt"); rec.Code != http.StatusInternalServerError {
+		t.Fatalf("quorum all: status %d, want 500: %s", rec.Code, rec.Body)
+	}
+	if _, ok := mock.file("Uploads/jane_en_example_com/broken.txt"); ok {
+		t.Error("file was kept on the replica that stored it although the quorum was missed")
+	}
+	replicaSet = newReplicatedBackend(nextcloud, []string{"backup"}, nextcloudTargets, quorumAny)
+	rec = complete("any-quorum", "broken.txt")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("quorum any: status %d: %s", rec.Code, rec.Body)
+	}
+	var response map[string]string
+	json.Unmarshal(rec.Body.Bytes(), &response)
+	if response["replicatedTo"] != "default" || response["replicationFailed"] != "backup" {
+		t.Errorf("response = %v, want backup reported as failed", response)
+	}
+}
+
+func TestUploadCompleteAsksForRetryWhileBreakerOpen(t *testing.T) {
+	setupIntegration(t)
+	appConfig.UploadTempDir = t.TempDir()
+	// The pre-check only sees the default account, the backup's breaker opens behind it
+	backupClient := newNextcloudClient(appConfig)
+	backupClient.Breaker = newCircuitBreaker(1, time.Minute)
+	backupClient.Breaker.record(false)
+	nextcloudTargets = map[string]*NextcloudClient{"backup": backupClient}
+	replicaSet = newReplicatedBackend(nextcloud, []string{"backup"}, nextcloudTargets, quorumAll)
+	t.Cleanup(func() { replicaSet = nil })
+
+	postChunk(t, "tripped", "0", []byte("data"))
+	rec := postJSON(t, handleUploadComplete, map[string]any{
+		"uploadId": "tripped",
+		"fileName": "file.txt",
+		"email":    "jane@example.com",
+	})
+	if rec.Code != http.StatusServiceUnavailable || rec.Header().Get("Retry-After") == "" {
+		t.Fatalf("status %d, Retry-After %q, want 503 with Retry-After: %s", rec.Code, rec.Header().Get("Retry-After"), rec.Body)
+	}
+}
+
+func TestUploadCompleteKeepsChunksWhenAskingForRetry(t *testing.T) {
+	mock := setupIntegration(t)
+	nextcloud.Breaker = newCircuitBreaker(1, time.Minute)
+	nextcloud.Breaker.record(false)
+
+	postChunk(t, "retried", "0", []byte("data"))
+	complete := func() *httptest.ResponseRecorder {
+		return postJSON(t, handleUploadComplete, map[string]any{
+			"uploadId": "retried",
+			"fileName": "file.txt",
+			"email":    "jane@example.com",
+		})
+	}
+	if rec := complete(); rec.Code != http.StatusServiceUnavailable {
+		t.Fatalf("breaker open: status %d, want 503: %s", rec.Code, rec.Body)
+	}
+	if _, err := chunkStore.ListChunks("retried"); err != nil {
+		t.Fatalf("chunks were removed although the client was asked to retry: %v", err)
+	}
+
+	nextcloud.Breaker = nil
+	if rec := complete(); rec.Code != http.StatusOK {
+		t.Fatalf("retry: status %d: %s", rec.Code, rec.Body)
+	}
+	if data, _ := mock.file("Uploads/jane_en_example_com/file.txt"); string(data) != "data" {
+		t.Errorf("file.txt = %q, want %q", data, "data")
+	}
+	if _, err := chunkStore.ListChunks("retried"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("chunks were kept after success: %v", err)
+	}
+}
+
+func TestUploadCompleteResumesTransferOnRetry(t *testing.T) {
+	mock := setupIntegration(t)
+	appConfig.ResumeAttempts = 1
+	nextcloud.Chunked, nextcloud.ResumeAttempts = true, 1
+	// Timestamped folder names give the retry a different folder
+	folderNameTemplate = nil
+
+	var mu sync.Mutex
+	puts := make(map[string]int)
+	mock.onPut = func(r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		puts[path.Base(r.URL.Path)]++
+	}
+	transfer := strings.TrimPrefix(nextcloud.resumableTransferURL("resumed", "file.bin"), appConfig.NextcloudURL)
+	mock.failPut = map[string]bool{transfer + "/000002": true}
+
+	postChunk(t, "resumed", "0", bytes.Repeat([]byte("x"), nextcloudChunkSize))
+	postChunk(t, "resumed", "1", []byte("tail"))
+	complete := func() *httptest.ResponseRecorder {
+		return postJSON(t, handleUploadComplete, map[string]any{
+			"uploadId": "resumed",
+			"fileName": "file.bin",
+			"email":    "jane@example.com",
+		})
+	}
+	if rec := complete(); rec.Code != http.StatusInternalServerError {
+		t.Fatalf("first attempt: status %d, want 500: %s", rec.Code, rec.Body)
+	}
+
+	time.Sleep(time.Until(time.Now().Truncate(time.Second).Add(time.Second)))
+	mock.mu.Lock()
+	mock.failPut = nil
+	mock.mu.Unlock()
+	if rec := complete(); rec.Code != http.StatusOK {
+		t.Fatalf("retry: status %d: %s", rec.Code, rec.Body)
+	}
+	if puts["000001"] != 1 {
+		t.Errorf("first chunk was sent %d times, want once", puts["000001"])
+	}
+	var stored []byte
+	for name, data := range mock.files {
+		if strings.HasSuffix(name, "/file.bin") {
+			stored = data
+		}
+	}
+	if len(stored) != nextcloudChunkSize+4 {
+		t.Errorf("file.bin has %d bytes, want %d", len(stored), nextcloudChunkSize+4)
+	}
+}
+
+func TestUploadCompleteRejectsChunkGaps(t *testing.T) {
+	mock := setupIntegration(t)
+
+	for _, index := range []string{"0", "2", "5"} {
+		postChunk(t, "gappy", index, []byte(index))
+	}
+	complete := func() *httptest.ResponseRecorder {
+		return postJSON(t, handleUploadComplete, map[string]any{
+			"uploadId": "gappy",
+			"fileName": "file.txt",
+			"email":    "jane@example.com",
+		})
+	}
+	rec := complete()
+	if rec.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("status %d, want 422: %s", rec.Code, rec.Body)
+	}
+	if !strings.Contains(rec.Body.String(), "missing chunks 1, 3, 4.") {
+		t.Errorf("error does not list the missing chunks: %s", rec.Body)
+	}
+	if _, ok := mock.file("Uploads/jane_en_example_com/file.txt"); ok {
+		t.Error("file with missing chunks was uploaded")
+	}
+
+	// The chunks that arrived are kept, so sending the missing ones is enough
+	for _, index := range []string{"1", "3", "4"} {
+		postChunk(t, "gappy", index, []byte(index))
+	}
+	if rec := complete(); rec.Code != http.StatusOK {
+		t.Fatalf("after filling the gaps: status %d: %s", rec.Code, rec.Body)
+	}
+	if data, _ := mock.file("Uploads/jane_en_example_com/file.txt"); string(data) != "012345" {
+		t.Errorf("file.txt = %q, want %q", data, "012345")
+	}
+}
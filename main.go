@@ -2,33 +2,161 @@ package main
 
 import (
 	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"embed"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"hash"
 	"io"
-	"log"
+	"io/fs"
+	"log/slog"
+	"math"
+	"net"
 	"net/http"
+	"net/mail"
 	"net/url"
 	"os"
+	"path"
 	"path/filepath"
+	"slices"
 	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"text/template"
 	"time"
+	"unicode/utf8"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
 // Config holds the application configuration.
+// The yaml tags name the keys accepted in the optional configuration file.
 type Config struct {
-	NextcloudURL       string
-	NextcloudUser      string
-	NextcloudAppPass   string
-	NextcloudUploadDir string
-	UploadTempDir      string // Directory for temporary chunk storage
+	NextcloudURL            string                     `yaml:"url"`
+	NextcloudUser           string                     `yaml:"user"`
+	NextcloudAppPass        string                     `yaml:"app_password"`
+	NextcloudAuthMode       string                     `yaml:"auth_mode"`    // "basic" (default) or "bearer"
+	NextcloudBearerToken    string                     `yaml:"bearer_token"` // Static token for bearer auth
+	NextcloudTokenURL       string                     `yaml:"token_url"`    // OAuth2 token endpoint for bearer auth, replaces the static token
+	NextcloudClientID       string                     `yaml:"client_id"`    // OAuth2 client for the token endpoint
+	NextcloudClientSecret   string                     `yaml:"client_secret"`
+	NextcloudUploadDir      string                     `yaml:"folder"`
+	UploadTempDir           string                     `yaml:"temp_dir"`              // Directory for temporary chunk storage
+	MaxUploadBytes          int64                      `yaml:"max_upload_bytes"`      // Maximum assembled file size in bytes, 0 means unlimited
+	SessionTTL              time.Duration              `yaml:"session_ttl"`           // Age after which unfinished sessions and chunks are discarded
+	ChunkedUpload           bool                       `yaml:"chunked_upload"`        // Use the Nextcloud chunked upload API instead of a single PUT
+	ClamAVAddr              string                     `yaml:"clamav_addr"`           // clamd address (host:port or unix:/path) to scan uploads, empty disables scanning
+	AllowedExtensions       []string                   `yaml:"allowed_extensions"`    // Accepted file extensions without the dot, empty allows all
+	AllowedMIMETypes        []string                   `yaml:"allowed_content_types"` // Accepted sniffed content types or prefixes like "image/", empty allows all
+	RateLimitRPS            float64                    `yaml:"rate_limit_rps"`        // Requests per second allowed per client IP on upload endpoints, 0 disables limiting
+	RateLimitBurst          int                        `yaml:"rate_limit_burst"`      // Burst size of the per-IP rate limiter
+	TrustProxy              bool                       `yaml:"trust_proxy"`           // Trust X-Forwarded-* headers set by a reverse proxy
+	CreateShare             bool                       `yaml:"create_share"`          // Create a public share link for each upload folder
+	SMTPHost                string                     `yaml:"smtp_host"`             // SMTP server for session notifications, empty disables email
+	SMTPPort                int                        `yaml:"smtp_port"`
+	SMTPUser                string                     `yaml:"smtp_user"`
+	SMTPPass                string                     `yaml:"smtp_pass"`
+	SMTPFrom                string                     `yaml:"smtp_from"`              // Sender address, defaults to SMTPUser
+	NotifyTo                []string                   `yaml:"notify_to"`              // Recipients of session notifications
+	WebhookURL              string                     `yaml:"webhook_url"`            // URL notified with a JSON POST after every successful upload
+	WebhookSecret           string                     `yaml:"webhook_secret"`         // Shared secret used to sign webhook payloads
+	SessionStore            string                     `yaml:"session_store"`          // Session store backend: "memory" (default) or "redis"
+	RedisAddr               string                     `yaml:"redis_addr"`             // Redis address (host:port) for the redis session store
+	MaxConcurrentUploads    int                        `yaml:"max_concurrent_uploads"` // Maximum simultaneous uploads to Nextcloud, 0 means unlimited
+	UploadQueueTimeout      time.Duration              `yaml:"upload_queue_timeout"`   // How long an upload waits for a free slot before failing with 503
+	AllowedOrigins          []string                   `yaml:"allowed_origins"`        // Origins allowed to call the upload API cross-origin, "*" allows any
+	ListenAddr              string                     `yaml:"listen_addr"`            // Address the HTTP server binds to, e.g. ":8080" or "127.0.0.1:9000"
+	TLSCertFile             string                     `yaml:"tls_cert_file"`          // Certificate for serving HTTPS directly, requires TLSKeyFile
+	TLSKeyFile              string                     `yaml:"tls_key_file"`
+	HTTPSRedirectPort       string                     `yaml:"https_redirect_port"`       // Port of an optional plain HTTP listener redirecting to HTTPS
+	FolderNameTemplate      string                     `yaml:"folder_name_template"`      // text/template for folder names, empty keeps "timestamp-email-phone"
+	DescriptionFilename     string                     `yaml:"description_filename"`      // Name of the metadata text file written to each folder
+	DescriptionTemplateFile string                     `yaml:"description_template_file"` // Optional text/template file overriding the description content
+	DedupFilenames          bool                       `yaml:"dedup_filenames"`           // Same as ON_CONFLICT=rename when on_conflict is not set
+	RequireEmail            bool                       `yaml:"require_email"`             // Reject sessions without an email address
+	RequirePhone            bool                       `yaml:"require_phone"`             // Reject sessions without a phone number
+	DryRun                  bool                       `yaml:"dry_run"`                   // Log Nextcloud operations instead of performing them
+	ChunkSize               int64                      `yaml:"chunk_size"`                // Maximum size in bytes of a single uploaded chunk
+	MaxChunksPerUpload      int                        `yaml:"max_chunks_per_upload"`     // Maximum number of chunks stored for one upload, 0 means unlimited
+	MinFreeDiskBytes        int64                      `yaml:"min_free_disk_bytes"`       // Reject new chunks when free space in the temp directory drops below this, 0 disables the check
+	MaxJSONBodyBytes        int64                      `yaml:"max_json_body_bytes"`       // Maximum size in bytes of JSON request bodies
+	MultipartMemory         int64                      `yaml:"multipart_memory"`          // Bytes of a chunk request buffered in memory before spilling to a temp file
+	AdminToken              string                     `yaml:"admin_token"`               // Bearer token for the admin endpoints, empty disables them
+	CleanupOnStart          bool                       `yaml:"cleanup_on_start"`          // Remove orphaned chunk directories from the temp directory at startup
+	OrphanCleanupAge        time.Duration              `yaml:"orphan_cleanup_age"`        // Minimum age of chunk directories removed at startup
+	DataOriginCategories    map[string]string          `yaml:"data_origin_categories"`    // Maps dataOrigin values (case-insensitive) to a category folder created under the upload folder
+	MkcolTimeout            time.Duration              `yaml:"mkcol_timeout"`             // Timeout for Nextcloud MKCOL requests
+	UploadTimeout           time.Duration              `yaml:"upload_timeout"`            // Timeout for Nextcloud file uploads, including chunk assembly
+	HeadTimeout             time.Duration              `yaml:"head_timeout"`              // Timeout for Nextcloud file existence checks
+	UploadToken             string                     `yaml:"upload_token"`              // Token required to upload, empty keeps the upload API public
+	Targets                 map[string]NextcloudTarget `yaml:"targets"`                   // Additional named Nextcloud accounts a session can select, config file only
+	MaxFilesPerSession      int                        `yaml:"max_files_per_session"`     // Maximum number of files a session can declare, 0 means unlimited
+	SetProperties           bool                       `yaml:"set_properties"`            // Store email, phone and data origin as WebDAV properties on each uploaded file
+	ResumeAttempts          int                        `yaml:"resume_attempts"`           // Times a failed chunk is resumed before the upload fails, enables the chunked upload API and resuming failed uploads
+	MaxActiveSessions       int                        `yaml:"max_active_sessions"`       // Maximum number of sessions registered at once, 0 means unlimited
+	GenerateThumbnails      bool                       `yaml:"generate_thumbnails"`       // Upload a downscaled thumb_<name> copy next to each JPEG or PNG image
+	ThumbnailMaxPixels      int64                      `yaml:"thumbnail_max_pixels"`      // Images with more pixels get no thumbnail, 0 means unlimited
+	ChunkWaitAttempts       int                        `yaml:"chunk_wait_attempts"`       // Times /upload-complete re-checks for chunks still in flight before failing
+	ChunkWaitInterval       time.Duration              `yaml:"chunk_wait_interval"`       // Pause between those checks
+	Backend                 string                     `yaml:"backend"`                   // Where uploads are stored: "nextcloud" (default) or "s3"
+	S3Bucket                string                     `yaml:"s3_bucket"`                 // Bucket receiving uploads with the s3 backend
+	S3Endpoint              string                     `yaml:"s3_endpoint"`               // Endpoint URL for S3-compatible servers like MinIO, empty for AWS
+	S3Region                string                     `yaml:"s3_region"`                 // Region of the bucket, empty to use the AWS default
+	S3AccessKeyID           string                     `yaml:"s3_access_key_id"`          // Empty to use the default AWS credential chain
+	S3SecretAccessKey       string                     `yaml:"s3_secret_access_key"`      // Secret for S3_ACCESS_KEY_ID
+	S3Prefix                string                     `yaml:"s3_prefix"`                 // Key prefix for upload folders
+	S3ForcePathStyle        bool                       `yaml:"s3_force_path_style"`       // Address the bucket in the path instead of the host name
+	AuditLogFile            string                     `yaml:"audit_log_file"`            // Append a JSON line per /upload-complete attempt to this file
+	FilenameUnsafeChars     string                     `yaml:"filename_unsafe_chars"`     // Characters replaced in uploaded file names
+	FilenameReplacement     string                     `yaml:"filename_replacement"`      // Replacement for each unsafe character, empty to strip them
+	MaxFilenameLength       int                        `yaml:"max_filename_length"`       // Maximum file name length in bytes, the extension is kept when shortening
+	OnConflict              string                     `yaml:"on_conflict"`               // What to do when the file already exists: overwrite, skip or rename
+	BreakerThreshold        int                        `yaml:"breaker_threshold"`         // Consecutive Nextcloud failures that open the circuit breaker, 0 disables it
+	BreakerCooldown         time.Duration              `yaml:"breaker_cooldown"`          // How long the open breaker refuses requests before a trial request
+	HashClientIP            bool                       `yaml:"hash_client_ip"`            // Log and audit a salted hash of client IPs instead of the addresses
+	ClientIPSalt            string                     `yaml:"client_ip_salt"`            // Salt for HASH_CLIENT_IP, random per process if empty
+	SessionMaxDuration      time.Duration              `yaml:"session_max_duration"`      // Time after registration when a session stops accepting chunks and completions, 0 for no limit
+	MetadataFormat          string                     `yaml:"metadata_format"`           // Format of the per-folder metadata: "text" (descripcion.txt, default) or "json" (metadata.json)
+	AllowEmptyFiles         bool                       `yaml:"allow_empty_files"`         // Upload zero-byte files instead of rejecting completions without data
+	FolderPerSession        bool                       `yaml:"folder_per_session"`        // Name the folder once when a session registers so all its files land together
+	AccessLog               bool                       `yaml:"access_log"`                // Log method, path, status, size and duration of every request
+	StaticDir               string                     `yaml:"static_dir"`                // Directory overriding the embedded form and its assets, empty serves the embedded copy
+	NextcloudHeaders        map[string]string          `yaml:"nc_headers"`                // Extra headers sent with every Nextcloud request, e.g. for an auth proxy
+	RequestTimeout          time.Duration              `yaml:"request_timeout"`           // Maximum lifetime of a request, including its Nextcloud calls, 0 means unlimited
+	RenameOnComplete        bool                       `yaml:"rename_on_complete"`        // Upload into a pending folder and rename it once all files and the description are in
+	PendingFolderPrefix     string                     `yaml:"pending_folder_prefix"`     // Prefix of folders still being written with RENAME_ON_COMPLETE
+	CompleteFolderPrefix    string                     `yaml:"complete_folder_prefix"`    // Prefix replacing the pending prefix once the folder is complete
+	HashFolderIdentifiers   bool                       `yaml:"hash_folder_identifiers"`   // Put a salted hash of the email and phone into folder names instead of the values
+	FolderIdentifierSalt    string                     `yaml:"folder_identifier_salt"`    // Secret salt for HASH_FOLDER_IDENTIFIERS
+	MaxConcurrentChunks     int                        `yaml:"max_concurrent_chunks"`     // Maximum number of chunks or ranges of one upload written at the same time, 0 means unlimited
+	WriteManifest           bool                       `yaml:"write_manifest"`            // Write manifest.json with the size and SHA-256 of every file once a session completes
+	SuccessRedirectURL      string                     `yaml:"success_redirect_url"`      // Where browsers asking for HTML are sent with 303 after a successful upload
+	StreamChunks            bool                       `yaml:"stream_chunks"`             // Forward chunks to a Nextcloud chunked upload as they arrive instead of storing them, requires in-order chunks
+	SizeLimits              map[string]string          `yaml:"size_limits"`               // Maximum sizes like "10MB" by extension, content type, content type family ("video/") or "default"
+	WriteDescription        bool                       `yaml:"write_description"`         // Write the description file (or metadata.json) into each folder
+	CompressMinBytes        int                        `yaml:"compress_min_bytes"`        // Gzip status and listing responses of at least this size for clients accepting it, 0 disables
+	AllowedDataOrigins      []string                   `yaml:"allowed_data_origins"`      // Accepted dataOrigin values (case-insensitive), empty allows any
+	ReplicateTo             []string                   `yaml:"replicate_to"`              // Targets every upload to the default account is mirrored to; Nextcloud-only features like shares are then skipped
+	ReplicationQuorum       string                     `yaml:"replication_quorum"`        // How many replicas must succeed: "all" (default), "majority" or "any"
 }
 
+// nextcloudChunkSize is the size of each chunk sent with the Nextcloud chunked upload API
+const nextcloudChunkSize = 10 << 20
+
 // Global config variable
 var appConfig Config
 
+// uploadSlots limits concurrent Nextcloud uploads, nil means unlimited
+var uploadSlots chan struct{}
+
 // Upload session tracking
 type UploadSession struct {
 	Email          string
@@ -36,12 +164,29 @@ type UploadSession struct {
 	DataOrigin     string
 	UploadCount    int
 	CompletedCount int
+	CreatedAt      time.Time
+	Target         string        // Name of the Nextcloud target, "" for the default account
+	Deadline       time.Time     // Uploads of the session are refused after this, zero for no deadline
+	Files          []SessionFile // Completed files in completion order
+	FolderName     string        // Folder for all files of the session with FOLDER_PER_SESSION, "" to name it per file
 	Mutex          sync.RWMutex
 }
 
-// Global map to track upload sessions
-var uploadSessions = make(map[string]*UploadSession)
-var sessionsMutex sync.RWMutex
+// SessionFile describes a completed file for metadata.json
+type SessionFile struct {
+	FileName         string `json:"fileName"`         // Name as stored, after sanitizing and renaming
+	OriginalFileName string `json:"originalFileName"` // Name as sent by the client
+	Size             int64  `json:"size"`
+	SHA256           string `json:"sha256,omitempty"` // Empty when the upload was skipped
+}
+
+// NextcloudTarget is a named Nextcloud account uploads can be routed to instead of the default one
+type NextcloudTarget struct {
+	URL         string `yaml:"url"`
+	User        string `yaml:"user"`
+	AppPassword string `yaml:"app_password"`
+	Folder      string `yaml:"folder"`
+}
 
 // Struct for the /upload-complete request body
 type CompleteRequest struct {
@@ -52,6 +197,23 @@ type CompleteRequest struct {
 	DataOrigin string `json:"dataOrigin"`
 	SessionID  string `json:"sessionId"`
 	TotalFiles int    `json:"totalFiles"`
+	TotalSize  int64  `json:"totalSize"`
+	// TotalChunks is the optional number of chunks the client sent, waited for before assembling
+	TotalChunks int `json:"totalChunks"`
+	// Redirect asks for a 303 to SUCCESS_REDIRECT_URL instead of the JSON
+	// response, like an Accept header listing text/html does
+	Redirect bool `json:"redirect"`
+	// FileHash is the optional hex SHA-256 of the whole file, checked against what was sent to Nextcloud
+	FileHash string `json:"fileHash"`
+	// RelativePath is the file's path inside a dropped folder (e.g. webkitRelativePath).
+	// Only its directory part is used, to recreate the subfolders in Nextcloud.
+	RelativePath string `json:"relativePath"`
+}
+
+// Struct for the /upload-cancel request body
+type CancelRequest struct {
+	UploadID  string `json:"uploadId"`
+	SessionID string `json:"sessionId"`
 }
 
 // Struct for the /upload-session request body
@@ -61,73 +223,328 @@ type SessionRequest struct {
 	Phone      string `json:"phone"`
 	DataOrigin string `json:"dataOrigin"`
 	TotalFiles int    `json:"totalFiles"`
+	Target     string `json:"target"`
 }
 
 func main() {
-	// Load configuration from environment variables
-	// TODO: Evaluate a possible configuration file
-	appConfig = Config{
-		NextcloudURL:       getEnv("NC_URL", ""),
-		NextcloudUser:      getEnv("NC_USER", ""),
-		NextcloudAppPass:   getEnv("NC_APP_PASSWORD", ""),
-		NextcloudUploadDir: getEnv("NC_FOLDER", ""),
-		UploadTempDir:      getEnv("UPLOAD_TEMP_DIR", "/tmp/nextcloud-public-uploader/"),
-	}
+	setupLogging()
 
-	if appConfig.NextcloudURL == "" || appConfig.NextcloudUser == "" || appConfig.NextcloudAppPass == "" {
-		log.Fatal("FATAL: Environment variables NC_URL, NC_USER, and NC_APP_PASSWORD must be set.")
+	// Load configuration from the optional config file and environment variables
+	var err error
+	appConfig, err = loadConfig()
+	if err != nil {
+		fatal("Invalid configuration", "error", err)
 	}
-	appConfig.NextcloudURL = strings.TrimSuffix(appConfig.NextcloudURL, "/")
 
 	// Create the temporary upload directory if it doesn't exist
 	if err := os.MkdirAll(appConfig.UploadTempDir, os.ModePerm); err != nil {
-		log.Fatalf("FATAL: Could not create temporary upload directory: %v", err)
+		fatal("Could not create temporary upload directory", "dir", appConfig.UploadTempDir, "error", err)
+	}
+	chunkStore = newFSChunkStore(appConfig.UploadTempDir)
+	// Chunks left behind by a crash are never completed, so reclaim their space
+	if appConfig.CleanupOnStart {
+		removed := removeStaleChunkDirs(time.Now().Add(-appConfig.OrphanCleanupAge))
+		slog.Info("Cleaned up orphaned chunk directories", "removed", removed, "minAge", appConfig.OrphanCleanupAge)
+	}
+	nextcloud = newNextcloudClient(appConfig)
+	nextcloudTargets = newNextcloudTargets(appConfig)
+	if len(appConfig.ReplicateTo) > 0 {
+		replicaSet = newReplicatedBackend(nextcloud, appConfig.ReplicateTo, nextcloudTargets, appConfig.ReplicationQuorum)
+	}
+	if appConfig.Backend == "s3" {
+		if s3Backend, err = newS3Backend(appConfig); err != nil {
+			fatal("Could not create S3 backend", "error", err)
+		}
+	}
+	if appConfig.AuditLogFile != "" {
+		if auditLog, err = openAuditLog(appConfig.AuditLogFile); err != nil {
+			fatal("Could not open audit log", "error", err)
+		}
 	}
+	if appConfig.DescriptionTemplateFile != "" {
+		if descriptionTemplate, err = template.ParseFiles(appConfig.DescriptionTemplateFile); err != nil {
+			fatal("Invalid DESCRIPTION_TEMPLATE_FILE", "error", err)
+		}
+	}
+	if appConfig.FolderNameTemplate != "" {
+		if folderNameTemplate, err = parseFolderNameTemplate(appConfig.FolderNameTemplate); err != nil {
+			fatal("Invalid FOLDER_NAME_TEMPLATE", "error", err)
+		}
+	}
+	if appConfig.MaxConcurrentUploads > 0 {
+		uploadSlots = make(chan struct{}, appConfig.MaxConcurrentUploads)
+	}
+	if sessionStore, err = newSessionStore(appConfig); err != nil {
+		fatal("Could not create session store", "error", err)
+	}
+
+	go sweepStaleSessions(appConfig.SessionTTL)
+	go reloadCredentialsOnSIGHUP()
+
+	if appConfig.DryRun {
+		slog.Warn("DRY RUN mode enabled, nothing will be uploaded to Nextcloud")
+	}
+	slog.Info("Server starting...",
+		"version", version,
+		"commit", commit,
+		"tempDir", appConfig.UploadTempDir,
+		"nextcloudURL", appConfig.NextcloudURL,
+	)
 
-	log.Printf("Server starting...")
-	log.Printf("Temporary chunk directory: %s", appConfig.UploadTempDir)
-	log.Printf("Uploading to Nextcloud instance at: %s", appConfig.NextcloudURL)
+	var limiter *ipRateLimiter
+	if appConfig.RateLimitRPS > 0 {
+		limiter = newIPRateLimiter(appConfig.RateLimitRPS, appConfig.RateLimitBurst, 10*time.Minute)
+	}
 
 	http.HandleFunc("/", serveForm)
-	http.HandleFunc("/upload-session", handleUploadSession)
-	http.HandleFunc("/upload-chunk", handleUploadChunk)
-	http.HandleFunc("/upload-complete", handleUploadComplete)
+	http.HandleFunc("/upload-session", withCORS(rateLimited(limiter, handleUploadSession)))
+	http.HandleFunc("/upload-chunk", withCORS(rateLimited(limiter, handleUploadChunk)))
+	http.HandleFunc("/upload-range", withCORS(rateLimited(limiter, handleUploadRange)))
+	http.HandleFunc(tusBasePath, withCORS(rateLimited(limiter, handleTus)))
+	http.HandleFunc("/upload-complete", withCORS(rateLimited(limiter, handleUploadComplete)))
+	http.HandleFunc("/upload-cancel", withCORS(withAdminAuth(handleUploadCancel)))
+	http.HandleFunc("/upload-status", withCORS(withAdminAuth(withGzip(handleUploadStatus))))
+	http.HandleFunc("/upload-chunk-status", withCORS(withGzip(handleUploadChunkStatus)))
+	http.HandleFunc("/healthz", handleHealth)
+	http.HandleFunc("/version", handleVersion)
+	http.HandleFunc("/submissions", withAdminAuth(withGzip(handleSubmissions)))
+	http.Handle("/metrics", promhttp.Handler())
+
+	// Bind explicitly so an unusable address is reported before serving starts
+	listener, err := net.Listen("tcp", appConfig.ListenAddr)
+	if err != nil {
+		fatal("Could not bind listen address", "addr", appConfig.ListenAddr, "error", err)
+	}
+	var handler http.Handler = http.DefaultServeMux
+	if appConfig.AccessLog {
+		handler = withAccessLog(handler)
+	}
+	if appConfig.RequestTimeout > 0 {
+		handler = withRequestTimeout(handler, appConfig.RequestTimeout)
+	}
+	server := &http.Server{
+		Handler: withRequestID(handler),
+		// Clients that never finish their headers would otherwise hold connections forever
+		ReadHeaderTimeout: 10 * time.Second,
+	}
 
-	port := ":8080"
-	log.Printf("Listening on http://localhost%s", port)
-	if err := http.ListenAndServe(port, nil); err != nil {
-		log.Fatalf("Could not start server: %s\n", err)
+	if appConfig.TLSCertFile == "" {
+		slog.Info("Listening on http://" + listener.Addr().String())
+		if err := server.Serve(listener); err != nil {
+			fatal("Could not start server", "error", err)
+		}
+		return
+	}
+
+	// Load the certificate up front so a bad cert/key fails at startup, not on the first handshake
+	certificate, err := tls.LoadX509KeyPair(appConfig.TLSCertFile, appConfig.TLSKeyFile)
+	if err != nil {
+		fatal("Could not load TLS certificate", "cert", appConfig.TLSCertFile, "key", appConfig.TLSKeyFile, "error", err)
+	}
+	server.TLSConfig = &tls.Config{Certificates: []tls.Certificate{certificate}}
+
+	if appConfig.HTTPSRedirectPort != "" {
+		_, httpsPort, _ := net.SplitHostPort(listener.Addr().String())
+		go serveHTTPSRedirect(":"+appConfig.HTTPSRedirectPort, httpsPort)
+	}
+
+	slog.Info("Listening on https://" + listener.Addr().String())
+	if err := server.ServeTLS(listener, "", ""); err != nil {
+		fatal("Could not start server", "error", err)
+	}
+}
+
+// serveHTTPSRedirect listens on addr and redirects every request to the HTTPS server on httpsPort
+func serveHTTPSRedirect(addr, httpsPort string) {
+	redirect := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(r.Host); err == nil {
+			host = h
+		}
+		if httpsPort != "443" {
+			host = net.JoinHostPort(host, httpsPort)
+		}
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusMovedPermanently)
+	})
+
+	slog.Info("Redirecting HTTP to HTTPS", "addr", addr)
+	if err := http.ListenAndServe(addr, redirect); err != nil {
+		fatal("Could not start HTTPS redirect listener", "addr", addr, "error", err)
 	}
 }
 
+// embeddedAssets is the frontend built into the binary, served unless STATIC_DIR is set
+//
+//go:embed index.html
+var embeddedAssets embed.FS
+
+// withRequestTimeout bounds every request to timeout. The request context gets
+// the deadline, so Nextcloud calls made with it are cancelled too, and reading
+// the body or writing the response fails past it, so a slow client cannot hold
+// a handler any longer.
+func withRequestTimeout(next http.Handler, timeout time.Duration) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := context.WithTimeout(r.Context(), timeout)
+		defer cancel()
+		deadline, _ := ctx.Deadline()
+		controller := http.NewResponseController(w)
+		controller.SetReadDeadline(deadline)
+		controller.SetWriteDeadline(deadline)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// missingFormPage is served instead of a bare 404 when STATIC_DIR has no
+// index.html, so a misconfigured deployment explains itself
+const missingFormPage = `<!DOCTYPE html>
+<html lang="en">
+<head><meta charset="utf-8"><title>Upload form unavailable</title></head>
+<body>
+<h1>Upload form unavailable</h1>
+<p>The upload service is running, but its form could not be found. Please contact the site administrator.</p>
+</body>
+</html>
+`
+
+// serveForm serves the frontend from STATIC_DIR, or the embedded copy when it
+// is unset. Paths that name no asset get index.html, as before assets existed.
 func serveForm(w http.ResponseWriter, r *http.Request) {
-	http.ServeFile(w, r, "index.html")
+	var assets fs.FS = embeddedAssets
+	if appConfig.StaticDir != "" {
+		assets = os.DirFS(appConfig.StaticDir)
+	}
+
+	// Hidden files are never served, so STATIC_DIR may double as a config directory
+	name := strings.TrimPrefix(path.Clean(r.URL.Path), "/")
+	if info, err := fs.Stat(assets, name); err != nil || info.IsDir() || strings.HasPrefix(path.Base(name), ".") {
+		name = "index.html"
+	}
+	if _, err := fs.Stat(assets, name); err != nil {
+		loggerFrom(r.Context()).Error("Upload form not found, check STATIC_DIR", "dir", appConfig.StaticDir, "error", err)
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprint(w, missingFormPage)
+		return
+	}
+	http.ServeFileFS(w, r, assets, name)
+}
+
+// handleHealth reports whether the server is alive and Nextcloud is reachable.
+// With ?shallow=true only the process itself is checked.
+func handleHealth(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Query().Get("shallow") != "true" {
+		if err := defaultBackend().CheckConnectivity(r.Context()); err != nil {
+			loggerFrom(r.Context()).Warn("Health check failed", "error", err)
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusServiceUnavailable)
+			json.NewEncoder(w).Encode(map[string]string{
+				"status": "unavailable",
+				"error":  err.Error(),
+			})
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
 }
 
-// handleUploadSession registers a new upload session
+// handleUploadSession registers a new upload session on POST and checks for one on GET
 func handleUploadSession(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodGet {
+		handleUploadSessionExists(w, r)
+		return
+	}
 	if r.Method != http.MethodPost {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
+	logger := loggerFrom(r.Context()).With("clientIp", loggedClientIP(r), "userAgent", r.UserAgent())
+	if !hasUploadToken(r) {
+		jsonErrorCode(w, errCodeUnauthorized, "Missing or invalid upload token.", http.StatusUnauthorized)
+		return
+	}
 
 	var reqData SessionRequest
-	if err := json.NewDecoder(r.Body).Decode(&reqData); err != nil {
-		http.Error(w, "Invalid JSON body.", http.StatusBadRequest)
+	if !decodeJSONBody(w, r, &reqData) {
+		return
+	}
+
+	if invalidFields := validateContactFields(reqData.Email, reqData.Phone); len(invalidFields) > 0 {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"error":  "Invalid contact details: " + strings.Join(invalidFields, ", ") + ".",
+			"fields": invalidFields,
+		})
+		return
+	}
+
+	if !isAllowedDataOrigin(reqData.DataOrigin) {
+		jsonErrorCode(w, errCodeInvalidInput, invalidDataOriginMessage(), http.StatusBadRequest)
+		return
+	}
+
+	if reqData.TotalFiles < 1 {
+		jsonError(w, "totalFiles must be at least 1.", http.StatusBadRequest)
+		return
+	}
+	if appConfig.MaxFilesPerSession > 0 && reqData.TotalFiles > appConfig.MaxFilesPerSession {
+		jsonError(w, fmt.Sprintf("Too many files: maximum is %d per session.", appConfig.MaxFilesPerSession), http.StatusBadRequest)
+		return
+	}
+
+	if reqData.Target != "" && nextcloudTargets[reqData.Target] == nil {
+		jsonError(w, fmt.Sprintf("Unknown target %q.", reqData.Target), http.StatusBadRequest)
+		return
+	}
+
+	if !hasFreeDiskSpace(r.Context()) {
+		jsonErrorCode(w, errCodeInsufficientStorage, "Insufficient storage, please retry later.", http.StatusInsufficientStorage)
 		return
 	}
 
-	sessionsMutex.Lock()
-	uploadSessions[reqData.SessionID] = &UploadSession{
+	// Bound the memory and temp space held by sessions; the TTL sweeper frees slots over time
+	if appConfig.MaxActiveSessions > 0 {
+		count, err := sessionStore.Count(r.Context())
+		if err != nil {
+			logger.Error("Could not count upload sessions", "error", err)
+			jsonError(w, "Could not register upload session.", http.StatusInternalServerError)
+			return
+		}
+		if count >= appConfig.MaxActiveSessions {
+			logger.Warn("Too many active sessions, rejecting session", "activeSessions", count, "maxSessions", appConfig.MaxActiveSessions)
+			w.Header().Set("Retry-After", "60")
+			jsonErrorCode(w, errCodeServerBusy, "Too many active upload sessions, please retry later.", http.StatusServiceUnavailable)
+			return
+		}
+	}
+
+	// The timestamp in the folder name is taken now, so later completions agree on it
+	var folderName string
+	if appConfig.FolderPerSession {
+		folderName = createFolderName(reqData.Email, reqData.Phone, reqData.DataOrigin)
+	}
+
+	err := sessionStore.Create(r.Context(), reqData.SessionID, &UploadSession{
 		Email:          reqData.Email,
 		Phone:          reqData.Phone,
 		DataOrigin:     reqData.DataOrigin,
 		UploadCount:    reqData.TotalFiles,
 		CompletedCount: 0,
+		CreatedAt:      time.Now(),
+		Target:         reqData.Target,
+		Deadline:       sessionDeadline(time.Now()),
+		FolderName:     folderName,
+	})
+	if err != nil {
+		logger.Error("Could not register upload session", "sessionId", reqData.SessionID, "error", err)
+		jsonError(w, "Could not register upload session.", http.StatusInternalServerError)
+		return
 	}
-	sessionsMutex.Unlock()
 
-	log.Printf("INFO: Registered upload session %s with %d files", reqData.SessionID, reqData.TotalFiles)
+	logger.Info("Registered upload session", "sessionId", reqData.SessionID, "totalFiles", reqData.TotalFiles)
 
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
@@ -137,278 +554,1476 @@ func handleUploadSession(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
-// handleUploadChunk receives and saves a single file chunk.
-func handleUploadChunk(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodPost {
+// handleUploadStatus reports the progress of a registered upload session
+func handleUploadStatus(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
 
-	// Max chunk size + metadata (e.g., 5MB + buffer)
-	if err := r.ParseMultipartForm(10 << 20); err != nil {
-		http.Error(w, "Could not parse form. Chunk might be too large.", http.StatusBadRequest)
+	sessionID := r.URL.Query().Get("sessionId")
+	if sessionID == "" {
+		jsonError(w, "Missing sessionId parameter.", http.StatusBadRequest)
 		return
 	}
 
-	file, _, err := r.FormFile("dataFile")
+	session, err := sessionStore.Get(r.Context(), sessionID)
+	if errors.Is(err, errSessionNotFound) {
+		jsonError(w, "Upload session not found.", http.StatusNotFound)
+		return
+	}
 	if err != nil {
-		http.Error(w, "Invalid file chunk key.", http.StatusBadRequest)
+		loggerFrom(r.Context()).Error("Could not read upload session", "sessionId", sessionID, "error", err)
+		jsonError(w, "Could not read upload session.", http.StatusInternalServerError)
 		return
 	}
-	defer file.Close()
+	uploadCount := session.UploadCount
+	completedCount := session.CompletedCount
 
-	uploadID := r.FormValue("uploadId")
-	chunkIndex := r.FormValue("chunkIndex")
+	percentComplete := 0.0
+	if uploadCount > 0 {
+		percentComplete = float64(completedCount) / float64(uploadCount) * 100
+	}
 
-	// Security: Sanitize uploadID to prevent path traversal attacks.
-	// We do not validate the uploadID against a list of active upload IDs in order to keep the code simple and reduce execution complexity.
-	// For simplicity, we clean the path.
-	cleanUploadID := filepath.Clean(filepath.Base(uploadID))
-	if cleanUploadID == "." || cleanUploadID == ".." {
-		http.Error(w, "Invalid upload ID.", http.StatusBadRequest)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"sessionId":       sessionID,
+		"uploadCount":     uploadCount,
+		"completedCount":  completedCount,
+		"percentComplete": percentComplete,
+	})
+}
+
+// handleUploadSessionExists lets a client confirm that its session was
+// registered before it starts sending chunks
+func handleUploadSessionExists(w http.ResponseWriter, r *http.Request) {
+	if !hasUploadToken(r) {
+		jsonErrorCode(w, errCodeUnauthorized, "Missing or invalid upload token.", http.StatusUnauthorized)
 		return
 	}
-
-	chunkDir := filepath.Join(appConfig.UploadTempDir, cleanUploadID)
-	if err := os.MkdirAll(chunkDir, os.ModePerm); err != nil {
-		log.Printf("ERROR: Could not create chunk directory %s: %v", chunkDir, err)
-		http.Error(w, "Server error creating chunk directory.", http.StatusInternalServerError)
+	sessionID := r.URL.Query().Get("sessionId")
+	if sessionID == "" {
+		jsonError(w, "Missing sessionId parameter.", http.StatusBadRequest)
 		return
 	}
 
-	chunkPath := filepath.Join(chunkDir, chunkIndex)
-	dst, err := os.Create(chunkPath)
-	if err != nil {
-		log.Printf("ERROR: Could not create chunk file %s: %v", chunkPath, err)
-		http.Error(w, "Server error creating chunk file.", http.StatusInternalServerError)
+	_, err := sessionStore.Get(r.Context(), sessionID)
+	if errors.Is(err, errSessionNotFound) {
+		jsonError(w, "Upload session not found.", http.StatusNotFound)
 		return
 	}
-	defer dst.Close()
-
-	if _, err := io.Copy(dst, file); err != nil {
-		log.Printf("ERROR: Could not save chunk file %s: %v", chunkPath, err)
-		http.Error(w, "Server error saving chunk file.", http.StatusInternalServerError)
+	if err != nil {
+		loggerFrom(r.Context()).Error("Could not read upload session", "sessionId", sessionID, "error", err)
+		jsonError(w, "Could not read upload session.", http.StatusInternalServerError)
 		return
 	}
 
+	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
-	fmt.Fprint(w, "Chunk uploaded successfully")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"sessionId": sessionID,
+		"exists":    true,
+	})
 }
 
-// handleUploadComplete assembles chunks and uploads to Nextcloud.
-func handleUploadComplete(w http.ResponseWriter, r *http.Request) {
+// handleUploadChunk receives and saves a single file chunk.
+func handleUploadChunk(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
 
-	var reqData CompleteRequest
-	if err := json.NewDecoder(r.Body).Decode(&reqData); err != nil {
-		http.Error(w, "Invalid JSON body.", http.StatusBadRequest)
+	// Limit the body to the chunk size plus some room for the other form fields
+	r.Body = http.MaxBytesReader(w, r.Body, appConfig.ChunkSize+(1<<20))
+	memory := appConfig.MultipartMemory
+	if appConfig.StreamChunks {
+		// Streamed chunks must not touch the disk, so the whole form is kept in memory
+		memory = appConfig.ChunkSize + (1 << 20)
+	}
+	if err := r.ParseMultipartForm(memory); err != nil {
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			jsonErrorCode(w, errCodeTooLarge, fmt.Sprintf("Chunk too large: maximum size is %d bytes.", appConfig.ChunkSize), http.StatusRequestEntityTooLarge)
+			return
+		}
+		jsonErrorCode(w, errCodeInvalidInput, "Could not parse form. Chunk might be too large.", http.StatusBadRequest)
 		return
 	}
-
-	// Security: Sanitize again.
-	cleanUploadID := filepath.Clean(filepath.Base(reqData.UploadID))
-	if cleanUploadID == "." || cleanUploadID == ".." {
-		http.Error(w, "Invalid upload ID.", http.StatusBadRequest)
+	// Parts beyond MultipartMemory were spilled to the OS temp dir and stay there until removed
+	if r.MultipartForm != nil {
+		defer r.MultipartForm.RemoveAll()
+	}
+	if !hasUploadToken(r) {
+		jsonErrorCode(w, errCodeUnauthorized, "Missing or invalid upload token.", http.StatusUnauthorized)
 		return
 	}
 
-	chunkDir := filepath.Join(appConfig.UploadTempDir, cleanUploadID)
-	defer os.RemoveAll(chunkDir) // Clean up chunks after we're done.
+	// Reject incomplete requests before touching the chunk store
+	for _, field := range []string{"uploadId", "chunkIndex"} {
+		if r.FormValue(field) == "" {
+			jsonErrorCode(w, errCodeInvalidInput, fmt.Sprintf("Missing required field: %s.", field), http.StatusBadRequest)
+			return
+		}
+	}
+
+	// The chunk index names the stored chunk and sets the assembly order, so it
+	// must be a plain non-negative integer. It is normalized so "007" and "7"
+	// map to the same chunk.
+	index, err := strconv.Atoi(r.FormValue("chunkIndex"))
+	if err != nil || index < 0 {
+		jsonErrorCode(w, errCodeInvalidInput, "Invalid chunk index: must be a non-negative integer.", http.StatusBadRequest)
+		return
+	}
+	chunkIndex := strconv.Itoa(index)
 
-	// Read all chunk files from the directory
-	chunkFiles, err := os.ReadDir(chunkDir)
+	file, header, err := r.FormFile("dataFile")
 	if err != nil {
-		log.Printf("ERROR: Could not read chunk directory %s: %v", chunkDir, err)
-		jsonError(w, "Could not find chunks on server.", http.StatusInternalServerError)
+		jsonErrorCode(w, errCodeInvalidInput, "Invalid file chunk key.", http.StatusBadRequest)
+		return
+	}
+	defer file.Close()
+	if header.Size > appConfig.ChunkSize {
+		jsonErrorCode(w, errCodeTooLarge, fmt.Sprintf("Chunk too large: maximum size is %d bytes.", appConfig.ChunkSize), http.StatusRequestEntityTooLarge)
 		return
 	}
 
-	// Sort chunks numerically by their filename (which is their index)
-	sort.Slice(chunkFiles, func(i, j int) bool {
-		numI, _ := strconv.Atoi(chunkFiles[i].Name())
-		numJ, _ := strconv.Atoi(chunkFiles[j].Name())
-		return numI < numJ
-	})
+	uploadID := r.FormValue("uploadId")
+	sessionID := r.FormValue("sessionId")
+
+	// Security: Sanitize uploadID to prevent path traversal attacks.
+	// We do not validate the uploadID against a list of active upload IDs in order to keep the code simple and reduce execution complexity.
+	cleanUploadID, ok := sanitizeUploadID(uploadID)
+	if !ok {
+		jsonErrorCode(w, errCodeInvalidInput, "Invalid upload ID.", http.StatusBadRequest)
+		return
+	}
+	logger := loggerFrom(r.Context()).With("uploadId", cleanUploadID, "chunkIndex", chunkIndex)
 
-	// Create a list of readers for the original file content only
-	var readers []io.Reader
+	if sessionExpired(r.Context(), sessionID) {
+		logger.Warn("Rejected chunk for expired session", "sessionId", sessionID)
+		rejectExpiredSession(w, logger, cleanUploadID)
+		return
+	}
 
-	// Read chunks (original file content only)
-	for _, chunkFile := range chunkFiles {
-		path := filepath.Join(chunkDir, chunkFile.Name())
-		f, err := os.Open(path)
-		if err != nil {
-			log.Printf("ERROR: Could not open chunk file %s: %v", path, err)
-			jsonError(w, "Error processing chunks.", http.StatusInternalServerError)
+	// Cap the number of chunks per upload so a client cannot exhaust the inodes
+	// of the temp filesystem. Re-sending an already stored index is still allowed.
+	// Streamed chunks are not stored, so forwardChunk counts those itself.
+	if appConfig.MaxChunksPerUpload > 0 && !appConfig.StreamChunks {
+		existing, err := chunkStore.ListChunks(cleanUploadID)
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			logger.Error("Could not list chunks", "error", err)
+			jsonErrorCode(w, errCodeServerError, "Server error saving chunk file.", http.StatusInternalServerError)
+			return
+		}
+		if len(existing) >= appConfig.MaxChunksPerUpload && !slices.Contains(existing, chunkIndex) {
+			logger.Warn("Too many chunks for upload", "chunks", len(existing), "maxChunks", appConfig.MaxChunksPerUpload)
+			jsonErrorCode(w, errCodeTooLarge, fmt.Sprintf("Too many chunks: maximum is %d per upload.", appConfig.MaxChunksPerUpload), http.StatusBadRequest)
 			return
 		}
-		// This cleanup is not 100% reliable, it's assumed that it's running in an ephemeral storage.
-		readers = append(readers, f)
 	}
 
-	// Combine all readers into one for the original file
-	originalFileReader := io.MultiReader(readers...)
-
-	// Create folder name with timestamp, email, and phone
-	folderName := createFolderName(reqData.Email, reqData.Phone)
-
-	// Create folder in Nextcloud first
-	if err := createNextcloudFolder(folderName); err != nil {
-		log.Printf("ERROR: Failed to create folder %s: %v", folderName, err)
-		jsonError(w, "Failed to create folder in Nextcloud.", http.StatusInternalServerError)
+	if !appConfig.StreamChunks && !hasFreeDiskSpace(r.Context()) {
+		jsonErrorCode(w, errCodeInsufficientStorage, "Insufficient storage, please retry later.", http.StatusInsufficientStorage)
+		return
+	}
+	release, ok := acquireChunkWrite(w, logger, cleanUploadID)
+	if !ok {
+		return
+	}
+	defer release()
+
+	// Pre-compressed chunks are stored decompressed, so the assembled file is intact.
+	// The decompressed size is capped like a plain chunk to defuse gzip bombs.
+	var chunkData io.Reader = file
+	var gzipChunk *gzipChunkReader
+	switch encoding := r.FormValue("chunkEncoding"); encoding {
+	case "", "identity":
+	case "gzip":
+		decompressor, err := gzip.NewReader(file)
+		if err != nil {
+			jsonErrorCode(w, errCodeInvalidInput, "Invalid gzip chunk.", http.StatusBadRequest)
+			return
+		}
+		defer decompressor.Close()
+		gzipChunk = &gzipChunkReader{r: io.LimitReader(decompressor, appConfig.ChunkSize+1)}
+		chunkData = gzipChunk
+	default:
+		jsonErrorCode(w, errCodeInvalidInput, fmt.Sprintf("Unsupported chunk encoding %q.", encoding), http.StatusBadRequest)
 		return
 	}
 
-	// Upload original file to Nextcloud in its own folder
-	finalFilename := filepath.Base(reqData.FileName)
-	if err := uploadToNextcloudFolder(folderName, finalFilename, originalFileReader); err != nil {
-		log.Printf("ERROR: Nextcloud upload failed for %s: %v", finalFilename, err)
-		jsonError(w, "Failed to upload to Nextcloud.", http.StatusInternalServerError)
+	if appConfig.StreamChunks {
+		// Browsers name Blob slices "blob" unless told otherwise, which is useless
+		fileName := header.Filename
+		if fileName == "blob" {
+			fileName = ""
+		}
+		forwardChunk(w, r, logger, cleanUploadID, index, sessionID, fileName, chunkData, gzipChunk)
 		return
 	}
 
-	// Check if this is part of a multi-file session
-	var shouldUploadDescription bool
-	if reqData.SessionID != "" {
-		shouldUploadDescription = checkAndUpdateSession(reqData.SessionID, folderName, reqData.Email, reqData.Phone, reqData.DataOrigin)
-	} else {
-		// Single file upload - always upload description
-		shouldUploadDescription = true
+	// Hash the chunk while it is written so it does not have to be read back from disk.
+	hasher := sha256.New()
+	if err := chunkStore.WriteChunk(cleanUploadID, chunkIndex, io.TeeReader(chunkData, hasher)); err != nil {
+		if gzipChunk != nil && gzipChunk.err != nil {
+			logger.Warn("Could not decompress chunk", "error", gzipChunk.err)
+			jsonErrorCode(w, errCodeInvalidInput, "Invalid gzip chunk.", http.StatusBadRequest)
+			return
+		}
+		logger.Error("Could not save chunk", "error", err)
+		jsonErrorCode(w, errCodeServerError, "Server error saving chunk file.", http.StatusInternalServerError)
+		return
+	}
+	if gzipChunk != nil {
+		size, err := chunkStore.ChunkSize(cleanUploadID, chunkIndex)
+		if err != nil {
+			logger.Error("Could not stat chunk", "error", err)
+			jsonErrorCode(w, errCodeServerError, "Server error saving chunk file.", http.StatusInternalServerError)
+			return
+		}
+		if size > appConfig.ChunkSize {
+			if err := chunkStore.DeleteChunk(cleanUploadID, chunkIndex); err != nil {
+				logger.Error("Could not delete oversized chunk", "error", err)
+			}
+			jsonErrorCode(w, errCodeTooLarge, fmt.Sprintf("Chunk too large: maximum size is %d bytes.", appConfig.ChunkSize), http.StatusRequestEntityTooLarge)
+			return
+		}
 	}
 
-	// Create and upload description text file only if needed
-	if shouldUploadDescription {
-		// Check if description file already exists
-		if checkDescriptionFileExists(folderName) {
-		} else {
-			descriptionContent := createDescriptionContent(reqData.Email, reqData.Phone, reqData.DataOrigin)
-			descriptionReader := strings.NewReader(descriptionContent)
-			if err := uploadToNextcloudFolder(folderName, "descripcion.txt", descriptionReader); err != nil {
-				log.Printf("ERROR: Failed to upload description file: %v", err)
+	// Verify the chunk against the client-supplied hash, if any
+	if expectedHash := r.FormValue("chunkHash"); expectedHash != "" {
+		actualHash := hex.EncodeToString(hasher.Sum(nil))
+		if !strings.EqualFold(actualHash, expectedHash) {
+			if err := chunkStore.DeleteChunk(cleanUploadID, chunkIndex); err != nil {
+				logger.Error("Could not delete corrupted chunk", "error", err)
 			}
-			log.Printf("INFO: Uploaded description file for session %s", reqData.SessionID)
+			logger.Warn("Chunk hash mismatch", "expectedHash", expectedHash, "actualHash", actualHash)
+			jsonErrorCode(w, errCodeChecksumMismatch, "Chunk hash mismatch.", http.StatusUnprocessableEntity)
+			return
 		}
-	} else {
-		log.Printf("INFO: Skipped description file upload for session %s (not all files complete)", reqData.SessionID)
 	}
 
-	// Respond with success
-	w.Header().Set("Content-Type", "application/json")
+	// Remember the multipart file name so /upload-complete can recover it.
+	// Browsers name Blob slices "blob" unless told otherwise, which is useless.
+	if index == 0 && header.Filename != "" && header.Filename != "blob" {
+		if err := chunkStore.SetFileName(cleanUploadID, header.Filename); err != nil {
+			logger.Error("Could not store file name", "error", err)
+		}
+	}
+
+	chunksReceivedTotal.Inc()
 	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(map[string]string{
-		"message":    "File uploaded successfully!",
-		"folderName": folderName,
-		"fileName":   finalFilename,
-	})
+	fmt.Fprint(w, "Chunk uploaded successfully")
 }
 
-// createNextcloudFolder creates a folder in Nextcloud using WebDAV MKCOL
-func createNextcloudFolder(folderName string) error {
-	webdavURL := fmt.Sprintf(
-		"%s/remote.php/dav/files/%s/%s/%s",
-		appConfig.NextcloudURL,
-		appConfig.NextcloudUser,
-		appConfig.NextcloudUploadDir,
-		url.PathEscape(folderName),
-	)
-	req, err := http.NewRequest("MKCOL", webdavURL, nil)
-	if err != nil {
-		return fmt.Errorf("could not create request: %w", err)
+// uploadTokenHeader carries the upload token; the "uploadToken" form or query
+// field is accepted as well for clients that cannot set headers
+const uploadTokenHeader = "X-Upload-Token"
+
+// hasUploadToken reports whether the request carries UPLOAD_TOKEN, or true if
+// no token is configured. For multipart requests the form must already be parsed.
+func hasUploadToken(r *http.Request) bool {
+	if appConfig.UploadToken == "" {
+		return true
 	}
-	req.SetBasicAuth(appConfig.NextcloudUser, appConfig.NextcloudAppPass)
-	client := &http.Client{Timeout: 30 * time.Second}
-	resp, err := client.Do(req)
-	if err != nil {
-		return fmt.Errorf("request execution failed: %w", err)
+	token := r.Header.Get(uploadTokenHeader)
+	if token == "" {
+		token = r.FormValue("uploadToken")
 	}
-	defer resp.Body.Close()
+	return subtle.ConstantTimeCompare([]byte(token), []byte(appConfig.UploadToken)) == 1
+}
 
-	// MKCOL returns 201 for created, 405 for already exists, both are OK
-	if resp.StatusCode != http.StatusCreated && resp.StatusCode != http.StatusMethodNotAllowed {
-		body, _ := io.ReadAll(resp.Body)
-		return fmt.Errorf("bad response from Nextcloud: %s (body: %s)", resp.Status, string(body))
-	}
-	return nil
+// gzipChunkReader reads a decompressed chunk and remembers decompression errors,
+// such as truncated or corrupt data, so they can be told apart from storage errors.
+type gzipChunkReader struct {
+	r   io.Reader
+	err error
 }
 
-// uploadToNextcloudFolder uploads a file to a specific folder in Nextcloud
-func uploadToNextcloudFolder(folderName, filename string, data io.Reader) error {
-	webdavURL := fmt.Sprintf(
-		"%s/remote.php/dav/files/%s/%s/%s/%s",
-		appConfig.NextcloudURL,
-		appConfig.NextcloudUser,
-		appConfig.NextcloudUploadDir,
-		url.PathEscape(folderName),
-		url.PathEscape(filename),
-	)
+func (g *gzipChunkReader) Read(p []byte) (int, error) {
+	n, err := g.r.Read(p)
+	if err != nil && err != io.EOF {
+		g.err = err
+	}
+	return n, err
+}
 
-	req, err := http.NewRequest(http.MethodPut, webdavURL, data)
-	if err != nil {
-		return fmt.Errorf("could not create request: %w", err)
+// hasFreeDiskSpace reports whether the temp directory still has at least
+// MinFreeDiskBytes available. Errors reading the filesystem are logged and do
+// not block uploads.
+func hasFreeDiskSpace(ctx context.Context) bool {
+	if appConfig.MinFreeDiskBytes <= 0 {
+		return true
 	}
-	req.SetBasicAuth(appConfig.NextcloudUser, appConfig.NextcloudAppPass)
-	client := &http.Client{Timeout: 60 * time.Minute}
-	resp, err := client.Do(req)
+	free, err := freeDiskBytes(appConfig.UploadTempDir)
 	if err != nil {
-		return fmt.Errorf("request execution failed: %w", err)
+		loggerFrom(ctx).Error("Could not check free disk space", "dir", appConfig.UploadTempDir, "error", err)
+		return true
 	}
-	defer resp.Body.Close()
-	if resp.StatusCode != http.StatusCreated && resp.StatusCode != http.StatusNoContent {
-		body, _ := io.ReadAll(resp.Body)
-		return fmt.Errorf("bad response from Nextcloud: %s (body: %s)", resp.Status, string(body))
+	if free < uint64(appConfig.MinFreeDiskBytes) {
+		loggerFrom(ctx).Warn("Temp directory is low on disk space", "dir", appConfig.UploadTempDir, "freeBytes", free, "minFreeBytes", appConfig.MinFreeDiskBytes)
+		return false
 	}
-	return nil
+	return true
 }
 
-// createFolderName creates a folder name with timestamp, email, and phone (no filename)
-func createFolderName(email, phone string) string {
-	timestamp := time.Now().Unix()
+// handleUploadChunkStatus lists the chunk indices already stored for an upload,
+// so an interrupted client can resume without re-sending them.
+func handleUploadChunkStatus(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
 
-	// Sanitize email for folder name (remove @ and replace with _at_)
-	sanitizedEmail := strings.ReplaceAll(email, "@", "_en_")
-	sanitizedEmail = strings.ReplaceAll(sanitizedEmail, ".", "_")
+	// Security: Sanitize uploadID to prevent path traversal attacks.
+	cleanUploadID, ok := sanitizeUploadID(r.URL.Query().Get("uploadId"))
+	if !ok {
+		jsonError(w, "Invalid upload ID.", http.StatusBadRequest)
+		return
+	}
 
-	// Sanitize phone for folder name (remove spaces, dashes, parentheses)
-	sanitizedPhone := strings.ReplaceAll(phone, " ", "")
-	sanitizedPhone = strings.ReplaceAll(sanitizedPhone, "-", "")
-	sanitizedPhone = strings.ReplaceAll(sanitizedPhone, "(", "")
-	sanitizedPhone = strings.ReplaceAll(sanitizedPhone, ")", "")
-	sanitizedPhone = strings.ReplaceAll(sanitizedPhone, "+", "plus")
+	chunks := []int{}
+	chunkNames, err := chunkStore.ListChunks(cleanUploadID)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		loggerFrom(r.Context()).Error("Could not list chunks", "uploadId", cleanUploadID, "error", err)
+		jsonError(w, "Could not read chunks on server.", http.StatusInternalServerError)
+		return
+	}
+	for _, chunkName := range chunkNames {
+		index, err := strconv.Atoi(chunkName)
+		if err != nil {
+			continue
+		}
+		chunks = append(chunks, index)
+	}
+	sort.Ints(chunks)
 
-	// Build folder name components
-	components := []string{fmt.Sprintf("%d", timestamp)}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(chunks)
+}
 
-	// Add email if provided
-	if email != "" {
-		components = append(components, sanitizedEmail)
+// handleUploadCancel discards the chunks of an abandoned upload and its session.
+// Cancelling an upload that is already gone still succeeds, so retries are safe.
+func handleUploadCancel(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
 	}
 
-	// Add phone if provided
-	if phone != "" {
-		components = append(components, sanitizedPhone)
+	var reqData CancelRequest
+	if !decodeJSONBody(w, r, &reqData) {
+		return
 	}
 
-	return strings.Join(components, "-")
-}
+	// Security: Sanitize uploadID to prevent path traversal attacks.
+	cleanUploadID, ok := sanitizeUploadID(reqData.UploadID)
+	if !ok {
+		jsonError(w, "Invalid upload ID.", http.StatusBadRequest)
+		return
+	}
+	logger := loggerFrom(r.Context()).With("uploadId", cleanUploadID, "sessionId", reqData.SessionID)
 
-// createDescriptionContent creates the content for the description.txt file
-func createDescriptionContent(email, phone, dataOrigin string) string {
-	var buffer bytes.Buffer
-	buffer.WriteString("--- UPLOAD INFORMATION ---\n")
-	buffer.WriteString(fmt.Sprintf("Timestamp (UTC): %s\n", time.Now().UTC().Format(time.RFC3339)))
-	buffer.WriteString(fmt.Sprintf("Email: %s\n", email))
-	if phone != "" {
-		buffer.WriteString(fmt.Sprintf("Teléfono: %s\n", phone))
+	if err := chunkStore.Remove(cleanUploadID); err != nil {
+		logger.Error("Could not remove chunks of cancelled upload", "error", err)
+		jsonError(w, "Could not discard upload.", http.StatusInternalServerError)
+		return
 	}
-	buffer.WriteString("\n--- DESCRIPCIÓN ---\n")
+	if err := removeRangeUpload(cleanUploadID); err != nil {
+		logger.Error("Could not remove ranges of cancelled upload", "error", err)
+		jsonError(w, "Could not discard upload.", http.StatusInternalServerError)
+		return
+	}
+	removeStreamTransfer(r.Context(), cleanUploadID)
+	if reqData.SessionID != "" {
+		if err := sessionStore.Delete(r.Context(), reqData.SessionID); err != nil {
+			logger.Error("Could not delete cancelled session", "error", err)
+			jsonError(w, "Could not discard upload session.", http.StatusInternalServerError)
+			return
+		}
+	}
+	logger.Info("Cancelled upload")
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{
+		"message":  "Upload cancelled",
+		"uploadId": reqData.UploadID,
+	})
+}
+
+// handleUploadComplete assembles chunks and uploads to Nextcloud.
+func handleUploadComplete(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// Every attempt is audited with the outcome taken from the response, so the
+	// early returns below need no audit calls of their own
+	audit := &AuditEntry{ClientIP: loggedClientIP(r), UserAgent: r.UserAgent()}
+	if auditLog != nil {
+		recorder := &auditRecorder{ResponseWriter: w}
+		w = recorder
+		defer auditLog.record(r, audit, recorder)
+	}
+
+	if !hasUploadToken(r) {
+		jsonErrorCode(w, errCodeUnauthorized, "Missing or invalid upload token.", http.StatusUnauthorized)
+		return
+	}
+
+	var reqData CompleteRequest
+	if !decodeJSONBody(w, r, &reqData) {
+		return
+	}
+	audit.UploadID, audit.SessionID = reqData.UploadID, reqData.SessionID
+	audit.Email, audit.Phone, audit.FileName = reqData.Email, reqData.Phone, reqData.FileName
+
+	// Security: Sanitize again.
+	cleanUploadID, ok := sanitizeUploadID(reqData.UploadID)
+	if !ok {
+		jsonErrorCode(w, errCodeInvalidInput, "Invalid upload ID.", http.StatusBadRequest)
+		return
+	}
+
+	// Clean up the stored upload once it succeeded, was rejected for good or
+	// the client went away. A client told to retry, or whose request failed on
+	// our side, needs it again; the sweeper removes it if it never comes back.
+	outcome := &statusRecorder{ResponseWriter: w}
+	w = outcome
+	var keepUpload bool // Set where the response alone does not show the upload is still needed
+	defer func() {
+		if keepUpload || outcome.status >= http.StatusInternalServerError || outcome.Header().Get("Retry-After") != "" {
+			return
+		}
+		chunkStore.Remove(cleanUploadID)
+		removeRangeUpload(cleanUploadID)
+		removeStreamTransfer(r.Context(), cleanUploadID)
+	}()
+
+	// Streamed uploads are already in Nextcloud and only need to be moved into place
+	streamed := lookupStreamTransfer(cleanUploadID)
+
+	// Fall back to the name sent with the first chunk if the client didn't repeat it
+	if reqData.FileName == "" && streamed != nil {
+		reqData.FileName = streamed.fileNameOfFirstChunk()
+	} else if reqData.FileName == "" {
+		storedName, err := chunkStore.FileName(cleanUploadID)
+		if err != nil {
+			loggerFrom(r.Context()).Error("Could not read stored file name", "uploadId", cleanUploadID, "error", err)
+		}
+		reqData.FileName = storedName
+	}
+
+	finalFilename, err := validateFileName(reqData.FileName)
+	if err != nil {
+		jsonErrorCode(w, errCodeInvalidInput, fmt.Sprintf("Invalid file name: %v.", err), http.StatusBadRequest)
+		return
+	}
+	finalFilename = sanitizeFileName(finalFilename)
+
+	if reqData.FileHash != "" {
+		if decoded, err := hex.DecodeString(reqData.FileHash); err != nil || len(decoded) != sha256.Size {
+			jsonErrorCode(w, errCodeInvalidInput, "Invalid file hash: expected a hex SHA-256 digest.", http.StatusBadRequest)
+			return
+		}
+	}
+
+	if !isAllowedDataOrigin(reqData.DataOrigin) {
+		jsonErrorCode(w, errCodeInvalidInput, invalidDataOriginMessage(), http.StatusBadRequest)
+		return
+	}
+
+	subfolders, err := sanitizeRelativeDir(reqData.RelativePath)
+	if err != nil {
+		jsonErrorCode(w, errCodeInvalidInput, fmt.Sprintf("Invalid relative path: %v.", err), http.StatusBadRequest)
+		return
+	}
+
+	logger := loggerFrom(r.Context()).With("uploadId", cleanUploadID, "sessionId", reqData.SessionID, "clientIp", audit.ClientIP, "userAgent", audit.UserAgent)
+
+	if sessionExpired(r.Context(), reqData.SessionID) {
+		logger.Warn("Rejected completion for expired session")
+		rejectExpiredSession(w, logger, cleanUploadID)
+		return
+	}
+
+	// Upload to the backend, or the Nextcloud account selected when the session was registered
+	backend, err := backendForSession(r.Context(), reqData.SessionID)
+	if err != nil {
+		logger.Error("Could not resolve Nextcloud target", "error", err)
+		jsonErrorCode(w, errCodeServerError, "Could not resolve upload target.", http.StatusInternalServerError)
+		return
+	}
+
+	// Fail fast while Nextcloud is known to be down instead of assembling the file for nothing
+	if nc, ok := backend.(*NextcloudClient); ok {
+		if wait := nc.Breaker.retryAfter(); wait > 0 {
+			logger.Warn("Nextcloud circuit breaker open, rejecting upload")
+			w.Header().Set("Retry-After", retryAfterSeconds(wait))
+			jsonErrorCode(w, errCodeNextcloudDown, "Nextcloud is unavailable, please retry later.", http.StatusServiceUnavailable)
+			return
+		}
+	}
+
+	if !isAllowedExtension(finalFilename) {
+		logger.Warn("Rejected disallowed file extension", "fileName", finalFilename)
+		jsonErrorCode(w, errCodeUnsupportedType, "File type not allowed.", http.StatusUnsupportedMediaType)
+		return
+	}
+
+	// The file is read back several times (scan, upload, thumbnail), each time
+	// through a fresh reader over either the chunks or the range upload file
+	var chunkNames []string
+	var totalBytes int64
+	openUpload := func() io.ReadCloser { return newChunkReader(cleanUploadID, chunkNames) }
+
+	if streamed != nil {
+		if reqData.TotalChunks > 0 && streamed.chunks() < reqData.TotalChunks {
+			logger.Error("Upload chunks missing", "expectedChunks", reqData.TotalChunks, "chunks", streamed.chunks())
+			keepUpload = true // The client can send the remaining chunks and complete again
+			jsonErrorCode(w, errCodeChunkMissing, fmt.Sprintf("Incomplete upload: expected %d chunks, received %d chunks.", reqData.TotalChunks, streamed.chunks()), http.StatusUnprocessableEntity)
+			return
+		}
+		totalBytes = streamed.totalSize()
+		// Only the first bytes are kept, which is all content sniffing reads
+		openUpload = func() io.ReadCloser { return io.NopCloser(bytes.NewReader(streamed.firstBytes())) }
+	} else if rangeUploadExists(cleanUploadID) {
+		state, err := loadRangeState(cleanUploadID)
+		if err != nil {
+			logger.Error("Could not read range state", "error", err)
+			jsonErrorCode(w, errCodeServerError, "Error processing chunks.", http.StatusInternalServerError)
+			return
+		}
+		if !state.complete() {
+			logger.Error("Upload ranges missing", "expectedBytes", state.Total, "receivedBytes", state.receivedBytes())
+			keepUpload = true // The client can send the missing ranges and complete again
+			jsonErrorCode(w, errCodeChunkMissing, fmt.Sprintf("Incomplete upload: expected %d bytes, received %d bytes.", state.Total, state.receivedBytes()), http.StatusUnprocessableEntity)
+			return
+		}
+		totalBytes = state.Total
+		openUpload = func() io.ReadCloser { return newRangeReader(cleanUploadID) }
+	} else {
+		// List all chunks of the upload, giving chunks still in flight a moment to arrive
+		// An upload without any chunk is checked below together with empty chunks
+		chunkNames, err = waitForChunks(r.Context(), cleanUploadID, reqData.TotalChunks)
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			logger.Error("Could not list chunks", "error", err)
+			jsonErrorCode(w, errCodeChunkMissing, "Could not find chunks on server.", http.StatusInternalServerError)
+			return
+		}
+		if reqData.TotalChunks > 0 && len(chunkNames) < reqData.TotalChunks {
+			logger.Error("Upload chunks missing", "expectedChunks", reqData.TotalChunks, "chunks", len(chunkNames))
+			keepUpload = true
+			jsonErrorCode(w, errCodeChunkMissing, fmt.Sprintf("Incomplete upload: expected %d chunks, received %d chunks.", reqData.TotalChunks, len(chunkNames)), http.StatusUnprocessableEntity)
+			return
+		}
+
+		// Sort chunks numerically by their name (which is their index)
+		sort.Slice(chunkNames, func(i, j int) bool {
+			numI, _ := strconv.Atoi(chunkNames[i])
+			numJ, _ := strconv.Atoi(chunkNames[j])
+			return numI < numJ
+		})
+
+		// A gap would silently be assembled into a corrupt file
+		if missing := missingChunkIndices(chunkNames); len(missing) > 0 {
+			logger.Error("Upload chunks missing", "missingChunks", missing, "chunks", len(chunkNames))
+			keepUpload = true // So the client can fill the gaps
+			jsonErrorCode(w, errCodeChunkMissing, fmt.Sprintf("Incomplete upload: missing chunks %s.", formatChunkIndices(missing)), http.StatusUnprocessableEntity)
+			return
+		}
+
+		// Sum the chunk sizes to detect missing or truncated chunks before uploading
+		for _, chunkName := range chunkNames {
+			size, err := chunkStore.ChunkSize(cleanUploadID, chunkName)
+			if err != nil {
+				logger.Error("Could not stat chunk", "chunkIndex", chunkName, "error", err)
+				jsonErrorCode(w, errCodeServerError, "Error processing chunks.", http.StatusInternalServerError)
+				return
+			}
+			totalBytes += size
+		}
+	}
+	audit.Size = totalBytes
+	if totalBytes == 0 && !appConfig.AllowEmptyFiles {
+		logger.Warn("Rejected upload without file data", "chunks", len(chunkNames))
+		jsonErrorCode(w, errCodeChunkMissing, "No file data received.", http.StatusBadRequest)
+		return
+	}
+	if appConfig.MaxUploadBytes > 0 && totalBytes > appConfig.MaxUploadBytes {
+		logger.Error("Upload exceeds maximum size", "totalBytes", totalBytes, "maxBytes", appConfig.MaxUploadBytes)
+		jsonErrorCode(w, errCodeTooLarge, fmt.Sprintf("File too large: maximum size is %d bytes.", appConfig.MaxUploadBytes), http.StatusRequestEntityTooLarge)
+		return
+	}
+	if reqData.TotalSize > 0 && totalBytes != reqData.TotalSize {
+		logger.Error("Upload size mismatch", "expectedBytes", reqData.TotalSize, "totalBytes", totalBytes)
+		jsonErrorCode(w, errCodeChunkMissing, fmt.Sprintf("Incomplete upload: expected %d bytes, received %d bytes.", reqData.TotalSize, totalBytes), http.StatusUnprocessableEntity)
+		return
+	}
+
+	// Scan the assembled file for malware before anything reaches Nextcloud
+	if appConfig.ClamAVAddr != "" {
+		scanReader := openUpload()
+		signature, err := scanWithClamAV(appConfig.ClamAVAddr, scanReader)
+		scanReader.Close()
+		if err != nil {
+			logger.Error("Virus scan failed", "error", err)
+			uploadFailuresTotal.WithLabelValues(stageVirusScan).Inc()
+			jsonErrorCode(w, errCodeScanUnavailable, "Virus scan unavailable.", http.StatusServiceUnavailable)
+			return
+		}
+		if signature != "" {
+			logger.Warn("Rejected infected upload", "fileName", finalFilename, "signature", signature)
+			uploadFailuresTotal.WithLabelValues(stageVirusScan).Inc()
+			jsonErrorCode(w, errCodeMalwareDetected, fmt.Sprintf("File rejected: malware detected (%s).", signature), http.StatusUnprocessableEntity)
+			return
+		}
+	}
+
+	// Combine all chunks into one reader for the original file, opening them one at a time
+	chunks := openUpload()
+	defer chunks.Close()
+	var originalFileReader io.Reader = chunks
+
+	// Sniff the content type from the first bytes and put them back in front of the stream
+	var contentType string
+	if len(appConfig.AllowedMIMETypes) > 0 || sizeLimitsUseContentType() {
+		sniffBuffer := make([]byte, 512)
+		n, err := io.ReadFull(originalFileReader, sniffBuffer)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			logger.Error("Could not read file for content sniffing", "error", err)
+			jsonErrorCode(w, errCodeServerError, "Error processing chunks.", http.StatusInternalServerError)
+			return
+		}
+		contentType = http.DetectContentType(sniffBuffer[:n])
+		if !isAllowedContentType(contentType) {
+			logger.Warn("Rejected disallowed content type", "fileName", finalFilename, "contentType", contentType)
+			jsonErrorCode(w, errCodeUnsupportedType, "File type not allowed.", http.StatusUnsupportedMediaType)
+			return
+		}
+		originalFileReader = io.MultiReader(bytes.NewReader(sniffBuffer[:n]), originalFileReader)
+	}
+	if limit, rule, size, ok := sizeLimitFor(finalFilename, contentType); ok && totalBytes > limit {
+		logger.Warn("Upload exceeds size limit for its type", "totalBytes", totalBytes, "rule", rule, "maxBytes", limit)
+		message := fmt.Sprintf("File too large: maximum size for %s files is %s.", rule, size)
+		if rule == "default" {
+			message = fmt.Sprintf("File too large: maximum size is %s.", size)
+		}
+		jsonErrorCode(w, errCodeTooLarge, message, http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	// Wait for a free upload slot so bursts don't overwhelm Nextcloud
+	if uploadSlots != nil {
+		select {
+		case uploadSlots <- struct{}{}:
+			defer func() { <-uploadSlots }()
+		case <-time.After(appConfig.UploadQueueTimeout):
+			logger.Warn("No free upload slot, rejecting upload")
+			w.Header().Set("Retry-After", strconv.Itoa(int(appConfig.UploadQueueTimeout.Seconds())+1))
+			jsonErrorCode(w, errCodeServerBusy, "Server busy, please retry later.", http.StatusServiceUnavailable)
+			return
+		case <-r.Context().Done():
+			return
+		}
+	}
+
+	// Create folder name with timestamp, email, and phone, unless the session already chose one
+	folderName := sessionFolderName(r.Context(), reqData.SessionID)
+	if folderName == "" {
+		folderName = createFolderName(reqData.Email, reqData.Phone, reqData.DataOrigin)
+	}
+	if appConfig.RenameOnComplete {
+		folderName = appConfig.PendingFolderPrefix + folderName
+	}
+
+	// File categorized uploads below a folder named after their category
+	if category := dataOriginCategory(reqData.DataOrigin); category != "" {
+		if err := backend.CreateFolder(r.Context(), category); err != nil {
+			logger.Error("Failed to create category folder", "category", category, "error", err)
+			uploadFailuresTotal.WithLabelValues(stageFolderCreate).Inc()
+			code, message, status := nextcloudError(w, backend, err, "Failed to create folder in Nextcloud.")
+			jsonErrorCode(w, code, message, status)
+			return
+		}
+		folderName = category + "/" + folderName
+	}
+	logger = logger.With("folderName", folderName)
+	audit.FolderName = folderName
+
+	// Create folder in Nextcloud first
+	if err := backend.CreateFolder(r.Context(), folderName); err != nil {
+		logger.Error("Failed to create folder", "error", err)
+		uploadFailuresTotal.WithLabelValues(stageFolderCreate).Inc()
+		code, message, status := nextcloudError(w, backend, err, "Failed to create folder in Nextcloud.")
+		jsonErrorCode(w, code, message, status)
+		return
+	}
+
+	// Recreate the original directory structure below the upload folder
+	uploadFolder := folderName
+	for _, subfolder := range subfolders {
+		uploadFolder = uploadFolder + "/" + subfolder
+		if err := backend.CreateFolder(r.Context(), uploadFolder); err != nil {
+			logger.Error("Failed to create subfolder", "subfolder", uploadFolder, "error", err)
+			uploadFailuresTotal.WithLabelValues(stageFolderCreate).Inc()
+			code, message, status := nextcloudError(w, backend, err, "Failed to create folder in Nextcloud.")
+			jsonErrorCode(w, code, message, status)
+			return
+		}
+	}
+
+	// Resolve a file with the same name that is already in the folder
+	var skipped bool
+	switch conflictPolicy() {
+	case conflictRename:
+		finalFilename, err = dedupFileName(r.Context(), backend, uploadFolder, finalFilename)
+		if err != nil {
+			logger.Error("Could not find a free file name", "error", err)
+			uploadFailuresTotal.WithLabelValues(stageFileUpload).Inc()
+			code, message, status := nextcloudError(w, backend, err, "Failed to upload to Nextcloud.")
+			jsonErrorCode(w, code, message, status)
+			return
+		}
+	case conflictSkip:
+		// Makes a retried complete step idempotent
+		skipped = backend.FileExists(r.Context(), uploadFolder, finalFilename)
+	}
+	audit.FileName = finalFilename
+
+	// Stream forwarding progress as NDJSON to clients that ask for it
+	var stream *progressStream
+	if wantsProgressStream(r) && streamed == nil {
+		counter := &countingReader{r: originalFileReader}
+		originalFileReader = counter
+		stream = startProgressStream(w, counter, totalBytes)
+	}
+
+	// Hash exactly the bytes sent to Nextcloud for end-to-end verification, metadata.json and the manifest
+	var fileHasher hash.Hash
+	if (reqData.FileHash != "" || appConfig.MetadataFormat == metadataFormatJSON || appConfig.WriteManifest) && !skipped && streamed == nil {
+		fileHasher = sha256.New()
+		originalFileReader = io.TeeReader(originalFileReader, fileHasher)
+	}
+
+	// Upload original file to Nextcloud in its own folder
+	var replicaResults []replicaResult
+	if skipped {
+		logger.Info("Skipped upload of existing file", "fileName", finalFilename)
+	} else if replicaResults, err = storeUpload(withResumableTransfer(r.Context(), cleanUploadID), backend, streamed, uploadFolder, finalFilename, originalFileReader); err != nil {
+		if abortedByClient(r, logger) {
+			return
+		}
+		logger.Error("Nextcloud upload failed", "fileName", finalFilename, "error", err)
+		uploadFailuresTotal.WithLabelValues(stageFileUpload).Inc()
+		code, message, status := nextcloudError(w, backend, err, "Failed to upload to Nextcloud.")
+		if stream != nil {
+			keepUpload = true // The stream already committed a 200
+			stream.finish(map[string]any{"event": "error", "code": code, "error": message})
+			return
+		}
+		jsonErrorCode(w, code, message, status)
+		return
+	}
+	completedFile := SessionFile{FileName: finalFilename, OriginalFileName: reqData.FileName, Size: totalBytes}
+	if fileHasher != nil {
+		completedFile.SHA256 = hex.EncodeToString(fileHasher.Sum(nil))
+	} else if streamed != nil && !skipped {
+		completedFile.SHA256 = streamed.sha256()
+	}
+	if reqData.FileHash != "" && !skipped {
+		if actualHash := completedFile.SHA256; !strings.EqualFold(actualHash, reqData.FileHash) {
+			logger.Warn("File hash mismatch, deleting uploaded file", "expectedHash", reqData.FileHash, "actualHash", actualHash)
+			uploadFailuresTotal.WithLabelValues(stageIntegrity).Inc()
+			rollbackUpload(r.Context(), logger, backend, uploadFolder, finalFilename)
+			if stream != nil {
+				stream.finish(map[string]any{"event": "error", "code": errCodeChecksumMismatch, "error": "File hash mismatch."})
+				return
+			}
+			jsonErrorCode(w, errCodeChecksumMismatch, "File hash mismatch.", http.StatusUnprocessableEntity)
+			return
+		}
+	}
+	if !skipped {
+		uploadsCompletedTotal.Inc()
+		uploadedFileSizeBytes.Observe(float64(totalBytes))
+	}
+
+	// Properties only complement the description file, so failing to set them is not fatal
+	nc, isNextcloud := backend.(*NextcloudClient)
+	if appConfig.SetProperties && isNextcloud && !skipped {
+		props := uploadProperties(reqData.Email, reqData.Phone, reqData.DataOrigin)
+		if err := nc.SetProperties(r.Context(), uploadFolder, finalFilename, props); err != nil {
+			logger.Error("Failed to set file properties", "fileName", finalFilename, "error", err)
+		}
+	}
+
+	// Thumbnails are a convenience for reviewers, so failures only get logged
+	if appConfig.GenerateThumbnails && !skipped {
+		uploadThumbnail(r.Context(), logger, backend, uploadFolder, finalFilename, openUpload())
+	}
+
+	// Share creation is best effort, the upload itself already succeeded
+	var shareURL string
+	if appConfig.CreateShare && isNextcloud {
+		shareURL, err = nc.CreatePublicShare(r.Context(), folderName)
+		if err != nil {
+			logger.Error("Failed to create public share", "error", err)
+		}
+	}
+
+	// Check if this is part of a multi-file session
+	var shouldUploadDescription bool
+	files := []SessionFile{completedFile}
+	if reqData.SessionID != "" {
+		shouldUploadDescription, files = checkAndUpdateSession(r.Context(), reqData.SessionID, completedFile, folderName, shareURL, reqData.Email, reqData.Phone, reqData.DataOrigin)
+	} else {
+		// Single file upload - always upload description
+		shouldUploadDescription = true
+	}
+
+	// Create and upload description text file only if needed
+	if shouldUploadDescription {
+		// Deployments capturing the metadata elsewhere, e.g. with the webhook, can do without it
+		if !appConfig.WriteDescription {
+			logger.Debug("Description file disabled, not writing it")
+		} else if err := uploadDescription(r.Context(), logger, backend, folderName, reqData.Email, reqData.Phone, reqData.DataOrigin, files); err != nil {
+			if abortedByClient(r, logger) {
+				if !skipped {
+					rollbackUpload(r.Context(), logger, backend, uploadFolder, finalFilename)
+				}
+				return
+			}
+			logger.Error("Failed to upload description file", "error", err)
+			uploadFailuresTotal.WithLabelValues(stageDescription).Inc()
+			// Never delete the file a skipped upload found in place
+			if !skipped {
+				rollbackUpload(r.Context(), logger, backend, uploadFolder, finalFilename)
+			}
+			code, message, status := nextcloudError(w, backend, err, "Failed to upload description to Nextcloud.")
+			if stream != nil {
+				keepUpload = true
+				stream.finish(map[string]any{"event": "error", "code": code, "error": message})
+				return
+			}
+			jsonErrorCode(w, code, message, status)
+			return
+		}
+		// The files are stored and described, so a missing manifest does not fail the upload
+		if appConfig.WriteManifest {
+			if err := uploadManifest(r.Context(), backend, folderName, files); err != nil {
+				logger.Error("Failed to upload manifest", "error", err)
+				uploadFailuresTotal.WithLabelValues(stageManifest).Inc()
+			} else {
+				logger.Info("Uploaded manifest", "files", len(files))
+			}
+		}
+	} else {
+		logger.Info("Skipped description file upload (not all files complete)")
+	}
+
+	// The folder is complete once its description is in, so give it its final name
+	if shouldUploadDescription && appConfig.RenameOnComplete && isNextcloud {
+		folderName = finalizeFolder(r.Context(), logger, nc, folderName)
+	}
+
+	sendWebhook(logger, WebhookPayload{
+		FolderName: folderName,
+		FileName:   finalFilename,
+		Email:      reqData.Email,
+		Phone:      reqData.Phone,
+		DataOrigin: reqData.DataOrigin,
+		SessionID:  reqData.SessionID,
+	})
+
+	response := map[string]string{
+		"message":    "File uploaded successfully!",
+		"folderName": folderName,
+		"fileName":   finalFilename,
+	}
+	if shareURL != "" {
+		response["shareUrl"] = shareURL
+	}
+	if skipped {
+		response["message"] = "File already exists, upload skipped."
+		response["skipped"] = "true"
+	}
+	// The quorum was reached, but the client should know about replicas that missed out
+	if replicaResults != nil {
+		for _, result := range replicaResults {
+			if result.err != nil {
+				logger.Warn("Upload not stored on replica", "fileName", finalFilename, "replica", result.name, "error", result.err)
+			}
+		}
+		succeeded, failed := replicaSummary(replicaResults)
+		response["replicatedTo"] = strings.Join(succeeded, ",")
+		if len(failed) > 0 {
+			response["replicationFailed"] = strings.Join(failed, ",")
+		}
+	}
+
+	if stream != nil {
+		event := map[string]any{"event": "complete"}
+		for key, value := range response {
+			event[key] = value
+		}
+		stream.finish(event)
+		return
+	}
+
+	// Plain HTML forms have nothing to show the JSON with, so send those browsers on
+	if appConfig.SuccessRedirectURL != "" && (reqData.Redirect || acceptsMediaType(r, "text/html")) {
+		http.Redirect(w, r, successRedirectURL(folderName), http.StatusSeeOther)
+		return
+	}
+
+	// Respond with success
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(response)
+}
+
+// successRedirectURL returns SUCCESS_REDIRECT_URL with the folder name added
+// to its query, keeping any parameters already in it
+func successRedirectURL(folderName string) string {
+	target, err := url.Parse(appConfig.SuccessRedirectURL)
+	if err != nil {
+		// Checked by validateConfig
+		return appConfig.SuccessRedirectURL
+	}
+	query := target.Query()
+	query.Set("folderName", folderName)
+	target.RawQuery = query.Encode()
+	return target.String()
+}
+
+// chunkReader reads the chunks of an upload in order as one stream. Each chunk is
+// opened only when the previous one is exhausted and closed right after, so at most
+// one chunk is open at a time regardless of the number of chunks.
+type chunkReader struct {
+	uploadID   string
+	chunkNames []string
+	current    io.ReadCloser
+}
+
+// newChunkReader creates a reader over the given chunks of an upload
+func newChunkReader(uploadID string, chunkNames []string) *chunkReader {
+	return &chunkReader{uploadID: uploadID, chunkNames: chunkNames}
+}
+
+func (c *chunkReader) Read(p []byte) (int, error) {
+	for {
+		if c.current == nil {
+			if len(c.chunkNames) == 0 {
+				return 0, io.EOF
+			}
+			chunk, err := chunkStore.OpenChunk(c.uploadID, c.chunkNames[0])
+			if err != nil {
+				return 0, fmt.Errorf("could not open chunk %s: %w", c.chunkNames[0], err)
+			}
+			c.current = chunk
+			c.chunkNames = c.chunkNames[1:]
+		}
+
+		n, err := c.current.Read(p)
+		if err == io.EOF {
+			c.current.Close()
+			c.current = nil
+			if n > 0 {
+				return n, nil
+			}
+			continue
+		}
+		return n, err
+	}
+}
+
+// Close closes the chunk currently being read, if any
+func (c *chunkReader) Close() error {
+	if c.current == nil {
+		return nil
+	}
+	err := c.current.Close()
+	c.current = nil
+	return err
+}
+
+// validateContactFields returns the names of the contact fields that are missing
+// (when required by REQUIRE_EMAIL/REQUIRE_PHONE) or malformed.
+func validateContactFields(email, phone string) []string {
+	var invalid []string
+	if email == "" {
+		if appConfig.RequireEmail {
+			invalid = append(invalid, "email")
+		}
+	} else if address, err := mail.ParseAddress(email); err != nil || address.Address != email {
+		invalid = append(invalid, "email")
+	}
+
+	if phone == "" {
+		if appConfig.RequirePhone {
+			invalid = append(invalid, "phone")
+		}
+	} else if !strings.ContainsAny(phone, "0123456789") {
+		invalid = append(invalid, "phone")
+	}
+	return invalid
+}
+
+// isAllowedDataOrigin reports whether dataOrigin is one of ALLOWED_DATA_ORIGINS,
+// ignoring case and surrounding spaces. Omitting it is always allowed.
+func isAllowedDataOrigin(dataOrigin string) bool {
+	dataOrigin = strings.TrimSpace(dataOrigin)
+	if len(appConfig.AllowedDataOrigins) == 0 || dataOrigin == "" {
+		return true
+	}
+	for _, allowed := range appConfig.AllowedDataOrigins {
+		if strings.EqualFold(strings.TrimSpace(allowed), dataOrigin) {
+			return true
+		}
+	}
+	return false
+}
+
+// invalidDataOriginMessage is the error message for a dataOrigin not in ALLOWED_DATA_ORIGINS
+func invalidDataOriginMessage() string {
+	return fmt.Sprintf("Invalid dataOrigin: must be one of %s.", strings.Join(appConfig.AllowedDataOrigins, ", "))
+}
+
+// isAllowedExtension reports whether the file name has an extension from the configured allowlist
+func isAllowedExtension(fileName string) bool {
+	if len(appConfig.AllowedExtensions) == 0 {
+		return true
+	}
+	extension := strings.TrimPrefix(strings.ToLower(filepath.Ext(fileName)), ".")
+	for _, allowed := range appConfig.AllowedExtensions {
+		if extension == strings.TrimPrefix(strings.ToLower(allowed), ".") {
+			return true
+		}
+	}
+	return false
+}
+
+// isAllowedContentType reports whether a sniffed content type matches the configured allowlist.
+// Entries ending in "/" match a whole family, e.g. "image/".
+func isAllowedContentType(contentType string) bool {
+	if len(appConfig.AllowedMIMETypes) == 0 {
+		return true
+	}
+	mediaType, _, _ := strings.Cut(contentType, ";")
+	for _, allowed := range appConfig.AllowedMIMETypes {
+		if strings.HasSuffix(allowed, "/") && strings.HasPrefix(mediaType, allowed) {
+			return true
+		}
+		if mediaType == allowed {
+			return true
+		}
+	}
+	return false
+}
+
+// byteSizeUnits are the suffixes accepted by parseByteSize, in powers of 1024
+var byteSizeUnits = []struct {
+	suffix     string
+	multiplier int64
+}{
+	{"TB", 1 << 40}, {"GB", 1 << 30}, {"MB", 1 << 20}, {"KB", 1 << 10}, {"B", 1},
+}
+
+// parseByteSize parses a size like "512", "10MB" or "2 GB"
+func parseByteSize(value string) (int64, error) {
+	number, multiplier := strings.ToUpper(strings.TrimSpace(value)), int64(1)
+	for _, unit := range byteSizeUnits {
+		if trimmed, ok := strings.CutSuffix(number, unit.suffix); ok {
+			number, multiplier = strings.TrimSpace(trimmed), unit.multiplier
+			break
+		}
+	}
+	size, err := strconv.ParseInt(number, 10, 64)
+	if err != nil || size < 0 || size > math.MaxInt64/multiplier {
+		return 0, fmt.Errorf("invalid size %q", value)
+	}
+	return size * multiplier, nil
+}
+
+// sizeLimitFor returns the SIZE_LIMITS entry that applies to a file. The
+// extension takes precedence over the exact content type, which takes
+// precedence over its family like "video/"; "default" covers everything else.
+func sizeLimitFor(fileName, contentType string) (limit int64, rule, size string, ok bool) {
+	if len(appConfig.SizeLimits) == 0 {
+		return 0, "", "", false
+	}
+	mediaType, _, _ := strings.Cut(contentType, ";")
+	family, _, _ := strings.Cut(mediaType, "/")
+	candidates := []string{strings.TrimPrefix(strings.ToLower(filepath.Ext(fileName)), ".")}
+	if mediaType != "" {
+		candidates = append(candidates, mediaType, family+"/")
+	}
+	for _, candidate := range append(candidates, "default") {
+		for rule, size := range appConfig.SizeLimits {
+			if candidate == "" || !strings.EqualFold(strings.TrimPrefix(rule, "."), candidate) {
+				continue
+			}
+			// Checked by validateConfig
+			limit, _ := parseByteSize(size)
+			return limit, rule, size, true
+		}
+	}
+	return 0, "", "", false
+}
+
+// sizeLimitsUseContentType reports whether SIZE_LIMITS has entries for
+// content types, which then have to be sniffed even without ALLOWED_CONTENT_TYPES
+func sizeLimitsUseContentType() bool {
+	for rule := range appConfig.SizeLimits {
+		if strings.Contains(rule, "/") {
+			return true
+		}
+	}
+	return false
+}
+
+// sanitizeUploadID reduces a client-supplied upload ID to a single path
+// element to prevent path traversal. IDs starting with a dot are rejected, so
+// no upload can address a hidden file or directory of the chunk store.
+func sanitizeUploadID(uploadID string) (string, bool) {
+	clean := filepath.Clean(filepath.Base(uploadID))
+	if strings.HasPrefix(clean, ".") {
+		return "", false
+	}
+	return clean, true
+}
+
+// sanitizeRelativeDir returns the directory segments of a client-supplied relative
+// file path, rejecting any segment that could escape the upload folder.
+func sanitizeRelativeDir(relativePath string) ([]string, error) {
+	relativePath = strings.ReplaceAll(relativePath, "\\", "/")
+	dir := path.Dir(relativePath)
+	if relativePath == "" || dir == "." || dir == "/" {
+		return nil, nil
+	}
+
+	var segments []string
+	for _, segment := range strings.Split(dir, "/") {
+		if segment == "" || segment == "." {
+			continue
+		}
+		if segment == ".." {
+			return nil, fmt.Errorf("path must not contain \"..\"")
+		}
+		clean, err := validateFileName(segment)
+		if err != nil {
+			return nil, err
+		}
+		segments = append(segments, clean)
+	}
+	return segments, nil
+}
+
+// escapePath escapes each segment of a slash-separated WebDAV path
+func escapePath(p string) string {
+	segments := strings.Split(p, "/")
+	for i, segment := range segments {
+		segments[i] = url.PathEscape(segment)
+	}
+	return strings.Join(segments, "/")
+}
+
+// windowsReservedNames are device names that cannot be used as file names on Windows clients
+var windowsReservedNames = map[string]bool{
+	"CON": true, "PRN": true, "AUX": true, "NUL": true,
+	"COM1": true, "COM2": true, "COM3": true, "COM4": true, "COM5": true, "COM6": true, "COM7": true, "COM8": true, "COM9": true,
+	"LPT1": true, "LPT2": true, "LPT3": true, "LPT4": true, "LPT5": true, "LPT6": true, "LPT7": true, "LPT8": true, "LPT9": true,
+}
+
+// validateFileName strips any directory components from name and rejects names
+// that would produce an invalid or confusing Nextcloud path.
+func validateFileName(name string) (string, error) {
+	base := filepath.Base(name)
+	if base == "." || base == ".." || base == "/" || strings.TrimSpace(base) == "" {
+		return "", fmt.Errorf("file name is empty")
+	}
+	for _, r := range base {
+		if r < 0x20 || r == 0x7f {
+			return "", fmt.Errorf("file name contains control characters")
+		}
+	}
+	stem := strings.ToUpper(strings.TrimSpace(strings.SplitN(base, ".", 2)[0]))
+	if windowsReservedNames[stem] {
+		return "", fmt.Errorf("file name %q is a reserved device name", base)
+	}
+	return base, nil
+}
+
+// sanitizeFileName rewrites a validated file name into one that is safe in a
+// WebDAV path: FILENAME_UNSAFE_CHARS are replaced, whitespace runs collapse to
+// one space, leading dots (hidden files) and trailing dots and spaces are
+// removed, and the name is shortened to MAX_FILENAME_LENGTH bytes while
+// keeping its extension.
+func sanitizeFileName(name string) string {
+	var b strings.Builder
+	for _, r := range name {
+		if strings.ContainsRune(appConfig.FilenameUnsafeChars, r) {
+			b.WriteString(appConfig.FilenameReplacement)
+			continue
+		}
+		b.WriteRune(r)
+	}
+	name = strings.Join(strings.Fields(b.String()), " ")
+	name = strings.TrimRight(strings.TrimLeft(name, ". "), ". ")
+
+	ext := filepath.Ext(name)
+	stem := strings.TrimSuffix(name, ext)
+	if stem == "" {
+		stem = "file"
+	}
+	if max := appConfig.MaxFilenameLength; max > 0 && len(stem)+len(ext) > max {
+		// Very long extensions are not worth keeping intact
+		if len(ext) > max/2 {
+			ext = ""
+		}
+		stem = truncateUTF8(stem, max-len(ext))
+	}
+	return stem + ext
+}
+
+// truncateUTF8 shortens s to at most n bytes without splitting a character
+func truncateUTF8(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return s[:n]
+}
+
+// FolderNameData holds the values available to FOLDER_NAME_TEMPLATE.
+// Email and Phone are already sanitized (and hashed with HASH_FOLDER_IDENTIFIERS)
+// the same way as in the default folder name.
+type FolderNameData struct {
+	Timestamp  int64
+	Date       string
+	Email      string
+	Phone      string
+	DataOrigin string
+}
+
+// folderNameTemplate is the parsed FOLDER_NAME_TEMPLATE, nil for the default format
+var folderNameTemplate *template.Template
+
+// parseFolderNameTemplate parses and test-renders a folder name template so
+// mistakes are reported at startup rather than on the first upload.
+func parseFolderNameTemplate(text string) (*template.Template, error) {
+	tmpl, err := template.New("folderName").Option("missingkey=error").Parse(text)
+	if err != nil {
+		return nil, err
+	}
+	if err := tmpl.Execute(io.Discard, FolderNameData{}); err != nil {
+		return nil, err
+	}
+	return tmpl, nil
+}
+
+// createFolderName creates a folder name with timestamp, email, and phone (no filename),
+// or renders FOLDER_NAME_TEMPLATE when configured
+func createFolderName(email, phone, dataOrigin string) string {
+	now := time.Now()
+	timestamp := now.Unix()
+
+	sanitizedEmail := folderIdentifier(sanitizeEmailForFolder(email))
+
+	// Sanitize phone for folder name (remove spaces, dashes, parentheses)
+	sanitizedPhone := strings.ReplaceAll(phone, " ", "")
+	sanitizedPhone = strings.ReplaceAll(sanitizedPhone, "-", "")
+	sanitizedPhone = strings.ReplaceAll(sanitizedPhone, "(", "")
+	sanitizedPhone = strings.ReplaceAll(sanitizedPhone, ")", "")
+	sanitizedPhone = strings.ReplaceAll(sanitizedPhone, "+", "plus")
+	sanitizedPhone = folderIdentifier(sanitizedPhone)
+
+	if folderNameTemplate != nil {
+		var buffer bytes.Buffer
+		err := folderNameTemplate.Execute(&buffer, FolderNameData{
+			Timestamp:  timestamp,
+			Date:       now.UTC().Format("2006-01-02"),
+			Email:      sanitizedEmail,
+			Phone:      sanitizedPhone,
+			DataOrigin: dataOrigin,
+		})
+		if name := sanitizeFolderName(buffer.String()); err == nil && name != "" {
+			return name
+		}
+		slog.Error("Could not render folder name template, using default format", "error", err)
+	}
+
+	// Build folder name components
+	components := []string{fmt.Sprintf("%d", timestamp)}
+
+	// Add email if provided
+	if email != "" {
+		components = append(components, sanitizedEmail)
+	}
+
+	// Add phone if provided
+	if phone != "" {
+		components = append(components, sanitizedPhone)
+	}
+
+	return sanitizeFolderName(strings.Join(components, "-"))
+}
+
+// dataOriginCategory returns the sanitized category folder configured for a
+// dataOrigin in DATA_ORIGIN_CATEGORIES, or "" if it is uncategorized.
+func dataOriginCategory(dataOrigin string) string {
+	dataOrigin = strings.TrimSpace(dataOrigin)
+	for origin, category := range appConfig.DataOriginCategories {
+		if strings.EqualFold(origin, dataOrigin) {
+			return sanitizeFolderName(category)
+		}
+	}
+	return ""
+}
+
+// sanitizeEmailForFolder turns an email address into the fragment used in folder names
+func sanitizeEmailForFolder(email string) string {
+	// Sanitize email for folder name (remove @ and replace with _en_)
+	sanitizedEmail := strings.ReplaceAll(email, "@", "_en_")
+	return strings.ReplaceAll(sanitizedEmail, ".", "_")
+}
+
+// folderIdentifier returns the form of an email or phone fragment used in
+// folder names: the fragment itself, or with HASH_FOLDER_IDENTIFIERS a salted
+// hash of it, so directory listings do not reveal who uploaded. The readable
+// values are still written to the description file.
+func folderIdentifier(fragment string) string {
+	if !appConfig.HashFolderIdentifiers || fragment == "" {
+		return fragment
+	}
+	mac := hmac.New(sha256.New, []byte(appConfig.FolderIdentifierSalt))
+	mac.Write([]byte(fragment))
+	return hex.EncodeToString(mac.Sum(nil))[:16]
+}
+
+// sanitizeFolderName replaces characters that are not safe in a single WebDAV path
+// segment (separators, wildcards, control characters) and trims leading/trailing dots and spaces.
+func sanitizeFolderName(name string) string {
+	name = strings.Map(func(r rune) rune {
+		if r < 0x20 || r == 0x7f || strings.ContainsRune(`/\:*?"<>|`, r) {
+			return '_'
+		}
+		return r
+	}, name)
+	return strings.Trim(name, " .")
+}
+
+// DescriptionData holds the values available to DESCRIPTION_TEMPLATE_FILE
+type DescriptionData struct {
+	Timestamp  string // Upload time in UTC, RFC 3339
+	Email      string
+	Phone      string
+	DataOrigin string
+}
+
+// descriptionTemplate is the parsed DESCRIPTION_TEMPLATE_FILE, nil for the default content
+var descriptionTemplate *template.Template
+
+// createDescriptionContent creates the content for the description file
+func createDescriptionContent(email, phone, dataOrigin string) string {
+	var buffer bytes.Buffer
+	if descriptionTemplate != nil {
+		err := descriptionTemplate.Execute(&buffer, DescriptionData{
+			Timestamp:  time.Now().UTC().Format(time.RFC3339),
+			Email:      email,
+			Phone:      phone,
+			DataOrigin: dataOrigin,
+		})
+		if err == nil {
+			return buffer.String()
+		}
+		slog.Error("Could not render description template, using default content", "error", err)
+		buffer.Reset()
+	}
+
+	buffer.WriteString("--- UPLOAD INFORMATION ---\n")
+	buffer.WriteString(fmt.Sprintf("Timestamp (UTC): %s\n", time.Now().UTC().Format(time.RFC3339)))
+	buffer.WriteString(fmt.Sprintf("Email: %s\n", email))
+	if phone != "" {
+		buffer.WriteString(fmt.Sprintf("Teléfono: %s\n", phone))
+	}
+	buffer.WriteString("\n--- DESCRIPCIÓN ---\n")
 	buffer.WriteString(dataOrigin)
 	buffer.WriteString("\n\n--- FIN ---\n")
 	return buffer.String()
 }
 
+// Formats for METADATA_FORMAT
+const (
+	metadataFormatText = "text"
+	metadataFormatJSON = "json"
+)
+
+// metadataFilename is the name of the metadata file with METADATA_FORMAT=json
+const metadataFilename = "metadata.json"
+
+// descriptionFileName returns the name of the metadata file written to each folder
+func descriptionFileName() string {
+	if appConfig.MetadataFormat == metadataFormatJSON {
+		return metadataFilename
+	}
+	return appConfig.DescriptionFilename
+}
+
+// UploadMetadata is the content of metadata.json, a machine readable
+// alternative to the description text file
+type UploadMetadata struct {
+	Timestamp  string        `json:"timestamp"` // Upload time in UTC, RFC 3339
+	Email      string        `json:"email"`
+	Phone      string        `json:"phone,omitempty"`
+	DataOrigin string        `json:"dataOrigin"`
+	Files      []SessionFile `json:"files"`
+}
+
+// createMetadataContent creates the content of metadata.json
+func createMetadataContent(email, phone, dataOrigin string, files []SessionFile) (string, error) {
+	data, err := json.MarshalIndent(UploadMetadata{
+		Timestamp:  time.Now().UTC().Format(time.RFC3339),
+		Email:      email,
+		Phone:      phone,
+		DataOrigin: dataOrigin,
+		Files:      files,
+	}, "", "  ")
+	if err != nil {
+		return "", fmt.Errorf("could not encode metadata: %w", err)
+	}
+	return string(data) + "\n", nil
+}
+
+// manifestFilename is the name of the manifest written with WRITE_MANIFEST
+const manifestFilename = "manifest.json"
+
+// UploadManifest is the content of manifest.json, which lets archivists check
+// that a folder still holds exactly the files that were uploaded
+type UploadManifest struct {
+	Timestamp string        `json:"timestamp"` // Completion time in UTC, RFC 3339
+	Files     []SessionFile `json:"files"`
+}
+
+// uploadManifest writes manifest.json listing files into the folder,
+// replacing the manifest of an earlier session in the same folder
+func uploadManifest(ctx context.Context, backend UploadBackend, folderName string, files []SessionFile) error {
+	data, err := json.MarshalIndent(UploadManifest{
+		Timestamp: time.Now().UTC().Format(time.RFC3339),
+		Files:     files,
+	}, "", "  ")
+	if err != nil {
+		return fmt.Errorf("could not encode manifest: %w", err)
+	}
+	return backend.PutFile(ctx, folderName, manifestFilename, bytes.NewReader(append(data, '\n')))
+}
+
 // getEnv is a helper to read an env var or return a default.
 func getEnv(key, fallback string) string {
 	if value, ok := os.LookupEnv(key); ok {
@@ -417,62 +2032,637 @@ func getEnv(key, fallback string) string {
 	return fallback
 }
 
-// checkAndUpdateSession checks if all files in a session are complete and updates the session
-func checkAndUpdateSession(sessionID, folderName, email, phone, dataOrigin string) bool {
-	sessionsMutex.Lock()
-	defer sessionsMutex.Unlock()
+// getEnvList is a helper to read a comma-separated env var or return a default.
+func getEnvList(key string, fallback []string) []string {
+	value, ok := os.LookupEnv(key)
+	if !ok || value == "" {
+		return fallback
+	}
+	var list []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+// getEnvMap is a helper to read a comma-separated list of key=value pairs or return a default.
+func getEnvMap(key string, fallback map[string]string) map[string]string {
+	value, ok := os.LookupEnv(key)
+	if !ok || value == "" {
+		return fallback
+	}
+	pairs := make(map[string]string)
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item == "" {
+			continue
+		}
+		k, v, found := strings.Cut(item, "=")
+		if !found {
+			fatal("Environment variable must be a list of key=value pairs", "key", key, "item", item)
+		}
+		pairs[strings.TrimSpace(k)] = strings.TrimSpace(v)
+	}
+	return pairs
+}
 
-	session, exists := uploadSessions[sessionID]
-	if !exists {
-		log.Printf("WARNING: Session %s not found, treating as single file upload", sessionID)
-		return true
+// getEnvHeaders parses a comma separated list of Key:Value HTTP headers
+func getEnvHeaders(key string, fallback map[string]string) map[string]string {
+	value, ok := os.LookupEnv(key)
+	if !ok || value == "" {
+		return fallback
+	}
+	headers := make(map[string]string)
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item == "" {
+			continue
+		}
+		k, v, found := strings.Cut(item, ":")
+		if !found || strings.TrimSpace(k) == "" {
+			fatal("Environment variable must be a list of Key:Value headers", "key", key, "item", item)
+		}
+		headers[strings.TrimSpace(k)] = strings.TrimSpace(v)
+	}
+	return headers
+}
+
+// getEnvSizeLimits parses a comma separated list of type:size limits, like
+// "jpg:10MB,video/:2GB,default:50MB"
+func getEnvSizeLimits(key string, fallback map[string]string) map[string]string {
+	value, ok := os.LookupEnv(key)
+	if !ok || value == "" {
+		return fallback
+	}
+	limits := make(map[string]string)
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item == "" {
+			continue
+		}
+		k, v, found := strings.Cut(item, ":")
+		if !found || strings.TrimSpace(k) == "" {
+			fatal("Environment variable must be a list of type:size limits", "key", key, "item", item)
+		}
+		limits[strings.TrimSpace(k)] = strings.TrimSpace(v)
+	}
+	return limits
+}
+
+// getEnvFloat is a helper to read a floating point env var or return a default.
+func getEnvFloat(key string, fallback float64) float64 {
+	value, ok := os.LookupEnv(key)
+	if !ok || value == "" {
+		return fallback
+	}
+	parsed, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		fatal("Environment variable must be a number", "key", key, "error", err)
+	}
+	return parsed
+}
+
+// getEnvBool is a helper to read a boolean env var (e.g. "true", "1") or return a default.
+func getEnvBool(key string, fallback bool) bool {
+	value, ok := os.LookupEnv(key)
+	if !ok || value == "" {
+		return fallback
+	}
+	parsed, err := strconv.ParseBool(value)
+	if err != nil {
+		fatal("Environment variable must be a boolean", "key", key, "error", err)
+	}
+	return parsed
+}
+
+// getEnvInt64 is a helper to read an integer env var or return a default.
+func getEnvInt64(key string, fallback int64) int64 {
+	value, ok := os.LookupEnv(key)
+	if !ok || value == "" {
+		return fallback
+	}
+	parsed, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		fatal("Environment variable must be an integer", "key", key, "error", err)
+	}
+	return parsed
+}
+
+// getEnvDuration is a helper to read a duration env var (e.g. "30m") or return a default.
+func getEnvDuration(key string, fallback time.Duration) time.Duration {
+	value, ok := os.LookupEnv(key)
+	if !ok || value == "" {
+		return fallback
+	}
+	parsed, err := time.ParseDuration(value)
+	if err != nil {
+		fatal("Environment variable must be a duration", "key", key, "error", err)
+	}
+	return parsed
+}
+
+// sweepStaleSessions periodically removes sessions and chunk directories older than ttl.
+// A non-positive ttl disables the sweeper.
+func sweepStaleSessions(ttl time.Duration) {
+	if ttl <= 0 {
+		return
+	}
+	interval := 5 * time.Minute
+	if ttl < interval {
+		interval = ttl
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		cutoff := time.Now().Add(-ttl)
+
+		// Shared stores like Redis expire sessions on their own
+		if store, ok := sessionStore.(*memorySessionStore); ok {
+			for _, sessionID := range store.deleteOlderThan(cutoff) {
+				slog.Info("Expired stale upload session", "sessionId", sessionID)
+			}
+		}
+
+		// Chunk directories are not linked to sessions, so expire them by modification time
+		removeStaleChunkDirs(cutoff)
+		removeStaleRangeUploads(cutoff)
+		removeStaleStreamTransfers(cutoff)
+	}
+}
+
+// removeStaleChunkDirs removes chunk directories in the temp directory last
+// modified before cutoff and returns how many were removed.
+func removeStaleChunkDirs(cutoff time.Time) int {
+	entries, err := os.ReadDir(appConfig.UploadTempDir)
+	if err != nil {
+		slog.Error("Could not read temporary upload directory", "error", err)
+		return 0
+	}
+	removed := 0
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil || !info.ModTime().Before(cutoff) {
+			continue
+		}
+		path := filepath.Join(appConfig.UploadTempDir, entry.Name())
+		if err := os.RemoveAll(path); err != nil {
+			slog.Error("Could not remove stale chunk directory", "path", path, "error", err)
+			continue
+		}
+		slog.Info("Removed stale chunk directory", "path", path)
+		removed++
+	}
+	return removed
+}
+
+// sessionFolderName returns the folder chosen when the session registered, or
+// "" if there is none or the session is unknown
+func sessionFolderName(ctx context.Context, sessionID string) string {
+	if sessionID == "" {
+		return ""
+	}
+	session, err := sessionStore.Get(ctx, sessionID)
+	if err != nil {
+		return ""
+	}
+	return session.FolderName
+}
+
+// sessionDeadline returns the deadline of a session created at createdAt, zero without SESSION_MAX_DURATION
+func sessionDeadline(createdAt time.Time) time.Time {
+	if appConfig.SessionMaxDuration <= 0 {
+		return time.Time{}
+	}
+	return createdAt.Add(appConfig.SessionMaxDuration)
+}
+
+// sessionExpired reports whether sessionID names a session past its deadline.
+// Unknown sessions are not expired; they are handled like uploads without one.
+func sessionExpired(ctx context.Context, sessionID string) bool {
+	if sessionID == "" {
+		return false
+	}
+	session, err := sessionStore.Get(ctx, sessionID)
+	if err != nil {
+		return false
+	}
+	return !session.Deadline.IsZero() && time.Now().After(session.Deadline)
+}
+
+// rejectExpiredSession discards the chunks of an upload belonging to an
+// expired session and responds with 410 Gone. The session itself stays until
+// the sweeper removes it, so later requests keep being refused.
+func rejectExpiredSession(w http.ResponseWriter, logger *slog.Logger, uploadID string) {
+	if err := chunkStore.Remove(uploadID); err != nil {
+		logger.Error("Could not remove chunks of expired session", "error", err)
+	}
+	jsonErrorCode(w, errCodeSessionExpired, "Upload session expired, please start a new upload.", http.StatusGone)
+}
+
+// checkAndUpdateSession records file as completed in the session and reports
+// whether it was the last one, along with all files the session completed
+func checkAndUpdateSession(ctx context.Context, sessionID string, file SessionFile, folderName, shareURL, email, phone, dataOrigin string) (bool, []SessionFile) {
+	logger := loggerFrom(ctx).With("sessionId", sessionID)
+
+	session, err := sessionStore.IncrementCompleted(ctx, sessionID, file)
+	if errors.Is(err, errSessionNotFound) {
+		logger.Warn("Session not found, treating as single file upload")
+		return true, []SessionFile{file}
+	}
+	if err != nil {
+		logger.Error("Could not update session, treating as single file upload", "error", err)
+		return true, []SessionFile{file}
 	}
 
-	session.Mutex.Lock()
-	defer session.Mutex.Unlock()
+	logger.Info("Session file completed", "completedCount", session.CompletedCount, "uploadCount", session.UploadCount)
 
-	session.CompletedCount++
-	log.Printf("INFO: Session %s: %d/%d files completed", sessionID, session.CompletedCount, session.UploadCount)
+	// Completions beyond the declared count come from a misbehaving client; the
+	// session was already finished by the completion that reached the count
+	if session.CompletedCount > session.UploadCount {
+		logger.Warn("More files completed than declared for session", "completedCount", session.CompletedCount, "uploadCount", session.UploadCount)
+		return false, nil
+	}
 
-	if session.CompletedCount >= session.UploadCount {
+	if session.CompletedCount == session.UploadCount {
 		// All files completed - upload description file and clean up session
-		log.Printf("INFO: All files completed for session %s, uploading description file", sessionID)
-		delete(uploadSessions, sessionID)
-		return true
+		logger.Info("All files completed for session, uploading description file")
+		if err := sessionStore.Delete(ctx, sessionID); err != nil {
+			logger.Error("Could not delete completed session", "error", err)
+		}
+		notifySessionComplete(logger, sessionNotification{
+			SessionID:  sessionID,
+			FolderName: folderName,
+			ShareURL:   shareURL,
+			Email:      email,
+			Phone:      phone,
+			FileCount:  session.UploadCount,
+		})
+		return true, session.Files
 	}
 
 	// Not all files completed yet
-	return false
+	return false, nil
 }
 
-// checkDescriptionFileExists checks if a description file already exists in the folder
-func checkDescriptionFileExists(folderName string) bool {
-	webdavURL := fmt.Sprintf(
-		"%s/remote.php/dav/files/%s/%s/%s/descripcion.txt",
-		appConfig.NextcloudURL,
-		appConfig.NextcloudUser,
-		appConfig.NextcloudUploadDir,
-		url.PathEscape(folderName),
-	)
+// maxListedChunkIndices bounds how many missing chunks an error message names
+const maxListedChunkIndices = 20
+
+// missingChunkIndices returns the indices absent from the numerically sorted
+// chunk names, which must form the sequence 0..N-1
+func missingChunkIndices(sortedNames []string) []int {
+	var missing []int
+	next := 0
+	for _, name := range sortedNames {
+		index, _ := strconv.Atoi(name)
+		for ; next < index; next++ {
+			missing = append(missing, next)
+		}
+		next = index + 1
+	}
+	return missing
+}
+
+// formatChunkIndices lists chunk indices for an error message, shortening long lists
+func formatChunkIndices(indices []int) string {
+	var parts []string
+	for _, index := range indices[:min(len(indices), maxListedChunkIndices)] {
+		parts = append(parts, strconv.Itoa(index))
+	}
+	if len(indices) > maxListedChunkIndices {
+		parts = append(parts, fmt.Sprintf("and %d more", len(indices)-maxListedChunkIndices))
+	}
+	return strings.Join(parts, ", ")
+}
+
+// waitForChunks lists the chunks of an upload, polling up to
+// ChunkWaitAttempts more times while the upload has no chunks yet or fewer
+// than wantChunks (when the client declared a count). Whatever is there when
+// the attempts run out is returned for the caller to judge.
+func waitForChunks(ctx context.Context, uploadID string, wantChunks int) ([]string, error) {
+	for attempt := 0; ; attempt++ {
+		chunkNames, err := chunkStore.ListChunks(uploadID)
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return nil, err
+		}
+		complete := len(chunkNames) > 0 && len(chunkNames) >= wantChunks
+		if complete || attempt >= appConfig.ChunkWaitAttempts {
+			if err != nil {
+				return nil, err
+			}
+			return chunkNames, nil
+		}
+		select {
+		case <-time.After(appConfig.ChunkWaitInterval):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
 
-	req, err := http.NewRequest("HEAD", webdavURL, nil)
+// uploadThumbnail reads the assembled image from chunks and uploads its
+// thumbnail next to the original. Files that are not images are skipped.
+func uploadThumbnail(ctx context.Context, logger *slog.Logger, backend UploadBackend, folderName, filename string, chunks io.ReadCloser) {
+	defer chunks.Close()
+	thumb, err := generateThumbnail(chunks, appConfig.ThumbnailMaxPixels)
+	if errors.Is(err, errNotThumbnailable) {
+		return
+	}
 	if err != nil {
-		return false
+		logger.Warn("Could not generate thumbnail", "fileName", filename, "error", err)
+		return
+	}
+	if err := backend.PutFile(ctx, folderName, thumbnailPrefix+filename, bytes.NewReader(thumb)); err != nil {
+		logger.Error("Failed to upload thumbnail", "fileName", filename, "error", err)
+		return
+	}
+	logger.Info("Uploaded thumbnail", "fileName", thumbnailPrefix+filename)
+}
+
+// descriptionLocks serializes description uploads per Nextcloud folder
+var descriptionLocks = newKeyedMutex()
+
+// uploadDescription uploads the description file, or metadata.json with
+// METADATA_FORMAT=json, to folderName unless it is already there. Within a
+// session only the completion that reaches the file count gets here, but
+// uploads without a tracked session can finish concurrently for the same
+// folder, so the existence check and the upload run under a per-folder lock.
+func uploadDescription(ctx context.Context, logger *slog.Logger, backend UploadBackend, folderName, email, phone, dataOrigin string, files []SessionFile) error {
+	// Same-named folders of different targets merely share a lock
+	unlock := descriptionLocks.lock(folderName)
+	defer unlock()
+
+	descriptionContent := createDescriptionContent(email, phone, dataOrigin)
+	if appConfig.MetadataFormat == metadataFormatJSON {
+		var err error
+		if descriptionContent, err = createMetadataContent(email, phone, dataOrigin, files); err != nil {
+			return err
+		}
+	}
+	// A conditional create instead of checking first, so completions running
+	// on other replicas cannot both write the file
+	err := backend.CreateFile(ctx, folderName, descriptionFileName(), strings.NewReader(descriptionContent))
+	if errors.Is(err, errFileExists) {
+		logger.Info("Description file already exists")
+		return nil
 	}
-	req.SetBasicAuth(appConfig.NextcloudUser, appConfig.NextcloudAppPass)
-	client := &http.Client{Timeout: 10 * time.Second}
-	resp, err := client.Do(req)
 	if err != nil {
+		return err
+	}
+	logger.Info("Uploaded description file")
+	return nil
+}
+
+// chunkWrites counts the chunk and range writes in progress per upload
+var chunkWrites = newInFlightCounter()
+
+// acquireChunkWrite claims one of the MAX_CONCURRENT_CHUNKS write slots of an
+// upload. If all are taken it answers 429, so one client sending hundreds of
+// parallel chunks for a single file cannot monopolize the disk, and returns
+// false. Other uploads are not affected.
+func acquireChunkWrite(w http.ResponseWriter, logger *slog.Logger, uploadID string) (release func(), ok bool) {
+	if appConfig.MaxConcurrentChunks <= 0 {
+		return func() {}, true
+	}
+	release, ok = chunkWrites.acquire(uploadID, appConfig.MaxConcurrentChunks)
+	if !ok {
+		logger.Warn("Too many concurrent chunks for upload", "maxConcurrentChunks", appConfig.MaxConcurrentChunks)
+		w.Header().Set("Retry-After", "1")
+		jsonErrorCode(w, errCodeServerBusy, "Too many chunks of this upload in progress, please retry later.", http.StatusTooManyRequests)
+	}
+	return release, ok
+}
+
+// inFlightCounter counts operations in progress per key and forgets idle keys
+type inFlightCounter struct {
+	mu     sync.Mutex
+	counts map[string]int
+}
+
+func newInFlightCounter() *inFlightCounter {
+	return &inFlightCounter{counts: make(map[string]int)}
+}
+
+// acquire starts an operation for key unless limit operations are already in
+// progress, and returns the function that ends it
+func (c *inFlightCounter) acquire(key string, limit int) (release func(), ok bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.counts[key] >= limit {
+		return nil, false
+	}
+	c.counts[key]++
+	return func() {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		if c.counts[key]--; c.counts[key] == 0 {
+			delete(c.counts, key)
+		}
+	}, true
+}
+
+// keyedMutex hands out one mutex per key and forgets keys nobody holds
+type keyedMutex struct {
+	mu    sync.Mutex
+	locks map[string]*keyedMutexEntry
+}
+
+type keyedMutexEntry struct {
+	sync.Mutex
+	refs int
+}
+
+func newKeyedMutex() *keyedMutex {
+	return &keyedMutex{locks: make(map[string]*keyedMutexEntry)}
+}
+
+// lock acquires the mutex for key and returns the function that releases it
+func (k *keyedMutex) lock(key string) (unlock func()) {
+	k.mu.Lock()
+	entry, ok := k.locks[key]
+	if !ok {
+		entry = &keyedMutexEntry{}
+		k.locks[key] = entry
+	}
+	entry.refs++
+	k.mu.Unlock()
+
+	entry.Lock()
+	return func() {
+		entry.Unlock()
+		k.mu.Lock()
+		if entry.refs--; entry.refs == 0 {
+			delete(k.locks, key)
+		}
+		k.mu.Unlock()
+	}
+}
+
+// finalizeFolder renames a complete folder from the pending to the complete
+// prefix and returns its new name. If the name is taken, a number is appended.
+// Failing to rename is logged and leaves the folder under its pending name.
+func finalizeFolder(ctx context.Context, logger *slog.Logger, nc *NextcloudClient, folderName string) string {
+	parent, base := path.Split(folderName)
+	target := parent + appConfig.CompleteFolderPrefix + strings.TrimPrefix(base, appConfig.PendingFolderPrefix)
+	for i := 1; i <= 100; i++ {
+		candidate := target
+		if i > 1 {
+			candidate = fmt.Sprintf("%s (%d)", target, i)
+		}
+		err := nc.MoveFolder(ctx, folderName, candidate)
+		if errors.Is(err, errDestinationExists) {
+			continue
+		}
+		if err != nil {
+			logger.Error("Failed to rename completed folder", "to", candidate, "error", err)
+			return folderName
+		}
+		logger.Info("Renamed completed folder", "to", candidate)
+		return candidate
+	}
+	logger.Error("Failed to rename completed folder: no free name", "to", target)
+	return folderName
+}
+
+// abortedByClient reports whether the request failed because the client
+// disconnected, which cancels its context and with it the Nextcloud requests.
+// Such aborts are logged and counted apart from failures, and need no response.
+func abortedByClient(r *http.Request, logger *slog.Logger) bool {
+	if !errors.Is(r.Context().Err(), context.Canceled) {
 		return false
 	}
-	defer resp.Body.Close()
+	logger.Warn("Upload aborted by client, cancelled Nextcloud upload")
+	uploadsAbortedTotal.Inc()
+	return true
+}
+
+// rollbackUpload deletes a file that was uploaded before a later step of the
+// upload failed, so the failed attempt leaves no partial data in Nextcloud.
+// It is best effort: a failed rollback is logged and the original error stands.
+func rollbackUpload(ctx context.Context, logger *slog.Logger, backend UploadBackend, folderName, filename string) {
+	// Roll back even when the request was cancelled, or its partial upload stays behind
+	if err := backend.DeleteFile(context.WithoutCancel(ctx), folderName, filename); err != nil {
+		logger.Error("Could not roll back uploaded file", "folderName", folderName, "fileName", filename, "error", err)
+		return
+	}
+	logger.Info("Rolled back uploaded file", "folderName", folderName, "fileName", filename)
+}
+
+// maxDedupAttempts bounds the number of " (n)" suffixes tried for a single file
+const maxDedupAttempts = 100
+
+// Policies for ON_CONFLICT
+const (
+	conflictOverwrite = "overwrite" // Replace the existing file
+	conflictSkip      = "skip"      // Keep the existing file and report success
+	conflictRename    = "rename"    // Upload under a free " (n)" name
+)
+
+// conflictPolicy returns the ON_CONFLICT policy. Without one, DEDUP_FILENAMES
+// still selects rename as it did before the policy existed.
+func conflictPolicy() string {
+	if appConfig.OnConflict != "" {
+		return appConfig.OnConflict
+	}
+	if appConfig.DedupFilenames {
+		return conflictRename
+	}
+	return conflictOverwrite
+}
+
+// dedupFileName returns filename, or the first "name (n).ext" variant that does not
+// exist yet in the folder, so existing files are never overwritten.
+func dedupFileName(ctx context.Context, backend UploadBackend, folderName, filename string) (string, error) {
+	if !backend.FileExists(ctx, folderName, filename) {
+		return filename, nil
+	}
+	extension := filepath.Ext(filename)
+	stem := strings.TrimSuffix(filename, extension)
+	for n := 1; n <= maxDedupAttempts; n++ {
+		candidate := fmt.Sprintf("%s (%d)%s", stem, n, extension)
+		if !backend.FileExists(ctx, folderName, candidate) {
+			return candidate, nil
+		}
+	}
+	return "", fmt.Errorf("no free file name found for %s after %d attempts", filename, maxDedupAttempts)
+}
+
+// Error codes returned in the "code" field of JSON error responses from
+// /upload-chunk and /upload-complete. Clients can rely on these values to
+// choose what to show; the "error" field is a human-readable message.
+const (
+	errCodeInvalidInput        = "invalid-input"        // Malformed request, upload ID, file name or path
+	errCodeUnauthorized        = "unauthorized"         // UPLOAD_TOKEN is set and the request didn't carry it
+	errCodeChunkMissing        = "chunk-missing"        // Chunks not found on the server or the assembled size doesn't match
+	errCodeChecksumMismatch    = "checksum-mismatch"    // Data doesn't match the hash sent by the client
+	errCodeTooLarge            = "too-large"            // A size limit was exceeded
+	errCodeUnsupportedType     = "unsupported-type"     // File type not in the allowlist
+	errCodeMalwareDetected     = "malware-detected"     // The virus scanner flagged the file
+	errCodeScanUnavailable     = "scan-unavailable"     // The virus scanner could not be reached
+	errCodeServerBusy          = "server-busy"          // Too many concurrent uploads, retry later
+	errCodeInsufficientStorage = "insufficient-storage" // The temp directory is running out of space, retry later
+	errCodeNextcloudDown       = "nextcloud-down"       // Nextcloud rejected the request or is unreachable
+	errCodeQuotaExceeded       = "quota-exceeded"       // The Nextcloud account is out of storage
+	errCodeServerError         = "server-error"         // Unexpected local failure
+	errCodeSessionExpired      = "session-expired"      // The session is past SESSION_MAX_DURATION
+)
 
-	return resp.StatusCode == http.StatusOK
+// decodeJSONBody decodes a size-limited JSON request body into dst, rejecting
+// unknown fields so typos don't go unnoticed. On failure it writes the error
+// response and returns false.
+func decodeJSONBody(w http.ResponseWriter, r *http.Request, dst any) bool {
+	r.Body = http.MaxBytesReader(w, r.Body, appConfig.MaxJSONBodyBytes)
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(dst); err != nil {
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			jsonErrorCode(w, errCodeTooLarge, fmt.Sprintf("Request body too large: maximum size is %d bytes.", appConfig.MaxJSONBodyBytes), http.StatusRequestEntityTooLarge)
+			return false
+		}
+		jsonErrorCode(w, errCodeInvalidInput, fmt.Sprintf("Invalid JSON body: %v.", err), http.StatusBadRequest)
+		return false
+	}
+	return true
 }
 
 // jsonError is a helper to return a JSON error response.
 func jsonError(w http.ResponseWriter, message string, statusCode int) {
+	jsonErrorCode(w, "", message, statusCode)
+}
+
+// jsonErrorCode returns a JSON error response carrying a machine-readable error code.
+func jsonErrorCode(w http.ResponseWriter, code, message string, statusCode int) {
+	body := map[string]string{"error": message}
+	if code != "" {
+		body["code"] = code
+	}
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(statusCode)
-	json.NewEncoder(w).Encode(map[string]string{"error": message})
+	json.NewEncoder(w).Encode(body)
+}
+
+// nextcloudError returns the error response for a failed backend operation:
+// 503 with Retry-After while the circuit breaker is open, 507 when the quota
+// is exceeded and otherwise a 500 with message
+func nextcloudError(w http.ResponseWriter, backend UploadBackend, err error, message string) (code, msg string, status int) {
+	switch {
+	case errors.Is(err, errCircuitOpen):
+		var wait time.Duration
+		if nc, ok := backend.(*NextcloudClient); ok {
+			wait = nc.Breaker.retryAfter()
+		}
+		w.Header().Set("Retry-After", retryAfterSeconds(wait))
+		return errCodeNextcloudDown, "Nextcloud is unavailable, please retry later.", http.StatusServiceUnavailable
+	case errors.Is(err, errQuotaExceeded):
+		return errCodeQuotaExceeded, "Storage quota exceeded.", http.StatusInsufficientStorage
+	}
+	return errCodeNextcloudDown, message, http.StatusInternalServerError
+}
+
+// retryAfterSeconds formats wait for a Retry-After header, rounding up to at least one second
+func retryAfterSeconds(wait time.Duration) string {
+	return strconv.Itoa(int(wait.Seconds()) + 1)
 }
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Prometheus metrics exposed on /metrics
+var (
+	chunksReceivedTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "uploader_chunks_received_total",
+		Help: "Number of file chunks successfully stored.",
+	})
+	uploadsCompletedTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "uploader_uploads_completed_total",
+		Help: "Number of files successfully uploaded to Nextcloud.",
+	})
+	uploadsAbortedTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "uploader_uploads_aborted_total",
+		Help: "Number of uploads given up because the client disconnected.",
+	})
+	uploadFailuresTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "uploader_upload_failures_total",
+		Help: "Number of failed uploads by stage.",
+	}, []string{"stage"})
+	uploadedFileSizeBytes = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "uploader_uploaded_file_size_bytes",
+		Help:    "Size of assembled files uploaded to Nextcloud.",
+		Buckets: prometheus.ExponentialBuckets(1<<10, 4, 12), // 1KB .. 4TB
+	})
+	webhookFailuresTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "uploader_webhook_failures_total",
+		Help: "Number of webhook deliveries that failed.",
+	})
+	nextcloudRequestsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "uploader_nextcloud_requests_total",
+		Help: "Number of WebDAV requests issued to Nextcloud by operation and result.",
+	}, []string{"operation", "result"})
+	activeSessions = promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "uploader_active_sessions",
+		Help: "Number of upload sessions currently registered.",
+	}, countActiveSessions)
+)
+
+// Upload failure stages used as the "stage" label of uploadFailuresTotal
+const (
+	stageFolderCreate = "folder-create"
+	stageFileUpload   = "file-upload"
+	stageDescription  = "description"
+	stageVirusScan    = "virus-scan"
+	stageIntegrity    = "integrity"
+	stageManifest     = "manifest"
+)
+
+// observeNextcloudRequest records the outcome of a Nextcloud WebDAV request
+func observeNextcloudRequest(operation string, err error) {
+	result := "success"
+	if err != nil {
+		result = "error"
+	}
+	nextcloudRequestsTotal.WithLabelValues(operation, result).Inc()
+}
+
+// countActiveSessions reports the size of the session store, or 0 before it is set up
+func countActiveSessions() float64 {
+	if sessionStore == nil {
+		return 0
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	count, err := sessionStore.Count(ctx)
+	if err != nil {
+		return 0
+	}
+	return float64(count)
+}
@@ -0,0 +1,822 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"path"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// NextcloudClient talks to a Nextcloud server over WebDAV and the OCS API.
+// HTTPClient can be replaced, e.g. to point tests at an httptest.Server;
+// per-operation timeouts are applied through each request's context.
+type NextcloudClient struct {
+	BaseURL    string // Server URL without trailing slash
+	User       string // Read through credentials, as it can be rotated with SetCredentials
+	AppPass    string
+	UploadDir  string // Base folder for uploads, relative to the user's files
+	DryRun     bool   // Log requests instead of sending them
+	HTTPClient *http.Client
+
+	MkcolTimeout  time.Duration // Timeout for creating folders
+	UploadTimeout time.Duration // Timeout for uploading a file or chunk and assembling chunks
+	HeadTimeout   time.Duration // Timeout for checking whether a file exists
+
+	Chunked        bool            // Use the chunked upload API in PutFile
+	ResumeAttempts int             // Times a failed chunk of a chunked upload is resumed before giving up
+	Breaker        *circuitBreaker // Fails requests fast while Nextcloud is down, nil to disable
+	Headers        http.Header     // Extra headers sent with every request
+	Auth           nextcloudAuth   // Authenticates requests, nil for basic auth with User and AppPass
+
+	mu sync.RWMutex // Guards User, AppPass and Auth
+}
+
+// nextcloudTargets holds the clients of the named targets from the config file
+var nextcloudTargets map[string]*NextcloudClient
+
+// newNextcloudTargets creates a client for each named target in cfg. Targets
+// share every setting except the account with the default client.
+func newNextcloudTargets(cfg Config) map[string]*NextcloudClient {
+	clients := make(map[string]*NextcloudClient, len(cfg.Targets))
+	for name, target := range cfg.Targets {
+		targetCfg := cfg
+		targetCfg.NextcloudURL = target.URL
+		targetCfg.NextcloudUser = target.User
+		targetCfg.NextcloudAppPass = target.AppPassword
+		targetCfg.NextcloudUploadDir = target.Folder
+		targetCfg.NextcloudAuthMode = authModeBasic // Targets are configured with app passwords
+		clients[name] = newNextcloudClient(targetCfg)
+	}
+	return clients
+}
+
+// nextcloudForSession returns the client of the target the session selected,
+// or the default client if it selected none. Unknown or expired sessions also
+// use the default client, as uploads without a session always have.
+func nextcloudForSession(ctx context.Context, sessionID string) (*NextcloudClient, error) {
+	if sessionID == "" || len(nextcloudTargets) == 0 {
+		return nextcloud, nil
+	}
+	session, err := sessionStore.Get(ctx, sessionID)
+	if errors.Is(err, errSessionNotFound) {
+		return nextcloud, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not read session: %w", err)
+	}
+	if session.Target == "" {
+		return nextcloud, nil
+	}
+	client, ok := nextcloudTargets[session.Target]
+	if !ok {
+		return nil, fmt.Errorf("session refers to unknown target %q", session.Target)
+	}
+	return client, nil
+}
+
+// errQuotaExceeded is returned when Nextcloud rejects an upload with 507 Insufficient Storage
+var errQuotaExceeded = errors.New("nextcloud storage quota exceeded")
+
+// errTransferExists is returned when the transfer directory of a chunked upload already exists
+var errTransferExists = errors.New("transfer already exists")
+
+// errDestinationExists is returned when a MOVE would replace an existing folder
+var errDestinationExists = errors.New("destination already exists")
+
+// nextcloud is the client used by the HTTP handlers
+var nextcloud *NextcloudClient
+
+// nextcloudHTTPClient is shared by all Nextcloud requests so connections are
+// kept alive and reused. Deadlines are set per request through the context.
+var nextcloudHTTPClient = &http.Client{Transport: newNextcloudTransport()}
+
+// newNextcloudTransport returns the default transport tuned for many requests to a single host
+func newNextcloudTransport() *http.Transport {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.MaxIdleConns = 100
+	transport.MaxIdleConnsPerHost = 32
+	transport.IdleConnTimeout = 90 * time.Second
+	return transport
+}
+
+// drainAndClose reads what is left of a small response body before closing it,
+// so the connection can be reused.
+func drainAndClose(body io.ReadCloser) {
+	io.Copy(io.Discard, io.LimitReader(body, 64<<10))
+	body.Close()
+}
+
+// newNextcloudClient creates a client for the Nextcloud server in cfg
+func newNextcloudClient(cfg Config) *NextcloudClient {
+	client := &NextcloudClient{
+		BaseURL:    cfg.NextcloudURL,
+		User:       cfg.NextcloudUser,
+		AppPass:    cfg.NextcloudAppPass,
+		UploadDir:  cfg.NextcloudUploadDir,
+		DryRun:     cfg.DryRun,
+		HTTPClient: nextcloudHTTPClient,
+
+		MkcolTimeout:  cfg.MkcolTimeout,
+		UploadTimeout: cfg.UploadTimeout,
+		HeadTimeout:   cfg.HeadTimeout,
+
+		Chunked:        cfg.ChunkedUpload || cfg.ResumeAttempts > 0,
+		ResumeAttempts: cfg.ResumeAttempts,
+		Breaker:        newCircuitBreaker(cfg.BreakerThreshold, cfg.BreakerCooldown),
+		Headers:        nextcloudHeaders(cfg.NextcloudHeaders),
+	}
+	client.Auth = newNextcloudAuth(cfg, client.credentials)
+	return client
+}
+
+// nextcloudHeaders converts configured headers to canonical form
+func nextcloudHeaders(headers map[string]string) http.Header {
+	if len(headers) == 0 {
+		return nil
+	}
+	h := make(http.Header, len(headers))
+	for key, value := range headers {
+		h.Set(key, value)
+	}
+	return h
+}
+
+// credentials returns the current user and app password
+func (c *NextcloudClient) credentials() (user, appPass string) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.User, c.AppPass
+}
+
+// SetCredentials replaces the user and app password used by subsequent requests
+func (c *NextcloudClient) SetCredentials(user, appPass string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.User = user
+	c.AppPass = appPass
+}
+
+// SetAuth replaces the authentication used by subsequent requests
+func (c *NextcloudClient) SetAuth(auth nextcloudAuth) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.Auth = auth
+}
+
+// newRequest creates an authenticated request
+func (c *NextcloudClient) newRequest(ctx context.Context, method, url string, body io.Reader) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, method, url, body)
+	if err != nil {
+		return nil, fmt.Errorf("could not create request: %w", err)
+	}
+	c.mu.RLock()
+	auth := c.Auth
+	c.mu.RUnlock()
+	if auth == nil {
+		auth = basicAuth(c.credentials)
+	}
+	if err := auth.authenticate(req); err != nil {
+		return nil, fmt.Errorf("could not authenticate request: %w", err)
+	}
+	for key, values := range c.Headers {
+		// Go sends req.Host, not a Host header, so the override goes there
+		if key == "Host" {
+			req.Host = values[0]
+			continue
+		}
+		req.Header.Set(key, values[0])
+	}
+	return req, nil
+}
+
+// folderURL returns the WebDAV URL of a folder inside the upload directory
+func (c *NextcloudClient) folderURL(folderName string) string {
+	user, _ := c.credentials()
+	return fmt.Sprintf(
+		"%s/remote.php/dav/files/%s/%s/%s",
+		c.BaseURL,
+		user,
+		c.UploadDir,
+		escapePath(folderName),
+	)
+}
+
+// fileURL returns the WebDAV URL of a file inside a folder of the upload directory
+func (c *NextcloudClient) fileURL(folderName, filename string) string {
+	return c.folderURL(folderName) + "/" + url.PathEscape(filename)
+}
+
+// CreateFolder creates a folder in Nextcloud using WebDAV MKCOL
+func (c *NextcloudClient) CreateFolder(ctx context.Context, folderName string) (err error) {
+	if c.DryRun {
+		slog.Info("DRY RUN: would create Nextcloud folder", "folderName", folderName)
+		return nil
+	}
+	defer func() { observeNextcloudRequest("mkcol", err) }()
+
+	ctx, cancel := context.WithTimeout(ctx, c.MkcolTimeout)
+	defer cancel()
+	req, err := c.newRequest(ctx, "MKCOL", c.folderURL(folderName), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := c.do(req)
+	if err != nil {
+		return fmt.Errorf("request execution failed: %w", err)
+	}
+	defer drainAndClose(resp.Body)
+
+	// MKCOL returns 201 for created, 405 for already exists, both are OK
+	if resp.StatusCode != http.StatusCreated && resp.StatusCode != http.StatusMethodNotAllowed {
+		body, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("bad response from Nextcloud: %s (body: %s)", resp.Status, string(body))
+	}
+	return nil
+}
+
+// UploadFile uploads a file to a specific folder in Nextcloud with a single PUT
+func (c *NextcloudClient) UploadFile(ctx context.Context, folderName, filename string, data io.Reader) error {
+	return c.uploadFile(ctx, folderName, filename, data, false)
+}
+
+// CreateFile uploads a file with a single conditional PUT that fails with
+// errFileExists instead of replacing an existing file. Nextcloud checks
+// If-None-Match atomically, so of several concurrent writers only one succeeds.
+func (c *NextcloudClient) CreateFile(ctx context.Context, folderName, filename string, data io.Reader) error {
+	return c.uploadFile(ctx, folderName, filename, data, true)
+}
+
+func (c *NextcloudClient) uploadFile(ctx context.Context, folderName, filename string, data io.Reader, onlyIfAbsent bool) (err error) {
+	if c.DryRun {
+		return dryRunUpload(folderName, filename, data)
+	}
+	defer func() { observeNextcloudRequest("put", err) }()
+
+	ctx, cancel := context.WithTimeout(ctx, c.UploadTimeout)
+	defer cancel()
+	req, err := c.newRequest(ctx, http.MethodPut, c.fileURL(folderName, filename), data)
+	if err != nil {
+		return err
+	}
+	if onlyIfAbsent {
+		req.Header.Set("If-None-Match", "*")
+	}
+	resp, err := c.do(req)
+	if err != nil {
+		return fmt.Errorf("request execution failed: %w", err)
+	}
+	defer drainAndClose(resp.Body)
+	if resp.StatusCode == http.StatusInsufficientStorage {
+		return errQuotaExceeded
+	}
+	if onlyIfAbsent && resp.StatusCode == http.StatusPreconditionFailed {
+		return errFileExists
+	}
+	if resp.StatusCode != http.StatusCreated && resp.StatusCode != http.StatusNoContent {
+		body, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("bad response from Nextcloud: %s (body: %s)", resp.Status, string(body))
+	}
+	return nil
+}
+
+// PutFile uploads a file with the chunked upload API or a single PUT, as configured
+func (c *NextcloudClient) PutFile(ctx context.Context, folderName, filename string, data io.Reader) error {
+	if c.Chunked {
+		return c.UploadFileChunked(ctx, folderName, filename, data)
+	}
+	return c.UploadFile(ctx, folderName, filename, data)
+}
+
+// dryRunUpload consumes data like a real upload would, so the whole assembly
+// path is exercised, and logs the upload instead of performing it
+func dryRunUpload(folderName, filename string, data io.Reader) error {
+	written, err := io.Copy(io.Discard, data)
+	if err != nil {
+		return fmt.Errorf("could not read file data: %w", err)
+	}
+	slog.Info("DRY RUN: would upload file to Nextcloud", "folderName", folderName, "fileName", filename, "bytes", written)
+	return nil
+}
+
+// UploadFileChunked uploads a file using the Nextcloud chunked upload API:
+// it creates a transfer directory, PUTs the data in numbered chunks and finally
+// MOVEs the assembled file into the target folder.
+//
+// With RESUME_ATTEMPTS and a context from withResumableTransfer, a failed
+// upload keeps its transfer directory. The next attempt for the same upload
+// finds it again and only sends the chunks Nextcloud does not have yet.
+func (c *NextcloudClient) UploadFileChunked(ctx context.Context, folderName, filename string, data io.Reader) (err error) {
+	if c.DryRun {
+		return dryRunUpload(folderName, filename, data)
+	}
+	defer func() { observeNextcloudRequest("chunked-put", err) }()
+
+	uploadID, resumable := ctx.Value(resumableTransferKey{}).(string)
+	resumable = resumable && c.ResumeAttempts > 0
+	var transferURL string
+	if resumable {
+		transferURL = c.resumableTransferURL(uploadID, filename)
+	} else if transferURL, err = c.newTransferURL(); err != nil {
+		return err
+	}
+	err = c.createTransfer(ctx, transferURL)
+	resumed := resumable && errors.Is(err, errTransferExists)
+	if err != nil && !resumed {
+		return err
+	}
+	if resumed {
+		slog.Info("Resuming chunked upload from an earlier attempt", "folderName", folderName, "fileName", filename)
+	}
+
+	if err := c.uploadChunks(ctx, transferURL, data, resumed); err != nil {
+		// Nextcloud expires transfers that are never completed
+		if !resumable {
+			c.discardTransfer(ctx, transferURL)
+		}
+		return err
+	}
+	return c.assembleTransfer(ctx, transferURL, folderName, filename)
+}
+
+// resumableTransferKey is the context key holding the upload ID set by withResumableTransfer
+type resumableTransferKey struct{}
+
+// withResumableTransfer returns a context whose chunked uploads keep their
+// transfer when they fail, so a later attempt for uploadID can resume it
+func withResumableTransfer(ctx context.Context, uploadID string) context.Context {
+	return context.WithValue(ctx, resumableTransferKey{}, uploadID)
+}
+
+// resumableTransferURL returns the transfer directory every attempt to upload
+// uploadID as filename uses. The folder is left out, as a retry can get a new
+// timestamped one. The upload's data does not change between attempts, so
+// chunks found there can be trusted by their size.
+func (c *NextcloudClient) resumableTransferURL(uploadID, filename string) string {
+	sum := sha256.Sum256([]byte(uploadID + "\x00" + filename))
+	user, _ := c.credentials()
+	return fmt.Sprintf(
+		"%s/remote.php/dav/uploads/%s/uploader-resume-%s",
+		c.BaseURL,
+		user,
+		hex.EncodeToString(sum[:16]),
+	)
+}
+
+// newTransferURL returns the URL of a new, not yet created transfer directory
+func (c *NextcloudClient) newTransferURL() (string, error) {
+	transferID := make([]byte, 16)
+	if _, err := rand.Read(transferID); err != nil {
+		return "", fmt.Errorf("could not generate transfer ID: %w", err)
+	}
+	user, _ := c.credentials()
+	return fmt.Sprintf(
+		"%s/remote.php/dav/uploads/%s/uploader-%s",
+		c.BaseURL,
+		user,
+		hex.EncodeToString(transferID),
+	), nil
+}
+
+// assembleTransfer MOVEs the uploaded chunks of a transfer into the target folder as one file
+func (c *NextcloudClient) assembleTransfer(ctx context.Context, transferURL, folderName, filename string) error {
+	// Assembling the chunks on the Nextcloud side can take a while for large files
+	ctx, cancel := context.WithTimeout(ctx, c.UploadTimeout)
+	defer cancel()
+	req, err := c.newRequest(ctx, "MOVE", transferURL+"/.file", nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Destination", c.fileURL(folderName, filename))
+	resp, err := c.do(req)
+	if err != nil {
+		return fmt.Errorf("request execution failed: %w", err)
+	}
+	defer drainAndClose(resp.Body)
+	if resp.StatusCode == http.StatusInsufficientStorage {
+		return errQuotaExceeded
+	}
+	if resp.StatusCode != http.StatusCreated && resp.StatusCode != http.StatusNoContent {
+		body, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("bad response from Nextcloud assembling chunks: %s (body: %s)", resp.Status, string(body))
+	}
+	return nil
+}
+
+// createTransfer creates the transfer directory of a chunked upload
+func (c *NextcloudClient) createTransfer(ctx context.Context, transferURL string) error {
+	ctx, cancel := context.WithTimeout(ctx, c.MkcolTimeout)
+	defer cancel()
+	req, err := c.newRequest(ctx, "MKCOL", transferURL, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := c.do(req)
+	if err != nil {
+		return fmt.Errorf("request execution failed: %w", err)
+	}
+	drainAndClose(resp.Body)
+	if resp.StatusCode == http.StatusMethodNotAllowed {
+		return errTransferExists
+	}
+	if resp.StatusCode != http.StatusCreated {
+		return fmt.Errorf("bad response from Nextcloud creating transfer: %s", resp.Status)
+	}
+	return nil
+}
+
+// discardTransfer deletes the transfer directory of a failed chunked upload, on a best effort basis
+func (c *NextcloudClient) discardTransfer(ctx context.Context, transferURL string) {
+	// Clean up even when the upload failed because ctx was cancelled
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), c.MkcolTimeout)
+	defer cancel()
+	req, err := c.newRequest(ctx, http.MethodDelete, transferURL, nil)
+	if err != nil {
+		return
+	}
+	if resp, err := c.do(req); err == nil {
+		drainAndClose(resp.Body)
+	}
+}
+
+// uploadChunks splits data into nextcloudChunkSize pieces and PUTs them into
+// the transfer directory. For a resumed transfer, chunks Nextcloud already
+// stored in full are read past without sending them again.
+func (c *NextcloudClient) uploadChunks(ctx context.Context, transferURL string, data io.Reader, resumed bool) error {
+	buffer := make([]byte, nextcloudChunkSize)
+	for chunkNumber := 1; ; chunkNumber++ {
+		n, err := io.ReadFull(data, buffer)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil && err != io.ErrUnexpectedEOF {
+			return fmt.Errorf("could not read file data: %w", err)
+		}
+
+		chunkURL := fmt.Sprintf("%s/%06d", transferURL, chunkNumber)
+		if resumed {
+			// After a skipped last chunk the next read reports io.EOF
+			if stored, ok := c.remoteSize(ctx, chunkURL); ok && stored == int64(n) {
+				slog.Debug("Skipped chunk already stored by Nextcloud", "chunk", chunkNumber, "bytes", stored)
+				continue
+			}
+		}
+		if err := c.uploadChunkResumable(ctx, chunkURL, buffer[:n]); err != nil {
+			return fmt.Errorf("chunk %d: %w", chunkNumber, err)
+		}
+
+		// A short read means that was the last chunk
+		if err == io.ErrUnexpectedEOF {
+			return nil
+		}
+	}
+}
+
+// uploadChunkResumable PUTs a chunk and, when that fails, asks Nextcloud with
+// a HEAD how much of it arrived. Earlier chunks are already stored, so only
+// this chunk is sent again, and not even that if Nextcloud has all of it and
+// just the response was lost.
+func (c *NextcloudClient) uploadChunkResumable(ctx context.Context, chunkURL string, chunk []byte) error {
+	err := c.uploadChunk(ctx, chunkURL, chunk)
+	for attempt := 1; err != nil && attempt <= c.ResumeAttempts; attempt++ {
+		if errors.Is(err, errQuotaExceeded) {
+			return err
+		}
+		stored, ok := c.remoteSize(ctx, chunkURL)
+		if ok && stored == int64(len(chunk)) {
+			slog.Info("Chunk already stored by Nextcloud", "chunk", path.Base(chunkURL), "bytes", stored)
+			return nil
+		}
+		slog.Warn("Resuming chunked upload", "chunk", path.Base(chunkURL), "attempt", attempt, "error", err)
+		err = c.uploadChunk(ctx, chunkURL, chunk)
+	}
+	return err
+}
+
+// remoteSize returns the Content-Length Nextcloud reports for url with a HEAD request
+func (c *NextcloudClient) remoteSize(ctx context.Context, url string) (int64, bool) {
+	ctx, cancel := context.WithTimeout(ctx, c.HeadTimeout)
+	defer cancel()
+	req, err := c.newRequest(ctx, http.MethodHead, url, nil)
+	if err != nil {
+		return 0, false
+	}
+	resp, err := c.do(req)
+	observeNextcloudRequest("head", err)
+	if err != nil {
+		return 0, false
+	}
+	drainAndClose(resp.Body)
+	if resp.StatusCode != http.StatusOK || resp.ContentLength < 0 {
+		return 0, false
+	}
+	return resp.ContentLength, true
+}
+
+// uploadChunk PUTs a single chunk of a chunked upload
+func (c *NextcloudClient) uploadChunk(ctx context.Context, chunkURL string, chunk []byte) error {
+	ctx, cancel := context.WithTimeout(ctx, c.UploadTimeout)
+	defer cancel()
+	req, err := c.newRequest(ctx, http.MethodPut, chunkURL, bytes.NewReader(chunk))
+	if err != nil {
+		return err
+	}
+	resp, err := c.do(req)
+	if err != nil {
+		return fmt.Errorf("request execution failed: %w", err)
+	}
+	drainAndClose(resp.Body)
+	if resp.StatusCode == http.StatusInsufficientStorage {
+		return errQuotaExceeded
+	}
+	if resp.StatusCode != http.StatusCreated && resp.StatusCode != http.StatusNoContent {
+		return fmt.Errorf("bad response from Nextcloud: %s", resp.Status)
+	}
+	return nil
+}
+
+// DeleteFile deletes a file from a folder of the upload directory. Deleting a missing file is not an error.
+func (c *NextcloudClient) DeleteFile(ctx context.Context, folderName, filename string) (err error) {
+	if c.DryRun {
+		slog.Info("DRY RUN: would delete Nextcloud file", "folderName", folderName, "fileName", filename)
+		return nil
+	}
+	defer func() { observeNextcloudRequest("delete", err) }()
+
+	ctx, cancel := context.WithTimeout(ctx, c.MkcolTimeout)
+	defer cancel()
+	req, err := c.newRequest(ctx, http.MethodDelete, c.fileURL(folderName, filename), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := c.do(req)
+	if err != nil {
+		return fmt.Errorf("request execution failed: %w", err)
+	}
+	defer drainAndClose(resp.Body)
+	if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNotFound {
+		return fmt.Errorf("bad response from Nextcloud: %s", resp.Status)
+	}
+	return nil
+}
+
+// MoveFolder renames a folder inside the upload directory using WebDAV MOVE.
+// An existing destination is never replaced; errDestinationExists is returned instead.
+func (c *NextcloudClient) MoveFolder(ctx context.Context, from, to string) (err error) {
+	if c.DryRun {
+		slog.Info("DRY RUN: would move Nextcloud folder", "from", from, "to", to)
+		return nil
+	}
+	defer func() { observeNextcloudRequest("move", err) }()
+
+	ctx, cancel := context.WithTimeout(ctx, c.MkcolTimeout)
+	defer cancel()
+	req, err := c.newRequest(ctx, "MOVE", c.folderURL(from), nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Destination", c.folderURL(to))
+	req.Header.Set("Overwrite", "F")
+	resp, err := c.do(req)
+	if err != nil {
+		return fmt.Errorf("request execution failed: %w", err)
+	}
+	defer drainAndClose(resp.Body)
+
+	// 201 for a new destination, 204 if one was replaced, which Overwrite: F prevents
+	switch resp.StatusCode {
+	case http.StatusCreated, http.StatusNoContent:
+		return nil
+	case http.StatusPreconditionFailed:
+		return errDestinationExists
+	}
+	body, _ := io.ReadAll(resp.Body)
+	return fmt.Errorf("bad response from Nextcloud: %s (body: %s)", resp.Status, string(body))
+}
+
+// FileExists checks if a file already exists in the folder using a HEAD request
+func (c *NextcloudClient) FileExists(ctx context.Context, folderName, filename string) bool {
+	if c.DryRun {
+		slog.Info("DRY RUN: would check for existing Nextcloud file", "folderName", folderName, "fileName", filename)
+		return false
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, c.HeadTimeout)
+	defer cancel()
+	req, err := c.newRequest(ctx, http.MethodHead, c.fileURL(folderName, filename), nil)
+	if err != nil {
+		return false
+	}
+	resp, err := c.do(req)
+	observeNextcloudRequest("head", err)
+	if err != nil {
+		return false
+	}
+	defer drainAndClose(resp.Body)
+
+	return resp.StatusCode == http.StatusOK
+}
+
+// CheckConnectivity issues a shallow PROPFIND against the user's WebDAV root
+func (c *NextcloudClient) CheckConnectivity(ctx context.Context) error {
+	user, _ := c.credentials()
+	webdavURL := fmt.Sprintf("%s/remote.php/dav/files/%s/", c.BaseURL, user)
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	req, err := c.newRequest(ctx, "PROPFIND", webdavURL, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Depth", "0")
+	resp, err := c.do(req)
+	if err != nil {
+		return fmt.Errorf("request execution failed: %w", err)
+	}
+	defer drainAndClose(resp.Body)
+
+	if resp.StatusCode != http.StatusMultiStatus {
+		return fmt.Errorf("bad response from Nextcloud: %s", resp.Status)
+	}
+	return nil
+}
+
+// FolderInfo describes a folder inside the upload directory
+type FolderInfo struct {
+	Name         string    `json:"folderName"`
+	LastModified time.Time `json:"lastModified"`
+}
+
+// davMultistatus is the subset of a WebDAV PROPFIND response we need
+type davMultistatus struct {
+	Responses []struct {
+		Href         string `xml:"href"`
+		LastModified string `xml:"propstat>prop>getlastmodified"`
+		ResourceType struct {
+			Collection *struct{} `xml:"collection"`
+		} `xml:"propstat>prop>resourcetype"`
+	} `xml:"response"`
+}
+
+// listFoldersBody asks PROPFIND for the properties ListFolders reads
+const listFoldersBody = `<?xml version="1.0"?>
+<d:propfind xmlns:d="DAV:"><d:prop><d:getlastmodified/><d:resourcetype/></d:prop></d:propfind>`
+
+// ListFolders returns the folders directly inside parent, a folder of the
+// upload directory or "" for the upload directory itself, using a Depth 1
+// PROPFIND. A parent that does not exist has no folders.
+func (c *NextcloudClient) ListFolders(ctx context.Context, parent string) (folders []FolderInfo, err error) {
+	if c.DryRun {
+		slog.Info("DRY RUN: would list Nextcloud folders")
+		return nil, nil
+	}
+	defer func() { observeNextcloudRequest("propfind", err) }()
+
+	webdavURL := c.folderURL(parent)
+	if parent != "" {
+		webdavURL += "/"
+	}
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+	req, err := c.newRequest(ctx, "PROPFIND", webdavURL, strings.NewReader(listFoldersBody))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Depth", "1")
+	req.Header.Set("Content-Type", "application/xml")
+	resp, err := c.do(req)
+	if err != nil {
+		return nil, fmt.Errorf("request execution failed: %w", err)
+	}
+	defer drainAndClose(resp.Body)
+	if resp.StatusCode == http.StatusNotFound && parent != "" {
+		return []FolderInfo{}, nil
+	}
+	if resp.StatusCode != http.StatusMultiStatus {
+		body, _ := io.ReadAll(resp.Body)
+		return nil, fmt.Errorf("bad response from Nextcloud: %s (body: %s)", resp.Status, string(body))
+	}
+
+	var multistatus davMultistatus
+	if err := xml.NewDecoder(resp.Body).Decode(&multistatus); err != nil {
+		return nil, fmt.Errorf("could not parse PROPFIND response: %w", err)
+	}
+
+	// The first response describes the upload directory itself
+	basePath := req.URL.EscapedPath()
+	folders = []FolderInfo{}
+	for _, response := range multistatus.Responses {
+		if response.ResourceType.Collection == nil {
+			continue
+		}
+		hrefPath := response.Href
+		if parsed, err := url.Parse(response.Href); err == nil {
+			hrefPath = parsed.EscapedPath()
+		}
+		if strings.TrimSuffix(hrefPath, "/") == strings.TrimSuffix(basePath, "/") {
+			continue
+		}
+		name, err := url.PathUnescape(path.Base(strings.TrimSuffix(hrefPath, "/")))
+		if err != nil {
+			continue
+		}
+		folder := FolderInfo{Name: name}
+		if modified, err := http.ParseTime(response.LastModified); err == nil {
+			folder.LastModified = modified.UTC()
+		}
+		folders = append(folders, folder)
+	}
+	return folders, nil
+}
+
+// reloadCredentialsOnSIGHUP calls reloadCredentials whenever the process receives SIGHUP
+func reloadCredentialsOnSIGHUP() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	for range signals {
+		reloadCredentials()
+	}
+}
+
+// reloadCredentials reloads the configuration and applies the new Nextcloud
+// user, app password and bearer token settings to the clients, so rotated
+// credentials take effect without a restart. Other settings still require a
+// restart.
+func reloadCredentials() {
+	cfg, err := loadConfig()
+	if err != nil {
+		slog.Error("Could not reload configuration, keeping current credentials", "error", err)
+		return
+	}
+	warnShadowedCredentials()
+	nextcloud.SetCredentials(cfg.NextcloudUser, cfg.NextcloudAppPass)
+	// A new token source also drops a token fetched with the old client secret
+	nextcloud.SetAuth(newNextcloudAuth(cfg, nextcloud.credentials))
+	for name, target := range cfg.Targets {
+		if client, ok := nextcloudTargets[name]; ok {
+			client.SetCredentials(target.User, target.AppPassword)
+		}
+	}
+	slog.Info("Reloaded Nextcloud credentials", "user", cfg.NextcloudUser, "authMode", cfg.NextcloudAuthMode, "targets", len(cfg.Targets))
+}
+
+// warnShadowedCredentials warns about credentials the environment sets to
+// something other than the config file. Environment variables win over the
+// file and cannot change in a running process, so rotating such a credential
+// in the file has no effect.
+func warnShadowedCredentials() {
+	file, err := readConfigFile()
+	if err != nil || getEnv("CONFIG_FILE", "") == "" {
+		return
+	}
+	for key, fileValue := range map[string]string{
+		"NC_USER":          file.NextcloudUser,
+		"NC_APP_PASSWORD":  file.NextcloudAppPass,
+		"NC_BEARER_TOKEN":  file.NextcloudBearerToken,
+		"NC_TOKEN_URL":     file.NextcloudTokenURL,
+		"NC_CLIENT_ID":     file.NextcloudClientID,
+		"NC_CLIENT_SECRET": file.NextcloudClientSecret,
+	} {
+		if envValue := getEnv(key, ""); envValue != "" && fileValue != "" && envValue != fileValue {
+			slog.Warn("Environment variable overrides the credential in the config file, the reloaded value is not used", "variable", key)
+		}
+	}
+}
+
+// createNextcloudFolder creates a folder in Nextcloud using the default client
+func createNextcloudFolder(folderName string) error {
+	return nextcloud.CreateFolder(context.Background(), folderName)
+}
+
+// uploadToNextcloudFolder uploads a file with a single PUT using the default client
+func uploadToNextcloudFolder(folderName, filename string, data io.Reader) error {
+	return nextcloud.UploadFile(context.Background(), folderName, filename, data)
+}
+
+// uploadToNextcloudChunked uploads a file with the chunked upload API using the default client
+func uploadToNextcloudChunked(folderName, filename string, data io.Reader) error {
+	return nextcloud.UploadFileChunked(context.Background(), folderName, filename, data)
+}
+
+// checkNextcloudFileExists checks if a file exists using the default client
+func checkNextcloudFileExists(folderName, filename string) bool {
+	return nextcloud.FileExists(context.Background(), folderName, filename)
+}
+
+// checkNextcloudConnectivity checks that Nextcloud is reachable using the default client
+func checkNextcloudConnectivity() error {
+	return nextcloud.CheckConnectivity(context.Background())
+}
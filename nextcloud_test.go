@@ -0,0 +1,547 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// recordedRequest is the part of a request received by the fake server that the tests assert on
+type recordedRequest struct {
+	Method      string
+	Path        string
+	Destination string
+	Body        string
+	User        string
+	Password    string
+}
+
+// fakeNextcloud starts an httptest.Server that records every request and
+// answers with the status returned by respond.
+func fakeNextcloud(t *testing.T, respond func(r *http.Request) int) (*NextcloudClient, func() []recordedRequest) {
+	t.Helper()
+	var mu sync.Mutex
+	var requests []recordedRequest
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		user, password, _ := r.BasicAuth()
+		mu.Lock()
+		requests = append(requests, recordedRequest{
+			Method:      r.Method,
+			Path:        r.URL.EscapedPath(),
+			Destination: r.Header.Get("Destination"),
+			Body:        string(body),
+			User:        user,
+			Password:    password,
+		})
+		mu.Unlock()
+		w.WriteHeader(respond(r))
+	}))
+	t.Cleanup(server.Close)
+
+	client := &NextcloudClient{
+		BaseURL:    server.URL,
+		User:       "uploader",
+		AppPass:    "secret",
+		UploadDir:  "Uploads",
+		HTTPClient: server.Client(),
+
+		MkcolTimeout:  5 * time.Second,
+		UploadTimeout: 5 * time.Second,
+		HeadTimeout:   5 * time.Second,
+	}
+	return client, func() []recordedRequest {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]recordedRequest(nil), requests...)
+	}
+}
+
+func TestCreateFolder(t *testing.T) {
+	for _, status := range []int{http.StatusCreated, http.StatusMethodNotAllowed} {
+		client, requests := fakeNextcloud(t, func(r *http.Request) int { return status })
+		if err := client.CreateFolder(context.Background(), "2024-01-01 user/sub dir"); err != nil {
+			t.Fatalf("status %d: unexpected error: %v", status, err)
+		}
+
+		got := requests()
+		if len(got) != 1 {
+			t.Fatalf("got %d requests, want 1", len(got))
+		}
+		if got[0].Method != "MKCOL" {
+			t.Errorf("method = %s, want MKCOL", got[0].Method)
+		}
+		if want := "/remote.php/dav/files/uploader/Uploads/2024-01-01%20user/sub%20dir"; got[0].Path != want {
+			t.Errorf("path = %s, want %s", got[0].Path, want)
+		}
+		if got[0].User != "uploader" || got[0].Password != "secret" {
+			t.Errorf("basic auth = %s:%s, want uploader:secret", got[0].User, got[0].Password)
+		}
+	}
+}
+
+func TestCreateFolderError(t *testing.T) {
+	client, _ := fakeNextcloud(t, func(r *http.Request) int { return http.StatusForbidden })
+	if err := client.CreateFolder(context.Background(), "folder"); err == nil {
+		t.Fatal("expected an error for a 403 response")
+	}
+}
+
+func TestCustomHeaders(t *testing.T) {
+	var gotSecret, gotHost string
+	client, _ := fakeNextcloud(t, func(r *http.Request) int {
+		gotSecret, gotHost = r.Header.Get("X-Proxy-Secret"), r.Host
+		return http.StatusCreated
+	})
+	client.Headers = nextcloudHeaders(map[string]string{"x-proxy-secret": "s3cr3t", "host": "cloud.internal"})
+	if err := client.CreateFolder(context.Background(), "folder"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if gotSecret != "s3cr3t" || gotHost != "cloud.internal" {
+		t.Errorf("X-Proxy-Secret = %q, Host = %q, want s3cr3t and cloud.internal", gotSecret, gotHost)
+	}
+}
+
+func TestBearerAuthFetchesToken(t *testing.T) {
+	var tokenRequests int
+	tokenServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tokenRequests++
+		if id, secret, _ := r.BasicAuth(); id != "uploader-client" || secret != "client-secret" || r.FormValue("grant_type") != "client_credentials" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Write([]byte(`{"access_token":"token-1","expires_in":3600}`))
+	}))
+	t.Cleanup(tokenServer.Close)
+
+	var gotAuth []string
+	client, _ := fakeNextcloud(t, func(r *http.Request) int {
+		gotAuth = append(gotAuth, r.Header.Get("Authorization"))
+		return http.StatusCreated
+	})
+	client.Auth = &clientCredentialsAuth{
+		TokenURL:     tokenServer.URL,
+		ClientID:     "uploader-client",
+		ClientSecret: "client-secret",
+		HTTPClient:   tokenServer.Client(),
+	}
+	for range 2 {
+		if err := client.CreateFolder(context.Background(), "folder"); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	for _, auth := range gotAuth {
+		if auth != "Bearer token-1" {
+			t.Errorf("Authorization = %q, want Bearer token-1", auth)
+		}
+	}
+	if tokenRequests != 1 {
+		t.Errorf("token fetched %d times, want once", tokenRequests)
+	}
+}
+
+func TestUploadFile(t *testing.T) {
+	client, requests := fakeNextcloud(t, func(r *http.Request) int { return http.StatusCreated })
+	if err := client.UploadFile(context.Background(), "folder", "report #1.pdf", strings.NewReader("file contents")); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	got := requests()
+	if len(got) != 1 {
+		t.Fatalf("got %d requests, want 1", len(got))
+	}
+	if got[0].Method != http.MethodPut {
+		t.Errorf("method = %s, want PUT", got[0].Method)
+	}
+	if want := "/remote.php/dav/files/uploader/Uploads/folder/report%20%231.pdf"; got[0].Path != want {
+		t.Errorf("path = %s, want %s", got[0].Path, want)
+	}
+	if got[0].Body != "file contents" {
+		t.Errorf("body = %q, want %q", got[0].Body, "file contents")
+	}
+}
+
+func TestUploadFileError(t *testing.T) {
+	client, _ := fakeNextcloud(t, func(r *http.Request) int { return http.StatusForbidden })
+	if err := client.UploadFile(context.Background(), "folder", "file.txt", strings.NewReader("data")); err == nil {
+		t.Fatal("expected an error for a 403 response")
+	}
+}
+
+func TestUploadFileQuotaExceeded(t *testing.T) {
+	client, _ := fakeNextcloud(t, func(r *http.Request) int {
+		if r.Method == http.MethodPut {
+			return http.StatusInsufficientStorage
+		}
+		return http.StatusCreated
+	})
+	if err := client.UploadFile(context.Background(), "folder", "file.txt", strings.NewReader("data")); !errors.Is(err, errQuotaExceeded) {
+		t.Fatalf("error = %v, want errQuotaExceeded", err)
+	}
+	if err := client.UploadFileChunked(context.Background(), "folder", "file.txt", strings.NewReader("data")); !errors.Is(err, errQuotaExceeded) {
+		t.Fatalf("chunked error = %v, want errQuotaExceeded", err)
+	}
+}
+
+func TestCreateFileDoesNotReplaceExistingFile(t *testing.T) {
+	client, _ := fakeNextcloud(t, func(r *http.Request) int {
+		if r.Header.Get("If-None-Match") != "*" {
+			return http.StatusBadRequest
+		}
+		return http.StatusPreconditionFailed
+	})
+	err := client.CreateFile(context.Background(), "folder", "descripcion.txt", strings.NewReader("data"))
+	if !errors.Is(err, errFileExists) {
+		t.Fatalf("error = %v, want errFileExists", err)
+	}
+}
+
+func TestUploadFileChunked(t *testing.T) {
+	client, requests := fakeNextcloud(t, func(r *http.Request) int { return http.StatusCreated })
+	if err := client.UploadFileChunked(context.Background(), "folder", "file.txt", strings.NewReader("chunked data")); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	got := requests()
+	if len(got) != 3 {
+		t.Fatalf("got %d requests, want 3: %+v", len(got), got)
+	}
+	if got[0].Method != "MKCOL" || !strings.HasPrefix(got[0].Path, "/remote.php/dav/uploads/uploader/uploader-") {
+		t.Errorf("first request = %s %s, want MKCOL of a transfer directory", got[0].Method, got[0].Path)
+	}
+	transferPath := got[0].Path
+	if got[1].Method != http.MethodPut || got[1].Path != transferPath+"/000001" || got[1].Body != "chunked data" {
+		t.Errorf("second request = %s %s %q, want PUT of chunk 000001", got[1].Method, got[1].Path, got[1].Body)
+	}
+	if got[2].Method != "MOVE" || got[2].Path != transferPath+"/.file" {
+		t.Errorf("third request = %s %s, want MOVE of .file", got[2].Method, got[2].Path)
+	}
+	if want := client.BaseURL + "/remote.php/dav/files/uploader/Uploads/folder/file.txt"; got[2].Destination != want {
+		t.Errorf("destination = %s, want %s", got[2].Destination, want)
+	}
+}
+
+func TestUploadFileChunkedDiscardsTransferOnFailure(t *testing.T) {
+	client, requests := fakeNextcloud(t, func(r *http.Request) int {
+		if r.Method == http.MethodPut {
+			return http.StatusInternalServerError
+		}
+		return http.StatusCreated
+	})
+	if err := client.UploadFileChunked(context.Background(), "folder", "file.txt", strings.NewReader("data")); err == nil {
+		t.Fatal("expected an error when a chunk PUT fails")
+	}
+
+	got := requests()
+	if last := got[len(got)-1]; last.Method != http.MethodDelete || last.Path != got[0].Path {
+		t.Errorf("last request = %s %s, want DELETE of the transfer directory", last.Method, last.Path)
+	}
+}
+
+func TestFileExists(t *testing.T) {
+	client, requests := fakeNextcloud(t, func(r *http.Request) int {
+		if strings.HasSuffix(r.URL.Path, "/present.txt") {
+			return http.StatusOK
+		}
+		return http.StatusNotFound
+	})
+	if !client.FileExists(context.Background(), "folder", "present.txt") {
+		t.Error("FileExists(present.txt) = false, want true")
+	}
+	if client.FileExists(context.Background(), "folder", "missing.txt") {
+		t.Error("FileExists(missing.txt) = true, want false")
+	}
+	for _, req := range requests() {
+		if req.Method != http.MethodHead {
+			t.Errorf("method = %s, want HEAD", req.Method)
+		}
+	}
+}
+
+func TestDryRunSendsNoRequests(t *testing.T) {
+	client, requests := fakeNextcloud(t, func(r *http.Request) int { return http.StatusCreated })
+	client.DryRun = true
+
+	if err := client.CreateFolder(context.Background(), "folder"); err != nil {
+		t.Fatalf("CreateFolder: unexpected error: %v", err)
+	}
+	if err := client.UploadFile(context.Background(), "folder", "file.txt", strings.NewReader("data")); err != nil {
+		t.Fatalf("UploadFile: unexpected error: %v", err)
+	}
+	if client.FileExists(context.Background(), "folder", "file.txt") {
+		t.Error("FileExists = true in dry run, want false")
+	}
+	if got := requests(); len(got) != 0 {
+		t.Errorf("got %d requests in dry run, want 0", len(got))
+	}
+}
+
+func TestCheckConnectivity(t *testing.T) {
+	client, requests := fakeNextcloud(t, func(r *http.Request) int { return http.StatusMultiStatus })
+	if err := client.CheckConnectivity(context.Background()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got := requests(); got[0].Method != "PROPFIND" || got[0].Path != "/remote.php/dav/files/uploader/" {
+		t.Errorf("request = %s %s, want PROPFIND of the user root", got[0].Method, got[0].Path)
+	}
+
+	client, _ = fakeNextcloud(t, func(r *http.Request) int { return http.StatusUnauthorized })
+	if err := client.CheckConnectivity(context.Background()); err == nil {
+		t.Fatal("expected an error for a 401 response")
+	}
+}
+
+func TestListFolders(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "PROPFIND" || r.Header.Get("Depth") != "1" {
+			t.Errorf("request = %s Depth %s, want PROPFIND Depth 1", r.Method, r.Header.Get("Depth"))
+		}
+		w.WriteHeader(http.StatusMultiStatus)
+		io.WriteString(w, `<?xml version="1.0"?>
+<d:multistatus xmlns:d="DAV:">
+  <d:response>
+    <d:href>/remote.php/dav/files/uploader/Uploads/</d:href>
+    <d:propstat><d:prop><d:getlastmodified>Mon, 01 Jan 2024 10:00:00 GMT</d:getlastmodified><d:resourcetype><d:collection/></d:resourcetype></d:prop></d:propstat>
+  </d:response>
+  <d:response>
+    <d:href>/remote.php/dav/files/uploader/Uploads/1704103200-jane_en_example_com/</d:href>
+    <d:propstat><d:prop><d:getlastmodified>Mon, 01 Jan 2024 10:00:00 GMT</d:getlastmodified><d:resourcetype><d:collection/></d:resourcetype></d:prop></d:propstat>
+  </d:response>
+  <d:response>
+    <d:href>/remote.php/dav/files/uploader/Uploads/notes.txt</d:href>
+    <d:propstat><d:prop><d:getlastmodified>Mon, 01 Jan 2024 10:00:00 GMT</d:getlastmodified><d:resourcetype/></d:prop></d:propstat>
+  </d:response>
+</d:multistatus>`)
+	}))
+	defer server.Close()
+
+	client := &NextcloudClient{BaseURL: server.URL, User: "uploader", UploadDir: "Uploads", HTTPClient: server.Client()}
+	folders, err := client.ListFolders(context.Background(), "")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(folders) != 1 {
+		t.Fatalf("got %d folders, want 1: %+v", len(folders), folders)
+	}
+	if folders[0].Name != "1704103200-jane_en_example_com" {
+		t.Errorf("name = %s, want 1704103200-jane_en_example_com", folders[0].Name)
+	}
+	if want := "2024-01-01T10:00:00Z"; folders[0].LastModified.Format(time.RFC3339) != want {
+		t.Errorf("lastModified = %s, want %s", folders[0].LastModified.Format(time.RFC3339), want)
+	}
+}
+
+func TestSetProperties(t *testing.T) {
+	var body string
+	status := "HTTP/1.1 200 OK"
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "PROPPATCH" {
+			t.Errorf("method = %s, want PROPPATCH", r.Method)
+		}
+		data, _ := io.ReadAll(r.Body)
+		body = string(data)
+		w.WriteHeader(http.StatusMultiStatus)
+		io.WriteString(w, `<?xml version="1.0"?>
+<d:multistatus xmlns:d="DAV:" xmlns:u="`+uploaderPropertyNamespace+`">
+  <d:response>
+    <d:href>/remote.php/dav/files/uploader/Uploads/folder/file.txt</d:href>
+    <d:propstat><d:prop><u:data-origin/><u:email/><u:phone/></d:prop><d:status>`+status+`</d:status></d:propstat>
+  </d:response>
+</d:multistatus>`)
+	}))
+	defer server.Close()
+
+	client := &NextcloudClient{BaseURL: server.URL, User: "uploader", UploadDir: "Uploads", HTTPClient: server.Client(), MkcolTimeout: 5 * time.Second}
+	if err := client.SetProperties(context.Background(), "folder", "file.txt", uploadProperties("jane@example.com", "<none>", "web")); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !strings.Contains(body, "<u:email>jane@example.com</u:email>") || !strings.Contains(body, "<u:phone>&lt;none&gt;</u:phone>") {
+		t.Errorf("body = %s, want escaped email and phone properties", body)
+	}
+
+	status = "HTTP/1.1 403 Forbidden"
+	if err := client.SetProperties(context.Background(), "folder", "file.txt", uploadProperties("jane@example.com", "", "web")); err == nil {
+		t.Fatal("expected an error when the multistatus reports 403")
+	}
+}
+
+func TestUploadFileChunkedResumesFailedChunk(t *testing.T) {
+	var failedOnce bool
+	client, requests := fakeNextcloud(t, func(r *http.Request) int {
+		if r.Method == http.MethodPut && !failedOnce {
+			failedOnce = true
+			return http.StatusBadGateway
+		}
+		if r.Method == http.MethodHead {
+			return http.StatusNotFound
+		}
+		return http.StatusCreated
+	})
+	client.ResumeAttempts = 1
+	if err := client.UploadFileChunked(context.Background(), "folder", "file.txt", strings.NewReader("chunked data")); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	var methods []string
+	for _, req := range requests() {
+		methods = append(methods, req.Method)
+	}
+	if got, want := strings.Join(methods, " "), "MKCOL PUT HEAD PUT MOVE"; got != want {
+		t.Errorf("requests = %s, want %s", got, want)
+	}
+}
+
+func TestCircuitBreakerOpensAfterFailures(t *testing.T) {
+	status := http.StatusInternalServerError
+	client, requests := fakeNextcloud(t, func(r *http.Request) int { return status })
+	client.Breaker = newCircuitBreaker(2, 50*time.Millisecond)
+
+	for i := 0; i < 2; i++ {
+		if err := client.CreateFolder(context.Background(), "folder"); err == nil || errors.Is(err, errCircuitOpen) {
+			t.Fatalf("attempt %d: error = %v, want a request failure", i, err)
+		}
+	}
+	if err := client.CreateFolder(context.Background(), "folder"); !errors.Is(err, errCircuitOpen) {
+		t.Fatalf("error = %v, want errCircuitOpen", err)
+	}
+	if got := len(requests()); got != 2 {
+		t.Errorf("got %d requests, want 2 while the breaker is open", got)
+	}
+
+	// After the cooldown a successful trial request closes the breaker
+	time.Sleep(60 * time.Millisecond)
+	status = http.StatusCreated
+	if err := client.CreateFolder(context.Background(), "folder"); err != nil {
+		t.Fatalf("trial request: unexpected error: %v", err)
+	}
+	if wait := client.Breaker.retryAfter(); wait != 0 {
+		t.Errorf("retryAfter = %s after recovery, want 0", wait)
+	}
+}
+
+func TestCircuitBreakerIgnoresCanceledRequests(t *testing.T) {
+	client, _ := fakeNextcloud(t, func(r *http.Request) int { return http.StatusCreated })
+	client.Breaker = newCircuitBreaker(1, time.Minute)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	for i := 0; i < 3; i++ {
+		if err := client.CreateFolder(ctx, "folder"); !errors.Is(err, context.Canceled) {
+			t.Fatalf("attempt %d: error = %v, want context.Canceled", i, err)
+		}
+	}
+	if err := client.CreateFolder(context.Background(), "folder"); err != nil {
+		t.Fatalf("breaker opened after canceled requests: %v", err)
+	}
+}
+
+func TestUploadFileChunkedResumesTransferOfFailedUpload(t *testing.T) {
+	var mu sync.Mutex
+	transferCreated, failSecondChunk := false, true
+	stored := make(map[string]int) // Chunk name → bytes
+	puts := make(map[string]int)   // Chunk name → PUT requests
+	var methods []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		mu.Lock()
+		defer mu.Unlock()
+		methods = append(methods, r.Method)
+		chunk := path.Base(r.URL.Path)
+		switch r.Method {
+		case "MKCOL":
+			if transferCreated {
+				w.WriteHeader(http.StatusMethodNotAllowed)
+				return
+			}
+			transferCreated = true
+			w.WriteHeader(http.StatusCreated)
+		case http.MethodPut:
+			puts[chunk]++
+			if chunk == "000002" && failSecondChunk {
+				w.WriteHeader(http.StatusBadGateway)
+				return
+			}
+			stored[chunk] = len(body)
+			w.WriteHeader(http.StatusCreated)
+		case http.MethodHead:
+			size, ok := stored[chunk]
+			if !ok {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			w.Header().Set("Content-Length", strconv.Itoa(size))
+			w.WriteHeader(http.StatusOK)
+		case "MOVE":
+			w.WriteHeader(http.StatusCreated)
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	}))
+	defer server.Close()
+
+	client := &NextcloudClient{
+		BaseURL: server.URL, User: "uploader", UploadDir: "Uploads", HTTPClient: server.Client(),
+		MkcolTimeout: 5 * time.Second, UploadTimeout: 5 * time.Second, HeadTimeout: 5 * time.Second,
+		ResumeAttempts: 1,
+	}
+	data := strings.Repeat("x", nextcloudChunkSize+5)
+	ctx := withResumableTransfer(context.Background(), "upload-1")
+
+	if err := client.UploadFileChunked(ctx, "folder", "big.bin", strings.NewReader(data)); err == nil {
+		t.Fatal("expected the first attempt to fail")
+	}
+	if slices.Contains(methods, http.MethodDelete) {
+		t.Fatal("transfer of a resumable upload was discarded")
+	}
+
+	failSecondChunk = false
+	if err := client.UploadFileChunked(ctx, "folder", "big.bin", strings.NewReader(data)); err != nil {
+		t.Fatalf("second attempt: unexpected error: %v", err)
+	}
+	if puts["000001"] != 1 {
+		t.Errorf("first chunk was sent %d times, want once", puts["000001"])
+	}
+	if stored["000002"] != 5 {
+		t.Errorf("second chunk has %d bytes, want 5", stored["000002"])
+	}
+}
+
+func TestReloadCredentialsAppliesBearerToken(t *testing.T) {
+	oldClient := nextcloud
+	t.Cleanup(func() { nextcloud = oldClient })
+	configFile := filepath.Join(t.TempDir(), "config.yaml")
+	writeConfig := func(token string) {
+		config := "url: https://cloud.example.com\nuser: uploader\nauth_mode: bearer\nbearer_token: " + token + "\n"
+		if err := os.WriteFile(configFile, []byte(config), 0o600); err != nil {
+			t.Fatalf("could not write config file: %v", err)
+		}
+	}
+	writeConfig("old-token")
+	t.Setenv("CONFIG_FILE", configFile)
+	cfg, err := loadConfig()
+	if err != nil {
+		t.Fatalf("could not load config: %v", err)
+	}
+	nextcloud = newNextcloudClient(cfg)
+
+	writeConfig("new-token")
+	reloadCredentials()
+	req, err := nextcloud.newRequest(context.Background(), http.MethodGet, "https://cloud.example.com/", nil)
+	if err != nil {
+		t.Fatalf("could not create request: %v", err)
+	}
+	if got := req.Header.Get("Authorization"); got != "Bearer new-token" {
+		t.Errorf("Authorization = %q after reload, want the new token", got)
+	}
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Values of NC_AUTH_MODE
+const (
+	authModeBasic  = "basic"  // User and app password (default)
+	authModeBearer = "bearer" // Static token, or one fetched from NC_TOKEN_URL
+)
+
+// nextcloudAuth adds credentials to an outgoing Nextcloud request
+type nextcloudAuth interface {
+	authenticate(req *http.Request) error
+}
+
+// newNextcloudAuth returns the authentication selected by NC_AUTH_MODE.
+// credentials supplies the user and app password for basic auth, which can
+// change at runtime.
+func newNextcloudAuth(cfg Config, credentials func() (string, string)) nextcloudAuth {
+	if cfg.NextcloudAuthMode != authModeBearer {
+		return basicAuth(credentials)
+	}
+	if cfg.NextcloudTokenURL != "" {
+		return &clientCredentialsAuth{
+			TokenURL:     cfg.NextcloudTokenURL,
+			ClientID:     cfg.NextcloudClientID,
+			ClientSecret: cfg.NextcloudClientSecret,
+			HTTPClient:   nextcloudHTTPClient,
+		}
+	}
+	return staticBearerAuth(cfg.NextcloudBearerToken)
+}
+
+// basicAuth sends HTTP basic auth with the credentials returned by the function
+type basicAuth func() (user, password string)
+
+func (a basicAuth) authenticate(req *http.Request) error {
+	req.SetBasicAuth(a())
+	return nil
+}
+
+// staticBearerAuth sends a fixed bearer token
+type staticBearerAuth string
+
+func (a staticBearerAuth) authenticate(req *http.Request) error {
+	req.Header.Set("Authorization", "Bearer "+string(a))
+	return nil
+}
+
+// tokenRefreshMargin is how long before its expiry a token is replaced, so it
+// does not run out while a long upload is being sent
+const tokenRefreshMargin = time.Minute
+
+// clientCredentialsAuth sends a bearer token obtained from an OAuth2 token
+// endpoint with the client credentials grant, fetching a new one shortly
+// before the current one expires
+type clientCredentialsAuth struct {
+	TokenURL     string
+	ClientID     string
+	ClientSecret string
+	HTTPClient   *http.Client
+
+	mu     sync.Mutex
+	token  string
+	expiry time.Time // Zero if the endpoint did not say
+}
+
+func (a *clientCredentialsAuth) authenticate(req *http.Request) error {
+	token, err := a.currentToken(req.Context())
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	return nil
+}
+
+// currentToken returns the cached token, fetching a new one if it is missing or about to expire
+func (a *clientCredentialsAuth) currentToken(ctx context.Context) (string, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.token != "" && (a.expiry.IsZero() || time.Now().Add(tokenRefreshMargin).Before(a.expiry)) {
+		return a.token, nil
+	}
+
+	form := url.Values{"grant_type": {"client_credentials"}}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, a.TokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", fmt.Errorf("could not create token request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth(url.QueryEscape(a.ClientID), url.QueryEscape(a.ClientSecret))
+	resp, err := a.HTTPClient.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("token request failed: %w", err)
+	}
+	defer drainAndClose(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1<<10))
+		return "", fmt.Errorf("bad response from token endpoint: %s (body: %s)", resp.Status, string(body))
+	}
+
+	var result struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int64  `json:"expires_in"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return "", fmt.Errorf("could not parse token response: %w", err)
+	}
+	if result.AccessToken == "" {
+		return "", fmt.Errorf("token endpoint returned no access token")
+	}
+	a.token = result.AccessToken
+	a.expiry = time.Time{}
+	if result.ExpiresIn > 0 {
+		a.expiry = time.Now().Add(time.Duration(result.ExpiresIn) * time.Second)
+	}
+	return a.token, nil
+}
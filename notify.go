@@ -0,0 +1,71 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/smtp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// sessionNotification holds the details reported when an upload session completes
+type sessionNotification struct {
+	SessionID  string
+	FolderName string
+	ShareURL   string
+	Email      string
+	Phone      string
+	FileCount  int
+}
+
+// notifySessionComplete emails the intake address about a completed session in the
+// background. Failures are only logged, they never affect the upload itself.
+func notifySessionComplete(logger *slog.Logger, n sessionNotification) {
+	if appConfig.SMTPHost == "" || len(appConfig.NotifyTo) == 0 {
+		return
+	}
+	go func() {
+		if err := sendSessionEmail(n); err != nil {
+			logger.Error("Failed to send session notification email", "error", err)
+			return
+		}
+		logger.Info("Sent session notification email", "recipients", appConfig.NotifyTo)
+	}()
+}
+
+// sendSessionEmail delivers the notification through the configured SMTP server.
+// STARTTLS is used automatically when the server offers it.
+func sendSessionEmail(n sessionNotification) error {
+	from := appConfig.SMTPFrom
+	if from == "" {
+		from = appConfig.SMTPUser
+	}
+
+	var body bytes.Buffer
+	fmt.Fprintf(&body, "From: %s\r\n", from)
+	fmt.Fprintf(&body, "To: %s\r\n", strings.Join(appConfig.NotifyTo, ", "))
+	fmt.Fprintf(&body, "Subject: Upload completed: %s\r\n", n.FolderName)
+	fmt.Fprintf(&body, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	body.WriteString("Content-Type: text/plain; charset=UTF-8\r\n\r\n")
+	fmt.Fprintf(&body, "A new upload session has completed.\r\n\r\n")
+	fmt.Fprintf(&body, "Folder: %s\r\n", n.FolderName)
+	if n.ShareURL != "" {
+		fmt.Fprintf(&body, "Link: %s\r\n", n.ShareURL)
+	}
+	fmt.Fprintf(&body, "Files: %d\r\n", n.FileCount)
+	fmt.Fprintf(&body, "Email: %s\r\n", n.Email)
+	if n.Phone != "" {
+		fmt.Fprintf(&body, "Phone: %s\r\n", n.Phone)
+	}
+	fmt.Fprintf(&body, "Session: %s\r\n", n.SessionID)
+
+	var auth smtp.Auth
+	if appConfig.SMTPUser != "" {
+		auth = smtp.PlainAuth("", appConfig.SMTPUser, appConfig.SMTPPass, appConfig.SMTPHost)
+	}
+	addr := net.JoinHostPort(appConfig.SMTPHost, strconv.Itoa(appConfig.SMTPPort))
+	return smtp.SendMail(addr, auth, from, appConfig.NotifyTo, body.Bytes())
+}
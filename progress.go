@@ -0,0 +1,104 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// ndjsonContentType is requested via Accept to receive live upload progress
+	ndjsonContentType = "application/x-ndjson"
+	// progressInterval is how often progress events are flushed to the client
+	progressInterval = time.Second
+)
+
+// countingReader counts the bytes read through it; safe to query concurrently
+type countingReader struct {
+	r io.Reader
+	n atomic.Int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n.Add(int64(n))
+	return n, err
+}
+
+// wantsProgressStream reports whether the client accepts newline-delimited JSON progress events
+func wantsProgressStream(r *http.Request) bool {
+	return acceptsMediaType(r, ndjsonContentType)
+}
+
+// acceptsMediaType reports whether the Accept header of the request lists mediaType
+func acceptsMediaType(r *http.Request, mediaType string) bool {
+	for _, accepted := range strings.Split(r.Header.Get("Accept"), ",") {
+		parsed, _, err := mime.ParseMediaType(strings.TrimSpace(accepted))
+		if err == nil && parsed == mediaType {
+			return true
+		}
+	}
+	return false
+}
+
+// progressStream writes periodic progress events while a file is forwarded to Nextcloud.
+// Once started, the response status is committed to 200 and the outcome is reported
+// as the final event instead.
+type progressStream struct {
+	mu      sync.Mutex
+	w       http.ResponseWriter
+	encoder *json.Encoder
+	stop    chan struct{}
+	stopped chan struct{}
+}
+
+// startProgressStream commits the streaming response and reports counter's progress every progressInterval
+func startProgressStream(w http.ResponseWriter, counter *countingReader, totalBytes int64) *progressStream {
+	w.Header().Set("Content-Type", ndjsonContentType)
+	w.WriteHeader(http.StatusOK)
+
+	p := &progressStream{
+		w:       w,
+		encoder: json.NewEncoder(w),
+		stop:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+	p.send(map[string]any{"event": "progress", "bytes": int64(0), "totalBytes": totalBytes})
+
+	go func() {
+		defer close(p.stopped)
+		ticker := time.NewTicker(progressInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				p.send(map[string]any{"event": "progress", "bytes": counter.n.Load(), "totalBytes": totalBytes})
+			case <-p.stop:
+				return
+			}
+		}
+	}()
+	return p
+}
+
+// send writes one event and flushes it to the client
+func (p *progressStream) send(event map[string]any) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.encoder.Encode(event)
+	if flusher, ok := p.w.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// finish stops the progress events and writes the final event
+func (p *progressStream) finish(event map[string]any) {
+	close(p.stop)
+	<-p.stopped
+	p.send(event)
+}
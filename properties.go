@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// uploaderPropertyNamespace is the XML namespace of the custom WebDAV
+// properties set on uploaded files
+const uploaderPropertyNamespace = "https://github.com/nbahbnco/nextcloud-public-uploader"
+
+// uploadProperties returns the properties describing an upload, keyed by
+// their local name in uploaderPropertyNamespace
+func uploadProperties(email, phone, dataOrigin string) map[string]string {
+	return map[string]string{
+		"email":       email,
+		"phone":       phone,
+		"data-origin": dataOrigin,
+	}
+}
+
+// proppatchBody builds a PROPPATCH request that sets props
+func proppatchBody(props map[string]string) string {
+	names := make([]string, 0, len(props))
+	for name := range props {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var b strings.Builder
+	b.WriteString(`<?xml version="1.0"?>`)
+	b.WriteString(`<d:propertyupdate xmlns:d="DAV:" xmlns:u="` + uploaderPropertyNamespace + `"><d:set><d:prop>`)
+	for _, name := range names {
+		b.WriteString("<u:" + name + ">")
+		xml.EscapeText(&b, []byte(props[name]))
+		b.WriteString("</u:" + name + ">")
+	}
+	b.WriteString(`</d:prop></d:set></d:propertyupdate>`)
+	return b.String()
+}
+
+// davPropstatMultistatus is the subset of a PROPPATCH response we need
+type davPropstatMultistatus struct {
+	Responses []struct {
+		Propstats []struct {
+			Status string `xml:"status"`
+			Prop   struct {
+				Names []struct {
+					XMLName xml.Name
+				} `xml:",any"`
+			} `xml:"prop"`
+		} `xml:"propstat"`
+	} `xml:"response"`
+}
+
+// SetProperties sets custom WebDAV properties on a file using PROPPATCH. The
+// server answers with a 207 multistatus that reports a status per property,
+// so a 207 alone does not mean the properties were stored.
+func (c *NextcloudClient) SetProperties(ctx context.Context, folderName, filename string, props map[string]string) (err error) {
+	if c.DryRun {
+		slog.Info("DRY RUN: would set Nextcloud file properties", "folderName", folderName, "fileName", filename)
+		return nil
+	}
+	defer func() { observeNextcloudRequest("proppatch", err) }()
+
+	ctx, cancel := context.WithTimeout(ctx, c.MkcolTimeout)
+	defer cancel()
+	req, err := c.newRequest(ctx, "PROPPATCH", c.fileURL(folderName, filename), strings.NewReader(proppatchBody(props)))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/xml")
+	resp, err := c.do(req)
+	if err != nil {
+		return fmt.Errorf("request execution failed: %w", err)
+	}
+	defer drainAndClose(resp.Body)
+	if resp.StatusCode != http.StatusMultiStatus {
+		body, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("bad response from Nextcloud: %s (body: %s)", resp.Status, string(body))
+	}
+
+	var multistatus davPropstatMultistatus
+	if err := xml.NewDecoder(resp.Body).Decode(&multistatus); err != nil {
+		return fmt.Errorf("could not parse PROPPATCH response: %w", err)
+	}
+	var failed []string
+	for _, response := range multistatus.Responses {
+		for _, propstat := range response.Propstats {
+			// Status lines look like "HTTP/1.1 200 OK"
+			if fields := strings.Fields(propstat.Status); len(fields) >= 2 && fields[1] == "200" {
+				continue
+			}
+			for _, name := range propstat.Prop.Names {
+				failed = append(failed, name.XMLName.Local)
+			}
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("nextcloud rejected properties: %s", strings.Join(failed, ", "))
+	}
+	return nil
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+)
+
+// externalBaseURL returns the scheme and host the client used to reach the
+// server, e.g. "https://upload.example.com". Behind a reverse proxy the
+// request itself only shows the internal address, so X-Forwarded-Proto and
+// X-Forwarded-Host are used instead, but only when TRUST_PROXY is enabled.
+func externalBaseURL(r *http.Request) string {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	host := r.Host
+
+	if appConfig.TrustProxy {
+		if proto := strings.ToLower(firstHeaderValue(r.Header.Get("X-Forwarded-Proto"))); proto == "http" || proto == "https" {
+			scheme = proto
+		}
+		if forwardedHost := firstHeaderValue(r.Header.Get("X-Forwarded-Host")); forwardedHost != "" && !strings.ContainsAny(forwardedHost, "/\\@ ") {
+			host = forwardedHost
+		}
+	}
+	return scheme + "://" + host
+}
+
+// firstHeaderValue returns the first entry of a comma-separated header, which
+// for X-Forwarded-* headers is the value set by the proxy closest to the client.
+func firstHeaderValue(value string) string {
+	first, _, _ := strings.Cut(value, ",")
+	return strings.TrimSpace(first)
+}
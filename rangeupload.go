@@ -0,0 +1,342 @@
+package main
+
+import (
+	"cmp"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"time"
+)
+
+// rangeUploadsDir returns the directory holding range and tus uploads, one
+// subdirectory per upload with the sparse data file and its state. It is a
+// sibling of the temp directory rather than inside it, so upload IDs of the
+// chunk store can never reach it.
+func rangeUploadsDir() string {
+	return filepath.Clean(appConfig.UploadTempDir) + "-ranges"
+}
+
+// rangeLocks serializes updates of the received ranges of an upload
+var rangeLocks = newKeyedMutex()
+
+// rangeState tracks which bytes of a range upload have been written. Ranges
+// may start at any offset, so instead of a bitmap over fixed blocks the
+// received bytes are kept as sorted, non-overlapping [start, end) intervals.
+type rangeState struct {
+	Total    int64      `json:"total"`
+	Received [][2]int64 `json:"received"`
+}
+
+// add marks [start, end) as received, merging it with touching intervals
+func (s *rangeState) add(start, end int64) {
+	merged := make([][2]int64, 0, len(s.Received)+1)
+	for _, r := range s.Received {
+		if r[1] < start || r[0] > end {
+			merged = append(merged, r)
+			continue
+		}
+		start, end = min(start, r[0]), max(end, r[1])
+	}
+	merged = append(merged, [2]int64{start, end})
+	slices.SortFunc(merged, func(a, b [2]int64) int { return cmp.Compare(a[0], b[0]) })
+	s.Received = merged
+}
+
+// receivedBytes returns how many distinct bytes have been written
+func (s *rangeState) receivedBytes() int64 {
+	var n int64
+	for _, r := range s.Received {
+		n += r[1] - r[0]
+	}
+	return n
+}
+
+// complete reports whether every byte of the file has been written
+func (s *rangeState) complete() bool {
+	if s.Total == 0 {
+		return true
+	}
+	return len(s.Received) == 1 && s.Received[0] == [2]int64{0, s.Total}
+}
+
+// rangeUploadDir returns the directory of a range upload
+func rangeUploadDir(uploadID string) string {
+	return filepath.Join(rangeUploadsDir(), uploadID)
+}
+
+// loadRangeState reads the state of a range upload. It returns an error
+// wrapping fs.ErrNotExist if no range has been written yet.
+func loadRangeState(uploadID string) (*rangeState, error) {
+	data, err := os.ReadFile(filepath.Join(rangeUploadDir(uploadID), "ranges.json"))
+	if err != nil {
+		return nil, err
+	}
+	var state rangeState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, fmt.Errorf("could not parse range state of upload %s: %w", uploadID, err)
+	}
+	return &state, nil
+}
+
+// saveRangeState replaces the state of a range upload, writing it to a
+// temporary file first so a crash never leaves it torn
+func saveRangeState(uploadID string, state *rangeState) error {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	dir := rangeUploadDir(uploadID)
+	tmp, err := os.CreateTemp(dir, tempChunkPrefix+"*")
+	if err != nil {
+		return fmt.Errorf("could not save range state: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("could not save range state: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("could not save range state: %w", err)
+	}
+	return os.Rename(tmp.Name(), filepath.Join(dir, "ranges.json"))
+}
+
+// writeRange writes length bytes read from r at offset start of the upload's
+// data file and records them as received. The total size is fixed by the
+// first range, later ranges must declare the same one.
+func writeRange(uploadID string, start, length, total int64, r io.Reader) (*rangeState, error) {
+	dir := rangeUploadDir(uploadID)
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return nil, fmt.Errorf("could not create range upload directory %s: %w", dir, err)
+	}
+
+	unlock := rangeLocks.lock(uploadID)
+	state, err := loadRangeState(uploadID)
+	unlock()
+	if errors.Is(err, fs.ErrNotExist) {
+		state = &rangeState{Total: total}
+	} else if err != nil {
+		return nil, err
+	}
+	if state.Total != total {
+		return nil, errRangeTotalMismatch
+	}
+
+	// Ranges of the same upload may be written concurrently, as WriteAt does
+	// not share a file offset; skipped regions simply stay sparse
+	file, err := os.OpenFile(filepath.Join(dir, "data"), os.O_WRONLY|os.O_CREATE, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("could not open range upload file: %w", err)
+	}
+	written, err := io.Copy(io.NewOffsetWriter(file, start), io.LimitReader(r, length))
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not write range: %w", err)
+	}
+	if written != length {
+		return nil, errRangeShortBody
+	}
+
+	// Reload under the lock so concurrent ranges are not lost
+	unlock = rangeLocks.lock(uploadID)
+	defer unlock()
+	state, err = loadRangeState(uploadID)
+	if errors.Is(err, fs.ErrNotExist) {
+		state = &rangeState{Total: total}
+	} else if err != nil {
+		return nil, err
+	}
+	state.add(start, start+length)
+	if err := saveRangeState(uploadID, state); err != nil {
+		return nil, err
+	}
+	return state, nil
+}
+
+var (
+	// errRangeTotalMismatch is returned for a range declaring another total size than the upload
+	errRangeTotalMismatch = errors.New("range total size does not match upload")
+	// errRangeShortBody is returned when the body is shorter than its Content-Range
+	errRangeShortBody = errors.New("request body shorter than content range")
+)
+
+// rangeUploadExists reports whether any range has been written for the upload
+func rangeUploadExists(uploadID string) bool {
+	_, err := os.Stat(filepath.Join(rangeUploadDir(uploadID), "ranges.json"))
+	return err == nil
+}
+
+// removeRangeUpload deletes the data and state of a range upload. Removing an
+// unknown upload is not an error.
+func removeRangeUpload(uploadID string) error {
+	return os.RemoveAll(rangeUploadDir(uploadID))
+}
+
+// removeStaleRangeUploads removes range uploads last modified before cutoff
+// and returns how many were removed
+func removeStaleRangeUploads(cutoff time.Time) int {
+	entries, err := os.ReadDir(rangeUploadsDir())
+	if err != nil {
+		return 0
+	}
+	removed := 0
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil || !info.ModTime().Before(cutoff) {
+			continue
+		}
+		if err := removeRangeUpload(entry.Name()); err != nil {
+			slog.Error("Could not remove stale range upload", "uploadId", entry.Name(), "error", err)
+			continue
+		}
+		slog.Info("Removed stale range upload", "uploadId", entry.Name())
+		removed++
+	}
+	return removed
+}
+
+// rangeReader reads the data file of a range upload, opening it on first use
+// like chunkReader opens its chunks
+type rangeReader struct {
+	uploadID string
+	file     *os.File
+}
+
+// newRangeReader creates a reader over the assembled file of a range upload
+func newRangeReader(uploadID string) *rangeReader {
+	return &rangeReader{uploadID: uploadID}
+}
+
+func (r *rangeReader) Read(p []byte) (int, error) {
+	if r.file == nil {
+		file, err := os.Open(filepath.Join(rangeUploadDir(r.uploadID), "data"))
+		if err != nil {
+			return 0, fmt.Errorf("could not open range upload file: %w", err)
+		}
+		r.file = file
+	}
+	return r.file.Read(p)
+}
+
+// Close closes the data file, if it was opened
+func (r *rangeReader) Close() error {
+	if r.file == nil {
+		return nil
+	}
+	err := r.file.Close()
+	r.file = nil
+	return err
+}
+
+// contentRangePattern matches "bytes start-end/total"; unknown totals are not supported
+var contentRangePattern = regexp.MustCompile(`^bytes (\d+)-(\d+)/(\d+)$`)
+
+// parseContentRange parses a Content-Range header into the offset and length
+// of the range and the total file size
+func parseContentRange(header string) (start, length, total int64, err error) {
+	match := contentRangePattern.FindStringSubmatch(header)
+	if match == nil {
+		return 0, 0, 0, errors.New(`expected "bytes start-end/total"`)
+	}
+	start, _ = strconv.ParseInt(match[1], 10, 64)
+	end, _ := strconv.ParseInt(match[2], 10, 64)
+	total, _ = strconv.ParseInt(match[3], 10, 64)
+	if end < start || end >= total {
+		return 0, 0, 0, errors.New("range outside of file")
+	}
+	return start, end - start + 1, total, nil
+}
+
+// handleUploadRange stores a byte range of an upload sent as the raw request
+// body with a Content-Range header. Ranges are written into a single file at
+// their offset, so they may arrive in any order, overlap or be retried; the
+// upload is then completed with /upload-complete like a chunked one.
+func handleUploadRange(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPut && r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !hasUploadToken(r) {
+		jsonErrorCode(w, errCodeUnauthorized, "Missing or invalid upload token.", http.StatusUnauthorized)
+		return
+	}
+
+	// Security: Sanitize uploadID to prevent path traversal attacks.
+	query := r.URL.Query()
+	cleanUploadID, ok := sanitizeUploadID(query.Get("uploadId"))
+	if !ok {
+		jsonErrorCode(w, errCodeInvalidInput, "Invalid upload ID.", http.StatusBadRequest)
+		return
+	}
+
+	start, length, total, err := parseContentRange(r.Header.Get("Content-Range"))
+	if err != nil {
+		jsonErrorCode(w, errCodeInvalidInput, fmt.Sprintf("Invalid Content-Range header: %v.", err), http.StatusBadRequest)
+		return
+	}
+	if length > appConfig.ChunkSize {
+		jsonErrorCode(w, errCodeTooLarge, fmt.Sprintf("Range too large: maximum size is %d bytes.", appConfig.ChunkSize), http.StatusRequestEntityTooLarge)
+		return
+	}
+	if appConfig.MaxUploadBytes > 0 && total > appConfig.MaxUploadBytes {
+		jsonErrorCode(w, errCodeTooLarge, fmt.Sprintf("File too large: maximum size is %d bytes.", appConfig.MaxUploadBytes), http.StatusRequestEntityTooLarge)
+		return
+	}
+	logger := loggerFrom(r.Context()).With("uploadId", cleanUploadID, "rangeStart", start, "rangeLength", length)
+
+	if sessionID := query.Get("sessionId"); sessionExpired(r.Context(), sessionID) {
+		logger.Warn("Rejected range for expired session", "sessionId", sessionID)
+		if err := removeRangeUpload(cleanUploadID); err != nil {
+			logger.Error("Could not remove range upload of expired session", "error", err)
+		}
+		rejectExpiredSession(w, logger, cleanUploadID)
+		return
+	}
+
+	if !hasFreeDiskSpace(r.Context()) {
+		jsonErrorCode(w, errCodeInsufficientStorage, "Insufficient storage, please retry later.", http.StatusInsufficientStorage)
+		return
+	}
+
+	release, ok := acquireChunkWrite(w, logger, cleanUploadID)
+	if !ok {
+		return
+	}
+	defer release()
+
+	r.Body = http.MaxBytesReader(w, r.Body, length)
+	state, err := writeRange(cleanUploadID, start, length, total, r.Body)
+	switch {
+	case errors.Is(err, errRangeTotalMismatch):
+		jsonErrorCode(w, errCodeInvalidInput, "Content-Range total does not match earlier ranges.", http.StatusBadRequest)
+		return
+	case errors.Is(err, errRangeShortBody):
+		jsonErrorCode(w, errCodeInvalidInput, "Request body is shorter than its Content-Range.", http.StatusBadRequest)
+		return
+	case err != nil:
+		logger.Error("Could not save range", "error", err)
+		jsonErrorCode(w, errCodeServerError, "Server error saving range.", http.StatusInternalServerError)
+		return
+	}
+
+	chunksReceivedTotal.Inc()
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]any{
+		"uploadId": cleanUploadID,
+		"received": state.receivedBytes(),
+		"total":    state.Total,
+		"complete": state.complete(),
+	})
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// ipRateLimiter keeps one token bucket per client IP
+type ipRateLimiter struct {
+	mu       sync.Mutex
+	limit    rate.Limit
+	burst    int
+	limiters map[string]*clientLimiter
+}
+
+type clientLimiter struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+// newIPRateLimiter creates a limiter allowing rps requests per second per IP with the given burst.
+// Idle buckets are forgotten after idleTimeout.
+func newIPRateLimiter(rps float64, burst int, idleTimeout time.Duration) *ipRateLimiter {
+	l := &ipRateLimiter{
+		limit:    rate.Limit(rps),
+		burst:    burst,
+		limiters: make(map[string]*clientLimiter),
+	}
+	go l.forgetIdle(idleTimeout)
+	return l
+}
+
+// reserve takes a token for ip and returns how long the client has to wait, 0 if allowed now
+func (l *ipRateLimiter) reserve(ip string) time.Duration {
+	l.mu.Lock()
+	client, ok := l.limiters[ip]
+	if !ok {
+		client = &clientLimiter{limiter: rate.NewLimiter(l.limit, l.burst)}
+		l.limiters[ip] = client
+	}
+	client.lastSeen = time.Now()
+	l.mu.Unlock()
+
+	reservation := client.limiter.Reserve()
+	if !reservation.OK() {
+		return time.Minute
+	}
+	delay := reservation.Delay()
+	if delay > 0 {
+		// The request is rejected, so don't consume the token
+		reservation.Cancel()
+	}
+	return delay
+}
+
+// forgetIdle periodically drops buckets of clients not seen for idleTimeout
+func (l *ipRateLimiter) forgetIdle(idleTimeout time.Duration) {
+	for range time.Tick(idleTimeout) {
+		cutoff := time.Now().Add(-idleTimeout)
+		l.mu.Lock()
+		for ip, client := range l.limiters {
+			if client.lastSeen.Before(cutoff) {
+				delete(l.limiters, ip)
+			}
+		}
+		l.mu.Unlock()
+	}
+}
+
+// rateLimited wraps a handler so that clients exceeding their rate get 429 with Retry-After.
+// A nil limiter disables rate limiting.
+func rateLimited(limiter *ipRateLimiter, next http.HandlerFunc) http.HandlerFunc {
+	if limiter == nil {
+		return next
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		if delay := limiter.reserve(clientIP(r)); delay > 0 {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(delay.Seconds()))))
+			jsonError(w, "Too many requests, please slow down.", http.StatusTooManyRequests)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// clientIP returns the IP address of the client that issued the request.
+// X-Forwarded-For is only honored when TRUST_PROXY is enabled, because otherwise any
+// client could spoof its address. In that case the last entry is used, which is the
+// address the trusted proxy itself appended.
+func clientIP(r *http.Request) string {
+	if appConfig.TrustProxy {
+		if forwarded := r.Header.Get("X-Forwarded-For"); forwarded != "" {
+			hops := strings.Split(forwarded, ",")
+			if ip := strings.TrimSpace(hops[len(hops)-1]); ip != "" {
+				return ip
+			}
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// clientIPSalt keys the client IP hash. It is filled on first use from
+// CLIENT_IP_SALT or, failing that, random bytes, in which case the hashes of
+// one address only match within the same process lifetime.
+var clientIPSalt = sync.OnceValue(func() []byte {
+	if appConfig.ClientIPSalt != "" {
+		return []byte(appConfig.ClientIPSalt)
+	}
+	salt := make([]byte, 32)
+	rand.Read(salt)
+	return salt
+})
+
+// loggedClientIP returns the client IP as it may appear in logs and the audit
+// log: the address itself, or with HASH_CLIENT_IP a salted hash of it that
+// still lets entries of the same client be correlated.
+func loggedClientIP(r *http.Request) string {
+	ip := clientIP(r)
+	if !appConfig.HashClientIP {
+		return ip
+	}
+	mac := hmac.New(sha256.New, clientIPSalt())
+	mac.Write([]byte(ip))
+	return hex.EncodeToString(mac.Sum(nil))[:16]
+}
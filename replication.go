@@ -0,0 +1,205 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+)
+
+// Values of REPLICATION_QUORUM
+const (
+	quorumAll      = "all"      // Every replica must succeed (default)
+	quorumMajority = "majority" // More than half of the replicas must succeed
+	quorumAny      = "any"      // One successful replica is enough
+)
+
+// replicaSet is set when REPLICATE_TO is configured and then receives the
+// uploads that would otherwise go to the default Nextcloud account
+var replicaSet *replicatedBackend
+
+// replica is one of the backends a replicatedBackend writes to
+type replica struct {
+	name    string
+	backend UploadBackend
+}
+
+// replicaResult is the outcome of an operation on one replica
+type replicaResult struct {
+	name string
+	err  error
+}
+
+// replicatedBackend mirrors every upload to several backends concurrently.
+// An operation succeeds when at least quorum replicas succeeded; reads such
+// as FileExists are answered by the first replica, the default account.
+type replicatedBackend struct {
+	replicas []replica
+	quorum   int
+}
+
+// newReplicatedBackend creates a backend writing to primary and the named
+// targets, succeeding according to the REPLICATION_QUORUM policy
+func newReplicatedBackend(primary UploadBackend, targets []string, clients map[string]*NextcloudClient, policy string) *replicatedBackend {
+	replicas := []replica{{name: "default", backend: primary}}
+	for _, name := range targets {
+		replicas = append(replicas, replica{name: name, backend: clients[name]})
+	}
+	quorum := len(replicas)
+	switch policy {
+	case quorumMajority:
+		quorum = len(replicas)/2 + 1
+	case quorumAny:
+		quorum = 1
+	}
+	return &replicatedBackend{replicas: replicas, quorum: quorum}
+}
+
+// each runs op on all replicas concurrently and returns their results in replica order
+func (b *replicatedBackend) each(ctx context.Context, op func(ctx context.Context, backend UploadBackend) error) []replicaResult {
+	results := make([]replicaResult, len(b.replicas))
+	var wg sync.WaitGroup
+	for i, r := range b.replicas {
+		results[i].name = r.name
+		wg.Go(func() {
+			results[i].err = op(ctx, r.backend)
+		})
+	}
+	wg.Wait()
+	return results
+}
+
+// check returns nil if enough replicas succeeded, otherwise the joined errors
+// of the failed ones, so errors.Is still finds errQuotaExceeded and the like
+func (b *replicatedBackend) check(results []replicaResult) error {
+	var failures []error
+	for _, result := range results {
+		if result.err != nil {
+			failures = append(failures, fmt.Errorf("replica %s: %w", result.name, result.err))
+		}
+	}
+	if len(results)-len(failures) >= b.quorum {
+		return nil
+	}
+	return errors.Join(failures...)
+}
+
+// CreateFolder creates the folder on every replica
+func (b *replicatedBackend) CreateFolder(ctx context.Context, folderName string) error {
+	return b.check(b.each(ctx, func(ctx context.Context, backend UploadBackend) error {
+		return backend.CreateFolder(ctx, folderName)
+	}))
+}
+
+// PutFile stores the file on every replica
+func (b *replicatedBackend) PutFile(ctx context.Context, folderName, filename string, data io.Reader) error {
+	results, err := b.PutFileReplicated(ctx, folderName, filename, data)
+	if err != nil {
+		return err
+	}
+	return b.check(results)
+}
+
+// PutFileReplicated stores the file on every replica and returns the outcome
+// for each of them. data can only be read once, so it is first copied to a
+// temporary file that each replica then reads independently. When the quorum
+// is missed the upload fails, so the file is deleted again from the replicas
+// that stored it; otherwise a retry would find it there.
+func (b *replicatedBackend) PutFileReplicated(ctx context.Context, folderName, filename string, data io.Reader) ([]replicaResult, error) {
+	spool, err := os.CreateTemp(appConfig.UploadTempDir, tempChunkPrefix+"replica-*")
+	if err != nil {
+		return nil, fmt.Errorf("could not buffer file for replication: %w", err)
+	}
+	defer os.Remove(spool.Name())
+	defer spool.Close()
+	size, err := io.Copy(spool, data)
+	if err != nil {
+		return nil, fmt.Errorf("could not buffer file for replication: %w", err)
+	}
+
+	results := b.each(ctx, func(ctx context.Context, backend UploadBackend) error {
+		return backend.PutFile(ctx, folderName, filename, io.NewSectionReader(spool, 0, size))
+	})
+	if b.check(results) != nil {
+		b.rollback(ctx, results, folderName, filename)
+	}
+	return results, nil
+}
+
+// rollback deletes the file from the replicas on which results records a
+// success. Like rollbackUpload it is best effort and only logs failures.
+func (b *replicatedBackend) rollback(ctx context.Context, results []replicaResult, folderName, filename string) {
+	logger := loggerFrom(ctx).With("folderName", folderName, "fileName", filename)
+	for i, result := range results {
+		if result.err != nil {
+			continue
+		}
+		// Roll back even when the request was cancelled, or the file stays behind
+		if err := b.replicas[i].backend.DeleteFile(context.WithoutCancel(ctx), folderName, filename); err != nil {
+			logger.Error("Could not roll back file on replica", "replica", result.name, "error", err)
+			continue
+		}
+		logger.Info("Rolled back file on replica", "replica", result.name)
+	}
+}
+
+// CreateFile creates the file on every replica. Replicas that already have it
+// count as successful; errFileExists is returned if the first one had it.
+func (b *replicatedBackend) CreateFile(ctx context.Context, folderName, filename string, data io.Reader) error {
+	content, err := io.ReadAll(data)
+	if err != nil {
+		return fmt.Errorf("could not read file data: %w", err)
+	}
+	var existed bool // Only written by the goroutine of the first replica
+	results := b.each(ctx, func(ctx context.Context, backend UploadBackend) error {
+		err := backend.CreateFile(ctx, folderName, filename, bytes.NewReader(content))
+		if errors.Is(err, errFileExists) {
+			if backend == b.replicas[0].backend {
+				existed = true
+			}
+			return nil
+		}
+		return err
+	})
+	if err := b.check(results); err != nil {
+		return err
+	}
+	if existed {
+		return errFileExists
+	}
+	return nil
+}
+
+// FileExists asks the first replica, which all others mirror
+func (b *replicatedBackend) FileExists(ctx context.Context, folderName, filename string) bool {
+	return b.replicas[0].backend.FileExists(ctx, folderName, filename)
+}
+
+// DeleteFile deletes the file on every replica
+func (b *replicatedBackend) DeleteFile(ctx context.Context, folderName, filename string) error {
+	return b.check(b.each(ctx, func(ctx context.Context, backend UploadBackend) error {
+		return backend.DeleteFile(ctx, folderName, filename)
+	}))
+}
+
+// CheckConnectivity checks that enough replicas are reachable to reach the quorum
+func (b *replicatedBackend) CheckConnectivity(ctx context.Context) error {
+	return b.check(b.each(ctx, func(ctx context.Context, backend UploadBackend) error {
+		return backend.CheckConnectivity(ctx)
+	}))
+}
+
+// replicaSummary lists the names of the replicas that succeeded and failed
+func replicaSummary(results []replicaResult) (succeeded, failed []string) {
+	for _, result := range results {
+		if result.err != nil {
+			failed = append(failed, result.name)
+		} else {
+			succeeded = append(succeeded, result.name)
+		}
+	}
+	return succeeded, failed
+}
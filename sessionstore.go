@@ -0,0 +1,286 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// errSessionNotFound is returned by a SessionStore for unknown session IDs
+var errSessionNotFound = errors.New("session not found")
+
+// SessionStore tracks multi-file upload sessions. Implementations shared between
+// instances (like Redis) let several replicas serve chunks of the same session.
+type SessionStore interface {
+	// Create registers a new session, replacing any existing one with the same ID.
+	Create(ctx context.Context, sessionID string, session *UploadSession) error
+	// Get returns a snapshot of the session or errSessionNotFound.
+	Get(ctx context.Context, sessionID string) (*UploadSession, error)
+	// IncrementCompleted atomically marks file as one more completed file and returns
+	// a snapshot of the session after the increment, or errSessionNotFound.
+	IncrementCompleted(ctx context.Context, sessionID string, file SessionFile) (*UploadSession, error)
+	// Delete removes the session. Deleting an unknown session is not an error.
+	Delete(ctx context.Context, sessionID string) error
+	// Count returns the number of sessions currently stored.
+	Count(ctx context.Context) (int, error)
+}
+
+// sessionStore is the store used by the HTTP handlers
+var sessionStore SessionStore
+
+// newSessionStore creates the session store selected by the configuration
+func newSessionStore(cfg Config) (SessionStore, error) {
+	switch cfg.SessionStore {
+	case "", "memory":
+		return newMemorySessionStore(), nil
+	case "redis":
+		return newRedisSessionStore(cfg.RedisAddr, cfg.SessionTTL)
+	default:
+		return nil, fmt.Errorf("unknown session store %q", cfg.SessionStore)
+	}
+}
+
+// snapshot copies the session fields without the mutex. The caller must hold the session lock.
+func (s *UploadSession) snapshot() *UploadSession {
+	return &UploadSession{
+		Email:          s.Email,
+		Phone:          s.Phone,
+		DataOrigin:     s.DataOrigin,
+		UploadCount:    s.UploadCount,
+		CompletedCount: s.CompletedCount,
+		CreatedAt:      s.CreatedAt,
+		Target:         s.Target,
+		Deadline:       s.Deadline,
+		Files:          slices.Clone(s.Files),
+		FolderName:     s.FolderName,
+	}
+}
+
+// memorySessionStore keeps sessions in a process-local map
+type memorySessionStore struct {
+	mu       sync.RWMutex
+	sessions map[string]*UploadSession
+}
+
+// newMemorySessionStore creates an empty in-memory session store
+func newMemorySessionStore() *memorySessionStore {
+	return &memorySessionStore{sessions: make(map[string]*UploadSession)}
+}
+
+func (s *memorySessionStore) Create(ctx context.Context, sessionID string, session *UploadSession) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sessions[sessionID] = session
+	return nil
+}
+
+func (s *memorySessionStore) Get(ctx context.Context, sessionID string) (*UploadSession, error) {
+	s.mu.RLock()
+	session, exists := s.sessions[sessionID]
+	s.mu.RUnlock()
+	if !exists {
+		return nil, errSessionNotFound
+	}
+
+	session.Mutex.RLock()
+	defer session.Mutex.RUnlock()
+	return session.snapshot(), nil
+}
+
+func (s *memorySessionStore) IncrementCompleted(ctx context.Context, sessionID string, file SessionFile) (*UploadSession, error) {
+	s.mu.RLock()
+	session, exists := s.sessions[sessionID]
+	s.mu.RUnlock()
+	if !exists {
+		return nil, errSessionNotFound
+	}
+
+	session.Mutex.Lock()
+	defer session.Mutex.Unlock()
+	session.CompletedCount++
+	session.Files = append(session.Files, file)
+	return session.snapshot(), nil
+}
+
+func (s *memorySessionStore) Delete(ctx context.Context, sessionID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.sessions, sessionID)
+	return nil
+}
+
+func (s *memorySessionStore) Count(ctx context.Context) (int, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return len(s.sessions), nil
+}
+
+// deleteOlderThan removes sessions created before cutoff and returns their IDs
+func (s *memorySessionStore) deleteOlderThan(cutoff time.Time) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var expired []string
+	for sessionID, session := range s.sessions {
+		if session.CreatedAt.Before(cutoff) {
+			delete(s.sessions, sessionID)
+			expired = append(expired, sessionID)
+		}
+	}
+	return expired
+}
+
+// redisSessionStore keeps each session in a Redis hash that expires after the session TTL
+type redisSessionStore struct {
+	client *redis.Client
+	ttl    time.Duration
+}
+
+// redisIncrementScript increments the completed counter and stores the file
+// under "file:<count>", only if the session still exists
+var redisIncrementScript = redis.NewScript(`
+if redis.call("EXISTS", KEYS[1]) == 0 then
+	return false
+end
+local completed = redis.call("HINCRBY", KEYS[1], "completedCount", 1)
+redis.call("HSET", KEYS[1], "file:" .. completed, ARGV[1])
+return completed
+`)
+
+// newRedisSessionStore connects to the Redis server at addr
+func newRedisSessionStore(addr string, ttl time.Duration) (*redisSessionStore, error) {
+	if addr == "" {
+		return nil, errors.New("REDIS_ADDR must be set when using the redis session store")
+	}
+	client := redis.NewClient(&redis.Options{Addr: addr})
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := client.Ping(ctx).Err(); err != nil {
+		return nil, fmt.Errorf("could not connect to Redis at %s: %w", addr, err)
+	}
+	return &redisSessionStore{client: client, ttl: ttl}, nil
+}
+
+// redisSessionKeyPrefix prefixes the key of every session hash
+const redisSessionKeyPrefix = "uploader:session:"
+
+func redisSessionKey(sessionID string) string {
+	return redisSessionKeyPrefix + sessionID
+}
+
+// unixOrZero stores zero times as 0 rather than a large negative Unix time
+func unixOrZero(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.Unix()
+}
+
+// timeOrZero is the inverse of unixOrZero
+func timeOrZero(unix int64) time.Time {
+	if unix == 0 {
+		return time.Time{}
+	}
+	return time.Unix(unix, 0)
+}
+
+func (s *redisSessionStore) Create(ctx context.Context, sessionID string, session *UploadSession) error {
+	key := redisSessionKey(sessionID)
+	_, err := s.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Del(ctx, key)
+		pipe.HSet(ctx, key,
+			"email", session.Email,
+			"phone", session.Phone,
+			"dataOrigin", session.DataOrigin,
+			"uploadCount", session.UploadCount,
+			"completedCount", session.CompletedCount,
+			"createdAt", session.CreatedAt.Unix(),
+			"target", session.Target,
+			"deadline", unixOrZero(session.Deadline),
+			"folderName", session.FolderName,
+		)
+		if s.ttl > 0 {
+			pipe.Expire(ctx, key, s.ttl)
+		}
+		return nil
+	})
+	return err
+}
+
+func (s *redisSessionStore) Get(ctx context.Context, sessionID string) (*UploadSession, error) {
+	fields, err := s.client.HGetAll(ctx, redisSessionKey(sessionID)).Result()
+	if err != nil {
+		return nil, err
+	}
+	if len(fields) == 0 {
+		return nil, errSessionNotFound
+	}
+	uploadCount, _ := strconv.Atoi(fields["uploadCount"])
+	completedCount, _ := strconv.Atoi(fields["completedCount"])
+	createdAt, _ := strconv.ParseInt(fields["createdAt"], 10, 64)
+	deadline, _ := strconv.ParseInt(fields["deadline"], 10, 64)
+
+	// Files are stored by completion number, so order them by it
+	var files []SessionFile
+	for n := 1; n <= completedCount; n++ {
+		var file SessionFile
+		if err := json.Unmarshal([]byte(fields["file:"+strconv.Itoa(n)]), &file); err == nil {
+			files = append(files, file)
+		}
+	}
+	return &UploadSession{
+		Email:          fields["email"],
+		Phone:          fields["phone"],
+		DataOrigin:     fields["dataOrigin"],
+		UploadCount:    uploadCount,
+		CompletedCount: completedCount,
+		CreatedAt:      time.Unix(createdAt, 0),
+		Target:         fields["target"],
+		Deadline:       timeOrZero(deadline),
+		Files:          files,
+		FolderName:     fields["folderName"],
+	}, nil
+}
+
+func (s *redisSessionStore) IncrementCompleted(ctx context.Context, sessionID string, file SessionFile) (*UploadSession, error) {
+	encoded, err := json.Marshal(file)
+	if err != nil {
+		return nil, err
+	}
+	completed, err := redisIncrementScript.Run(ctx, s.client, []string{redisSessionKey(sessionID)}, encoded).Int()
+	if errors.Is(err, redis.Nil) {
+		return nil, errSessionNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	session, err := s.Get(ctx, sessionID)
+	if err != nil {
+		return nil, err
+	}
+	// Report the value of our own increment, not one made concurrently by another instance
+	session.CompletedCount = completed
+	return session, nil
+}
+
+func (s *redisSessionStore) Delete(ctx context.Context, sessionID string) error {
+	return s.client.Del(ctx, redisSessionKey(sessionID)).Err()
+}
+
+// Count scans the session keys, so it is meant for limits and monitoring
+// rather than hot paths. Expired sessions are already gone from Redis.
+func (s *redisSessionStore) Count(ctx context.Context) (int, error) {
+	count := 0
+	iter := s.client.Scan(ctx, 0, redisSessionKeyPrefix+"*", 100).Iterator()
+	for iter.Next(ctx) {
+		count++
+	}
+	return count, iter.Err()
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+)
+
+// ocsShareResponse is the subset of the OCS share API response we need.
+// The same struct decodes both the JSON and the XML representation.
+type ocsShareResponse struct {
+	Ocs struct {
+		Meta struct {
+			Status     string `json:"status" xml:"status"`
+			StatusCode int    `json:"statuscode" xml:"statuscode"`
+			Message    string `json:"message" xml:"message"`
+		} `json:"meta" xml:"meta"`
+		Data struct {
+			Token string `json:"token" xml:"token"`
+			URL   string `json:"url" xml:"url"`
+		} `json:"data" xml:"data"`
+	} `json:"ocs"`
+}
+
+// createPublicShare creates a public link share using the default client
+func createPublicShare(folderName string) (string, error) {
+	return nextcloud.CreatePublicShare(context.Background(), folderName)
+}
+
+// CreatePublicShare creates a public link share for a folder inside the upload
+// directory using the Nextcloud OCS Share API and returns its URL.
+func (c *NextcloudClient) CreatePublicShare(ctx context.Context, folderName string) (string, error) {
+	shareURL := fmt.Sprintf("%s/ocs/v2.php/apps/files_sharing/api/v1/shares?format=json", c.BaseURL)
+	form := url.Values{
+		"path":      {path.Join("/", c.UploadDir, folderName)},
+		"shareType": {"3"}, // Public link
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+	req, err := c.newRequest(ctx, http.MethodPost, shareURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("OCS-APIRequest", "true")
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	resp, err := c.do(req)
+	observeNextcloudRequest("share", err)
+	if err != nil {
+		return "", fmt.Errorf("request execution failed: %w", err)
+	}
+	defer drainAndClose(resp.Body)
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", fmt.Errorf("could not read response: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("bad response from Nextcloud: %s (body: %s)", resp.Status, string(body))
+	}
+
+	// Older servers may ignore format=json and answer with XML
+	var share ocsShareResponse
+	if strings.Contains(resp.Header.Get("Content-Type"), "xml") {
+		err = xml.Unmarshal(body, &share.Ocs)
+	} else {
+		err = json.Unmarshal(body, &share)
+	}
+	if err != nil {
+		return "", fmt.Errorf("could not parse share response: %w", err)
+	}
+
+	if share.Ocs.Data.URL != "" {
+		return share.Ocs.Data.URL, nil
+	}
+	if share.Ocs.Data.Token != "" {
+		return fmt.Sprintf("%s/s/%s", c.BaseURL, share.Ocs.Data.Token), nil
+	}
+	return "", fmt.Errorf("share response contained no URL or token (status: %s, message: %s)", share.Ocs.Meta.Status, share.Ocs.Meta.Message)
+}
@@ -0,0 +1,311 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// streamTransfer is an upload whose chunks are forwarded into a Nextcloud
+// chunked upload as they arrive, with STREAM_CHUNKS, instead of being stored
+// in the temp directory. Only what /upload-complete needs is kept: the size,
+// a running hash and the first bytes for content sniffing.
+type streamTransfer struct {
+	mu          sync.Mutex
+	client      *NextcloudClient
+	transferURL string
+	created     bool // The transfer directory exists in Nextcloud
+	nextIndex   int  // Chunks must arrive in order, this is the one expected next
+	size        int64
+	hasher      hash.Hash
+	head        []byte    // Up to sniffLength bytes from the start of the file
+	fileName    string    // Multipart file name of the first chunk
+	lastActive  time.Time // Guarded by streamTransfersMu
+	assembled   bool      // Moved into its folder, so nothing is left to discard
+}
+
+// sniffLength is how many bytes http.DetectContentType looks at
+const sniffLength = 512
+
+// Streamed uploads live in memory, so a deployment using STREAM_CHUNKS must
+// route all requests of an upload to the same replica
+var (
+	streamTransfersMu sync.Mutex
+	streamTransfers   = make(map[string]*streamTransfer)
+)
+
+// lookupStreamTransfer returns the streamed upload with the ID, or nil
+func lookupStreamTransfer(uploadID string) *streamTransfer {
+	streamTransfersMu.Lock()
+	defer streamTransfersMu.Unlock()
+	return streamTransfers[uploadID]
+}
+
+// openStreamTransfer returns the streamed upload with the ID, registering a
+// new one going to client if there is none yet, and marks it as active
+func openStreamTransfer(uploadID string, client *NextcloudClient) (*streamTransfer, error) {
+	streamTransfersMu.Lock()
+	defer streamTransfersMu.Unlock()
+	if t, ok := streamTransfers[uploadID]; ok {
+		t.lastActive = time.Now()
+		return t, nil
+	}
+	transferURL, err := client.newTransferURL()
+	if err != nil {
+		return nil, err
+	}
+	t := &streamTransfer{client: client, transferURL: transferURL, hasher: sha256.New(), lastActive: time.Now()}
+	streamTransfers[uploadID] = t
+	return t, nil
+}
+
+// removeStreamTransfer forgets a streamed upload and, unless it was already
+// assembled, deletes its chunks from Nextcloud. Removing an unknown upload does nothing.
+func removeStreamTransfer(ctx context.Context, uploadID string) {
+	streamTransfersMu.Lock()
+	t, ok := streamTransfers[uploadID]
+	delete(streamTransfers, uploadID)
+	streamTransfersMu.Unlock()
+	if !ok {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.created && !t.assembled && !t.client.DryRun {
+		t.client.discardTransfer(ctx, t.transferURL)
+	}
+}
+
+// removeStaleStreamTransfers discards streamed uploads that received no chunk
+// since cutoff and returns how many were removed
+func removeStaleStreamTransfers(cutoff time.Time) int {
+	streamTransfersMu.Lock()
+	var stale []string
+	for uploadID, t := range streamTransfers {
+		if t.lastActive.Before(cutoff) {
+			stale = append(stale, uploadID)
+		}
+	}
+	streamTransfersMu.Unlock()
+
+	for _, uploadID := range stale {
+		removeStreamTransfer(context.Background(), uploadID)
+		slog.Info("Removed stale streamed upload", "uploadId", uploadID)
+	}
+	return len(stale)
+}
+
+var (
+	// errChunkOutOfOrder is returned for a streamed chunk that skips ahead of the next expected one
+	errChunkOutOfOrder = errors.New("chunk out of order")
+	// errTooManyChunks is returned for a streamed chunk past MAX_CHUNKS_PER_UPLOAD
+	errTooManyChunks = errors.New("too many chunks")
+	// errUploadTooLarge is returned for a streamed chunk that takes the upload past MAX_UPLOAD_BYTES
+	errUploadTooLarge = errors.New("upload too large")
+)
+
+// forward sends one chunk to Nextcloud. A chunk that was already forwarded
+// is acknowledged without sending it again, so clients can retry a chunk
+// whose response got lost.
+func (t *streamTransfer) forward(ctx context.Context, index int, chunk []byte, fileName string) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if index < t.nextIndex {
+		return nil
+	}
+	if index > t.nextIndex {
+		return errChunkOutOfOrder
+	}
+	// Checked here rather than at completion, as the chunks are already in Nextcloud by then
+	if appConfig.MaxChunksPerUpload > 0 && t.nextIndex >= appConfig.MaxChunksPerUpload {
+		return errTooManyChunks
+	}
+	if appConfig.MaxUploadBytes > 0 && t.size+int64(len(chunk)) > appConfig.MaxUploadBytes {
+		return errUploadTooLarge
+	}
+
+	if !t.client.DryRun {
+		if !t.created {
+			if err := t.client.createTransfer(ctx, t.transferURL); err != nil {
+				return err
+			}
+			t.created = true
+		}
+		// Nextcloud assembles chunks in the order of their names
+		chunkURL := fmt.Sprintf("%s/%06d", t.transferURL, index+1)
+		err := t.client.uploadChunkResumable(ctx, chunkURL, chunk)
+		observeNextcloudRequest("stream-chunk", err)
+		if err != nil {
+			return err
+		}
+	} else {
+		slog.Info("DRY RUN: would forward chunk to Nextcloud", "chunkIndex", index, "bytes", len(chunk))
+	}
+
+	if index == 0 {
+		t.fileName = fileName
+	}
+	if missing := sniffLength - len(t.head); missing > 0 {
+		t.head = append(t.head, chunk[:min(missing, len(chunk))]...)
+	}
+	t.hasher.Write(chunk)
+	t.size += int64(len(chunk))
+	t.nextIndex++
+	return nil
+}
+
+// fileNameOfFirstChunk returns the multipart file name sent with chunk 0
+func (t *streamTransfer) fileNameOfFirstChunk() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.fileName
+}
+
+// firstBytes returns up to sniffLength bytes from the start of the file
+func (t *streamTransfer) firstBytes() []byte {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.head
+}
+
+// chunks returns how many chunks have been forwarded
+func (t *streamTransfer) chunks() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.nextIndex
+}
+
+// totalSize returns the number of bytes forwarded
+func (t *streamTransfer) totalSize() int64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.size
+}
+
+// sha256 returns the hex SHA-256 of the bytes forwarded so far
+func (t *streamTransfer) sha256() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return hex.EncodeToString(t.hasher.Sum(nil))
+}
+
+// assemble moves the forwarded chunks into folderName as filename
+func (t *streamTransfer) assemble(ctx context.Context, folderName, filename string) (err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.client.DryRun {
+		slog.Info("DRY RUN: would assemble streamed upload in Nextcloud", "folderName", folderName, "fileName", filename, "bytes", t.size)
+		return nil
+	}
+	defer func() { observeNextcloudRequest("stream-assemble", err) }()
+	if !t.created {
+		// An empty file never sent a chunk, so there is nothing to move
+		err = t.client.UploadFile(ctx, folderName, filename, strings.NewReader(""))
+	} else {
+		err = t.client.assembleTransfer(ctx, t.transferURL, folderName, filename)
+	}
+	if err == nil {
+		t.assembled = true
+	}
+	return err
+}
+
+// storeUpload stores the assembled file in the backend or, for a streamed
+// upload, moves the chunks already in Nextcloud into place. For a replicated
+// backend it also returns the outcome on each replica.
+func storeUpload(ctx context.Context, backend UploadBackend, streamed *streamTransfer, folderName, filename string, data io.Reader) ([]replicaResult, error) {
+	if streamed != nil {
+		return nil, streamed.assemble(ctx, folderName, filename)
+	}
+	if replicated, ok := backend.(*replicatedBackend); ok {
+		results, err := replicated.PutFileReplicated(ctx, folderName, filename, data)
+		if err != nil {
+			return nil, err
+		}
+		return results, replicated.check(results)
+	}
+	return nil, backend.PutFile(ctx, folderName, filename, data)
+}
+
+// forwardChunk handles a chunk with STREAM_CHUNKS: it is read into memory,
+// checked and forwarded into the upload's Nextcloud transfer right away.
+func forwardChunk(w http.ResponseWriter, r *http.Request, logger *slog.Logger, uploadID string, index int, sessionID, fileName string, chunkData io.Reader, gzipChunk *gzipChunkReader) {
+	chunk, err := io.ReadAll(io.LimitReader(chunkData, appConfig.ChunkSize+1))
+	if err != nil {
+		if gzipChunk != nil && gzipChunk.err != nil {
+			logger.Warn("Could not decompress chunk", "error", gzipChunk.err)
+			jsonErrorCode(w, errCodeInvalidInput, "Invalid gzip chunk.", http.StatusBadRequest)
+			return
+		}
+		logger.Error("Could not read chunk", "error", err)
+		jsonErrorCode(w, errCodeServerError, "Server error reading chunk.", http.StatusInternalServerError)
+		return
+	}
+	if int64(len(chunk)) > appConfig.ChunkSize {
+		jsonErrorCode(w, errCodeTooLarge, fmt.Sprintf("Chunk too large: maximum size is %d bytes.", appConfig.ChunkSize), http.StatusRequestEntityTooLarge)
+		return
+	}
+	if expectedHash := r.FormValue("chunkHash"); expectedHash != "" {
+		actualHash := fmt.Sprintf("%x", sha256.Sum256(chunk))
+		if !strings.EqualFold(actualHash, expectedHash) {
+			logger.Warn("Chunk hash mismatch", "expectedHash", expectedHash, "actualHash", actualHash)
+			jsonErrorCode(w, errCodeChecksumMismatch, "Chunk hash mismatch.", http.StatusUnprocessableEntity)
+			return
+		}
+	}
+
+	backend, err := backendForSession(r.Context(), sessionID)
+	if err != nil {
+		logger.Error("Could not resolve Nextcloud target", "error", err)
+		jsonErrorCode(w, errCodeServerError, "Could not resolve upload target.", http.StatusInternalServerError)
+		return
+	}
+	// validateConfig only allows STREAM_CHUNKS with the Nextcloud backend
+	nc := backend.(*NextcloudClient)
+	transfer, err := openStreamTransfer(uploadID, nc)
+	if err != nil {
+		logger.Error("Could not start streamed upload", "error", err)
+		jsonErrorCode(w, errCodeServerError, "Server error saving chunk file.", http.StatusInternalServerError)
+		return
+	}
+
+	err = transfer.forward(r.Context(), index, chunk, fileName)
+	switch {
+	case errors.Is(err, errChunkOutOfOrder):
+		expected := transfer.chunks()
+		logger.Warn("Rejected streamed chunk out of order", "expectedChunkIndex", expected)
+		jsonErrorCode(w, errCodeChunkMissing, fmt.Sprintf("Chunks must be sent in order: expected chunk %d.", expected), http.StatusConflict)
+		return
+	case errors.Is(err, errTooManyChunks):
+		logger.Warn("Too many chunks for upload", "chunks", transfer.chunks(), "maxChunks", appConfig.MaxChunksPerUpload)
+		jsonErrorCode(w, errCodeTooLarge, fmt.Sprintf("Too many chunks: maximum is %d per upload.", appConfig.MaxChunksPerUpload), http.StatusBadRequest)
+		return
+	case errors.Is(err, errUploadTooLarge):
+		logger.Warn("Upload exceeds maximum size", "totalBytes", transfer.totalSize()+int64(len(chunk)), "maxBytes", appConfig.MaxUploadBytes)
+		jsonErrorCode(w, errCodeTooLarge, fmt.Sprintf("File too large: maximum size is %d bytes.", appConfig.MaxUploadBytes), http.StatusRequestEntityTooLarge)
+		return
+	case errors.Is(err, errQuotaExceeded):
+		jsonErrorCode(w, errCodeQuotaExceeded, "Storage quota exceeded.", http.StatusInsufficientStorage)
+		return
+	case err != nil:
+		if abortedByClient(r, logger) {
+			return
+		}
+		logger.Error("Could not forward chunk to Nextcloud", "error", err)
+		jsonErrorCode(w, errCodeNextcloudDown, "Failed to upload to Nextcloud.", http.StatusBadGateway)
+		return
+	}
+
+	chunksReceivedTotal.Inc()
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprint(w, "Chunk uploaded successfully")
+}
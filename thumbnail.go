@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"net/http"
+)
+
+// thumbnailSize is the maximum width and height of generated thumbnails
+const thumbnailSize = 256
+
+// thumbnailPrefix is prepended to the original file name to name its thumbnail
+const thumbnailPrefix = "thumb_"
+
+// errNotThumbnailable is returned for files that are not JPEG or PNG images
+var errNotThumbnailable = errors.New("not a JPEG or PNG image")
+
+// generateThumbnail decodes the JPEG or PNG image in data and returns a
+// downscaled copy encoded in the same format. Images with more than maxPixels
+// pixels are refused before decoding so a small file cannot claim gigabytes of
+// memory; maxPixels of 0 disables the check.
+func generateThumbnail(data io.Reader, maxPixels int64) ([]byte, error) {
+	buffered := bufio.NewReader(data)
+	header, _ := buffered.Peek(512)
+	contentType := http.DetectContentType(header)
+	if contentType != "image/jpeg" && contentType != "image/png" {
+		return nil, errNotThumbnailable
+	}
+
+	// DecodeConfig only reads the header, so keep it in a buffer for the full decode
+	var consumed bytes.Buffer
+	config, _, err := image.DecodeConfig(io.TeeReader(buffered, &consumed))
+	if err != nil {
+		return nil, fmt.Errorf("could not read image header: %w", err)
+	}
+	if pixels := int64(config.Width) * int64(config.Height); maxPixels > 0 && pixels > maxPixels {
+		return nil, fmt.Errorf("image has %d pixels, maximum for thumbnails is %d", pixels, maxPixels)
+	}
+
+	var src image.Image
+	full := io.MultiReader(&consumed, buffered)
+	if contentType == "image/png" {
+		src, err = png.Decode(full)
+	} else {
+		src, err = jpeg.Decode(full)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not decode image: %w", err)
+	}
+
+	var out bytes.Buffer
+	thumb := downscale(src, thumbnailSize)
+	if contentType == "image/png" {
+		err = png.Encode(&out, thumb)
+	} else {
+		err = jpeg.Encode(&out, thumb, &jpeg.Options{Quality: 80})
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not encode thumbnail: %w", err)
+	}
+	return out.Bytes(), nil
+}
+
+// downscale shrinks src to fit in a size x size box keeping its aspect ratio,
+// averaging the source pixels covered by each thumbnail pixel. Images that
+// already fit are copied unchanged.
+func downscale(src image.Image, size int) image.Image {
+	bounds := src.Bounds()
+	srcW, srcH := bounds.Dx(), bounds.Dy()
+	dstW, dstH := srcW, srcH
+	if srcW > size || srcH > size {
+		if srcW >= srcH {
+			dstW, dstH = size, max(1, srcH*size/srcW)
+		} else {
+			dstW, dstH = max(1, srcW*size/srcH), size
+		}
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, dstW, dstH))
+	for y := 0; y < dstH; y++ {
+		y0 := bounds.Min.Y + y*srcH/dstH
+		y1 := max(y0+1, bounds.Min.Y+(y+1)*srcH/dstH)
+		for x := 0; x < dstW; x++ {
+			x0 := bounds.Min.X + x*srcW/dstW
+			x1 := max(x0+1, bounds.Min.X+(x+1)*srcW/dstW)
+
+			var r, g, b, a, n uint64
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					cr, cg, cb, ca := src.At(sx, sy).RGBA()
+					r, g, b, a = r+uint64(cr), g+uint64(cg), b+uint64(cb), a+uint64(ca)
+					n++
+				}
+			}
+			dst.Set(x, y, color.RGBA64{uint16(r / n), uint16(g / n), uint16(b / n), uint16(a / n)})
+		}
+	}
+	return dst
+}
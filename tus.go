@@ -0,0 +1,362 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// tusVersion is the only tus protocol version supported
+const tusVersion = "1.0.0"
+
+// tusBasePath is where tus clients create uploads; each upload lives below it
+const tusBasePath = "/files/"
+
+// tusMetadataFile holds the Upload-Metadata of a tus upload next to its range state
+const tusMetadataFile = "tus.json"
+
+// handleTus implements the core tus protocol with the creation and termination
+// extensions. Uploads are stored like range uploads, and the final PATCH
+// completes them through /upload-complete, so they get the same checks and
+// land in the same folders. The metadata keys filename, email, phone,
+// dataOrigin, sessionId and relativePath map to the fields of CompleteRequest.
+func handleTus(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Tus-Resumable", tusVersion)
+	if r.Method == http.MethodOptions {
+		w.Header().Set("Tus-Version", tusVersion)
+		w.Header().Set("Tus-Extension", "creation,termination")
+		if appConfig.MaxUploadBytes > 0 {
+			w.Header().Set("Tus-Max-Size", strconv.FormatInt(appConfig.MaxUploadBytes, 10))
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	if r.Header.Get("Tus-Resumable") != tusVersion {
+		w.Header().Set("Tus-Version", tusVersion)
+		jsonErrorCode(w, errCodeInvalidInput, "Unsupported tus version.", http.StatusPreconditionFailed)
+		return
+	}
+	if !hasUploadToken(r) {
+		jsonErrorCode(w, errCodeUnauthorized, "Missing or invalid upload token.", http.StatusUnauthorized)
+		return
+	}
+
+	uploadID := strings.TrimPrefix(r.URL.Path, tusBasePath)
+	if uploadID == "" {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		handleTusCreate(w, r)
+		return
+	}
+
+	// Security: Sanitize uploadID to prevent path traversal attacks.
+	cleanUploadID, ok := sanitizeUploadID(uploadID)
+	if !ok || cleanUploadID != uploadID {
+		http.NotFound(w, r)
+		return
+	}
+	switch r.Method {
+	case http.MethodHead:
+		handleTusHead(w, r, cleanUploadID)
+	case http.MethodPatch:
+		handleTusPatch(w, r, cleanUploadID)
+	case http.MethodDelete:
+		if err := removeRangeUpload(cleanUploadID); err != nil {
+			loggerFrom(r.Context()).Error("Could not remove terminated tus upload", "uploadId", cleanUploadID, "error", err)
+			jsonErrorCode(w, errCodeServerError, "Could not discard upload.", http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleTusCreate creates an empty upload of the size given by Upload-Length
+func handleTusCreate(w http.ResponseWriter, r *http.Request) {
+	total, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+	if err != nil || total < 0 {
+		jsonErrorCode(w, errCodeInvalidInput, "Missing or invalid Upload-Length header.", http.StatusBadRequest)
+		return
+	}
+	if appConfig.MaxUploadBytes > 0 && total > appConfig.MaxUploadBytes {
+		jsonErrorCode(w, errCodeTooLarge, fmt.Sprintf("File too large: maximum size is %d bytes.", appConfig.MaxUploadBytes), http.StatusRequestEntityTooLarge)
+		return
+	}
+	metadata, err := parseTusMetadata(r.Header.Get("Upload-Metadata"))
+	if err != nil {
+		jsonErrorCode(w, errCodeInvalidInput, fmt.Sprintf("Invalid Upload-Metadata header: %v.", err), http.StatusBadRequest)
+		return
+	}
+	if _, err := validateFileName(metadata["filename"]); err != nil {
+		jsonErrorCode(w, errCodeInvalidInput, fmt.Sprintf("Invalid file name: %v.", err), http.StatusBadRequest)
+		return
+	}
+	if !hasFreeDiskSpace(r.Context()) {
+		jsonErrorCode(w, errCodeInsufficientStorage, "Insufficient storage, please retry later.", http.StatusInsufficientStorage)
+		return
+	}
+
+	uploadID, err := newTusUploadID()
+	if err != nil {
+		loggerFrom(r.Context()).Error("Could not generate tus upload ID", "error", err)
+		jsonErrorCode(w, errCodeServerError, "Could not create upload.", http.StatusInternalServerError)
+		return
+	}
+	logger := loggerFrom(r.Context()).With("uploadId", uploadID)
+	if err := createTusUpload(uploadID, total, metadata); err != nil {
+		logger.Error("Could not create tus upload", "error", err)
+		jsonErrorCode(w, errCodeServerError, "Could not create upload.", http.StatusInternalServerError)
+		return
+	}
+	logger.Info("Created tus upload", "uploadLength", total)
+
+	w.Header().Set("Location", tusBasePath+uploadID)
+	w.WriteHeader(http.StatusCreated)
+}
+
+// handleTusHead reports how many bytes of an upload have been received
+func handleTusHead(w http.ResponseWriter, r *http.Request, uploadID string) {
+	state, err := loadRangeState(uploadID)
+	if errors.Is(err, fs.ErrNotExist) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		loggerFrom(r.Context()).Error("Could not read tus upload state", "uploadId", uploadID, "error", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Upload-Offset", strconv.FormatInt(tusOffset(state), 10))
+	w.Header().Set("Upload-Length", strconv.FormatInt(state.Total, 10))
+	w.WriteHeader(http.StatusOK)
+}
+
+// handleTusPatch appends the request body at Upload-Offset and completes the
+// upload once all bytes have arrived
+func handleTusPatch(w http.ResponseWriter, r *http.Request, uploadID string) {
+	if r.Header.Get("Content-Type") != "application/offset+octet-stream" {
+		jsonErrorCode(w, errCodeInvalidInput, "Content-Type must be application/offset+octet-stream.", http.StatusUnsupportedMediaType)
+		return
+	}
+	offset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil || offset < 0 {
+		jsonErrorCode(w, errCodeInvalidInput, "Missing or invalid Upload-Offset header.", http.StatusBadRequest)
+		return
+	}
+	logger := loggerFrom(r.Context()).With("uploadId", uploadID, "uploadOffset", offset)
+
+	state, err := loadRangeState(uploadID)
+	if errors.Is(err, fs.ErrNotExist) {
+		jsonErrorCode(w, errCodeChunkMissing, "Unknown upload.", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		logger.Error("Could not read tus upload state", "error", err)
+		jsonErrorCode(w, errCodeServerError, "Server error saving range.", http.StatusInternalServerError)
+		return
+	}
+	if metadata, err := loadTusMetadata(uploadID); err == nil && sessionExpired(r.Context(), metadata["sessionId"]) {
+		logger.Warn("Rejected tus data for expired session", "sessionId", metadata["sessionId"])
+		if err := removeRangeUpload(uploadID); err != nil {
+			logger.Error("Could not remove tus upload of expired session", "error", err)
+		}
+		rejectExpiredSession(w, logger, uploadID)
+		return
+	}
+	if offset != tusOffset(state) {
+		jsonErrorCode(w, errCodeInvalidInput, fmt.Sprintf("Upload-Offset %d does not match the upload offset %d.", offset, tusOffset(state)), http.StatusConflict)
+		return
+	}
+	if r.ContentLength < 0 {
+		jsonErrorCode(w, errCodeInvalidInput, "Missing Content-Length header.", http.StatusLengthRequired)
+		return
+	}
+	if offset+r.ContentLength > state.Total {
+		jsonErrorCode(w, errCodeTooLarge, "Request body exceeds Upload-Length.", http.StatusRequestEntityTooLarge)
+		return
+	}
+	if !hasFreeDiskSpace(r.Context()) {
+		jsonErrorCode(w, errCodeInsufficientStorage, "Insufficient storage, please retry later.", http.StatusInsufficientStorage)
+		return
+	}
+	release, ok := acquireChunkWrite(w, logger, uploadID)
+	if !ok {
+		return
+	}
+	defer release()
+
+	if r.ContentLength > 0 {
+		r.Body = http.MaxBytesReader(w, r.Body, r.ContentLength)
+		state, err = writeRange(uploadID, offset, r.ContentLength, state.Total, r.Body)
+		if errors.Is(err, errRangeShortBody) {
+			// The client resumes from the offset reported by HEAD
+			logger.Warn("tus request body ended early")
+			jsonErrorCode(w, errCodeInvalidInput, "Request body is shorter than its Content-Length.", http.StatusBadRequest)
+			return
+		}
+		if err != nil {
+			logger.Error("Could not save tus data", "error", err)
+			jsonErrorCode(w, errCodeServerError, "Server error saving range.", http.StatusInternalServerError)
+			return
+		}
+		chunksReceivedTotal.Inc()
+	}
+
+	newOffset := tusOffset(state)
+	w.Header().Set("Upload-Offset", strconv.FormatInt(newOffset, 10))
+	if newOffset < state.Total {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	completeTusUpload(w, r, uploadID)
+}
+
+// completeTusUpload runs the completed upload through handleUploadComplete,
+// answering with 204 on success and the completion error otherwise
+func completeTusUpload(w http.ResponseWriter, r *http.Request, uploadID string) {
+	logger := loggerFrom(r.Context()).With("uploadId", uploadID)
+	metadata, err := loadTusMetadata(uploadID)
+	if err != nil {
+		logger.Error("Could not read tus upload metadata", "error", err)
+		jsonErrorCode(w, errCodeServerError, "Error processing chunks.", http.StatusInternalServerError)
+		return
+	}
+	body, err := json.Marshal(CompleteRequest{
+		UploadID:     uploadID,
+		FileName:     metadata["filename"],
+		Email:        metadata["email"],
+		Phone:        metadata["phone"],
+		DataOrigin:   metadata["dataOrigin"],
+		SessionID:    metadata["sessionId"],
+		RelativePath: metadata["relativePath"],
+	})
+	if err != nil {
+		logger.Error("Could not encode tus completion", "error", err)
+		jsonErrorCode(w, errCodeServerError, "Error processing chunks.", http.StatusInternalServerError)
+		return
+	}
+
+	// The request keeps its context and headers, so logging, the client IP and
+	// the upload token carry over; Accept is dropped so no progress is streamed
+	complete := r.Clone(r.Context())
+	complete.Method = http.MethodPost
+	complete.Body, complete.ContentLength = io.NopCloser(bytes.NewReader(body)), int64(len(body))
+	complete.Header.Set("Content-Type", "application/json")
+	complete.Header.Del("Accept")
+
+	result := &capturedResponse{header: make(http.Header)}
+	handleUploadComplete(result, complete)
+	if result.status == http.StatusOK {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	for key, values := range result.header {
+		w.Header()[key] = values
+	}
+	w.WriteHeader(result.status)
+	w.Write(result.body.Bytes())
+}
+
+// capturedResponse buffers a response so it can be translated before sending
+type capturedResponse struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (c *capturedResponse) Header() http.Header { return c.header }
+
+func (c *capturedResponse) WriteHeader(status int) {
+	if c.status == 0 {
+		c.status = status
+	}
+}
+
+func (c *capturedResponse) Write(p []byte) (int, error) {
+	if c.status == 0 {
+		c.status = http.StatusOK
+	}
+	return c.body.Write(p)
+}
+
+// tusOffset returns the number of contiguous bytes received from the start
+func tusOffset(state *rangeState) int64 {
+	if len(state.Received) == 0 || state.Received[0][0] != 0 {
+		return 0
+	}
+	return state.Received[0][1]
+}
+
+// newTusUploadID generates a random 32 character hex upload ID
+func newTusUploadID() (string, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(id), nil
+}
+
+// createTusUpload stores the range state and metadata of a new upload
+func createTusUpload(uploadID string, total int64, metadata map[string]string) error {
+	dir := rangeUploadDir(uploadID)
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return fmt.Errorf("could not create range upload directory %s: %w", dir, err)
+	}
+	data, err := json.Marshal(metadata)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(filepath.Join(dir, tusMetadataFile), data, 0o600); err != nil {
+		return fmt.Errorf("could not save tus metadata: %w", err)
+	}
+	return saveRangeState(uploadID, &rangeState{Total: total})
+}
+
+// loadTusMetadata reads the metadata stored by createTusUpload
+func loadTusMetadata(uploadID string) (map[string]string, error) {
+	data, err := os.ReadFile(filepath.Join(rangeUploadDir(uploadID), tusMetadataFile))
+	if err != nil {
+		return nil, err
+	}
+	metadata := make(map[string]string)
+	if err := json.Unmarshal(data, &metadata); err != nil {
+		return nil, fmt.Errorf("could not parse tus metadata: %w", err)
+	}
+	return metadata, nil
+}
+
+// parseTusMetadata decodes an Upload-Metadata header: comma separated pairs
+// of a key and an optional base64 encoded value
+func parseTusMetadata(header string) (map[string]string, error) {
+	metadata := make(map[string]string)
+	if strings.TrimSpace(header) == "" {
+		return metadata, nil
+	}
+	for _, pair := range strings.Split(header, ",") {
+		key, encoded, _ := strings.Cut(strings.TrimSpace(pair), " ")
+		if key == "" {
+			return nil, errors.New("empty key")
+		}
+		value, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("value of %s is not base64", key)
+		}
+		metadata[key] = string(value)
+	}
+	return metadata, nil
+}
@@ -0,0 +1,25 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// Build information, set at build time with
+// -ldflags "-X main.version=... -X main.commit=... -X main.date=..."
+// (the names GoReleaser sets by default)
+var (
+	version = "dev"
+	commit  = "none"
+	date    = "unknown"
+)
+
+// handleVersion reports which build is running
+func handleVersion(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"version": version,
+		"commit":  commit,
+		"date":    date,
+	})
+}
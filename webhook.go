@@ -0,0 +1,77 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+const (
+	// webhookTimeout bounds the delivery of a single webhook call
+	webhookTimeout = 10 * time.Second
+	// webhookSignatureHeader carries the hex HMAC-SHA256 of the body when WEBHOOK_SECRET is set
+	webhookSignatureHeader = "X-Uploader-Signature"
+)
+
+// WebhookPayload is the JSON body posted to WEBHOOK_URL after a successful upload
+type WebhookPayload struct {
+	FolderName string `json:"folderName"`
+	FileName   string `json:"fileName"`
+	Email      string `json:"email"`
+	Phone      string `json:"phone"`
+	DataOrigin string `json:"dataOrigin"`
+	SessionID  string `json:"sessionId"`
+}
+
+// sendWebhook delivers the payload in the background. Failures are logged and counted
+// but never affect the upload response.
+func sendWebhook(logger *slog.Logger, payload WebhookPayload) {
+	if appConfig.WebhookURL == "" {
+		return
+	}
+	go func() {
+		if err := deliverWebhook(payload); err != nil {
+			logger.Error("Webhook delivery failed", "error", err)
+			webhookFailuresTotal.Inc()
+		}
+	}()
+}
+
+// deliverWebhook POSTs the payload, signing it when a shared secret is configured
+func deliverWebhook(payload WebhookPayload) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return fmt.Errorf("could not encode payload: %w", err)
+	}
+
+	req, err := http.NewRequest(http.MethodPost, appConfig.WebhookURL, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("could not create request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if appConfig.WebhookSecret != "" {
+		mac := hmac.New(sha256.New, []byte(appConfig.WebhookSecret))
+		mac.Write(body)
+		req.Header.Set(webhookSignatureHeader, "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+
+	client := &http.Client{Timeout: webhookTimeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("request execution failed: %w", err)
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("bad response from webhook: %s", resp.Status)
+	}
+	return nil
+}